@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/klemjul/build-my-own-in-go/git-go/internal"
+)
+
+const (
+	defaultBatchFormat = "%(objectname) %(objecttype) %(objectsize)"
+	// the flag package needs a value, a bare --batch is given this one
+	noBatchFormat = "\x00"
+)
+
+var batchAtomRegexp = regexp.MustCompile(`%\((objectname|objecttype|objectsize|rest)\)`)
+
+// https://git-scm.com/docs/git-cat-file
+func catFile(local *internal.LocalRepository, args []string, stdin io.Reader, stdout io.Writer) error {
+	catfile := flag.NewFlagSet("cat-file", flag.ExitOnError)
+	showType := catfile.Bool("t", false, "show the object type")
+	showSize := catfile.Bool("s", false, "show the object size")
+	exists := catfile.Bool("e", false, "exit with zero status if the object exists and is valid")
+	pretty := catfile.Bool("p", false, "pretty-print the object content")
+	batch := catfile.String("batch", "", "print the info and content of the objects read from stdin")
+	batchCheck := catfile.String("batch-check", "", "print the info of the objects read from stdin")
+	catfile.Parse(normalizeBatchFlags(args))
+
+	if *batch != "" || *batchCheck != "" {
+		if *batch != "" {
+			return catFileBatch(local, batchFormat(*batch), true, stdin, stdout)
+		}
+		return catFileBatch(local, batchFormat(*batchCheck), false, stdin, stdout)
+	}
+	if catfile.NArg() != 1 {
+		return errors.New("usage: gitgo cat-file (-t | -s | -e | -p) <object> | (--batch | --batch-check)[=<format>]")
+	}
+
+	sha, err := local.ResolveRevision(catfile.Arg(0))
+	if err == nil && !local.ObjectExists(sha) {
+		err = fmt.Errorf("Not a valid object name %v", catfile.Arg(0))
+	}
+	if *exists {
+		// only the exit status matters
+		if err != nil {
+			return exitStatus(1)
+		}
+		_, err = local.ReadTypedObject(sha)
+		if err != nil {
+			return exitStatus(1)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *showType || *showSize:
+		objType, content, err := local.ReadObjectWithType(sha)
+		if err != nil {
+			return err
+		}
+		if *showType {
+			fmt.Fprintln(stdout, objType)
+		} else {
+			fmt.Fprintln(stdout, len(content))
+		}
+	case *pretty:
+		object, err := local.ReadTypedObject(sha)
+		if err != nil {
+			return err
+		}
+		tree, isTree := object.(*internal.Tree)
+		if !isTree {
+			_, err = stdout.Write(object.Serialize())
+			return err
+		}
+		for _, entry := range tree.Entries {
+			objType, err := entry.Type()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(stdout, "%06s %v %v\t%v\n", entry.Mode, objType, entry.Sha, entry.Name)
+		}
+	default:
+		return errors.New("please provide one of -t, -s, -e or -p")
+	}
+	return nil
+}
+
+// normalizeBatchFlags gives the default format to bare --batch and --batch-check flags
+func normalizeBatchFlags(args []string) []string {
+	normalized := make([]string, len(args))
+	for i, arg := range args {
+		switch arg {
+		case "--batch", "-batch", "--batch-check", "-batch-check":
+			arg += "=" + noBatchFormat
+		}
+		normalized[i] = arg
+	}
+	return normalized
+}
+
+func batchFormat(format string) string {
+	if format == noBatchFormat {
+		return defaultBatchFormat
+	}
+	return format
+}
+
+// catFileBatch answers each object name read from stdin with a formatted line, followed by
+// the object content with withContent, the output is flushed after each object
+func catFileBatch(local *internal.LocalRepository, format string, withContent bool, stdin io.Reader, stdout io.Writer) error {
+	writer := bufio.NewWriter(stdout)
+	scanner := bufio.NewScanner(stdin)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	// with %(rest) the object name stops at the first whitespace
+	splitRest := strings.Contains(format, "%(rest)")
+	for scanner.Scan() {
+		name, rest := scanner.Text(), ""
+		if splitRest {
+			fields := strings.SplitN(strings.TrimLeft(name, " \t"), " ", 2)
+			name = fields[0]
+			if len(fields) > 1 {
+				rest = strings.TrimLeft(fields[1], " \t")
+			}
+		}
+
+		sha, err := local.ResolveRevision(name)
+		var objType string
+		var content []byte
+		if err == nil {
+			objType, content, err = local.ReadObjectWithType(sha)
+		}
+		if err != nil {
+			fmt.Fprintf(writer, "%v missing\n", name)
+		} else {
+			line := batchAtomRegexp.ReplaceAllStringFunc(format, func(atom string) string {
+				switch atom {
+				case "%(objectname)":
+					return sha
+				case "%(objecttype)":
+					return objType
+				case "%(objectsize)":
+					return fmt.Sprint(len(content))
+				}
+				return rest
+			})
+			fmt.Fprintln(writer, line)
+			if withContent {
+				writer.Write(content)
+				writer.WriteByte('\n')
+			}
+		}
+		err = writer.Flush()
+		if err != nil {
+			return fmt.Errorf("failed to write to stdout, %v", err)
+		}
+	}
+	return scanner.Err()
+}
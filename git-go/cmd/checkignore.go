@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/klemjul/build-my-own-in-go/git-go/internal"
+)
+
+// https://git-scm.com/docs/git-check-ignore
+func checkIgnore(local *internal.LocalRepository, args []string, stdin io.Reader, stdout io.Writer) error {
+	checkignore := flag.NewFlagSet("check-ignore", flag.ExitOnError)
+	verbose := checkignore.Bool("v", false, "show the matching pattern of each path")
+	checkignore.BoolVar(verbose, "verbose", false, "show the matching pattern of each path")
+	nonMatching := checkignore.Bool("n", false, "with -v, also show the paths matching no pattern")
+	checkignore.BoolVar(nonMatching, "non-matching", false, "with -v, also show the paths matching no pattern")
+	fromStdin := checkignore.Bool("stdin", false, "read the paths from stdin, one per line")
+	checkignore.Parse(args)
+	if *nonMatching && !*verbose {
+		return errors.New("--non-matching is only valid with --verbose")
+	}
+
+	pathnames := checkignore.Args()
+	if *fromStdin {
+		scanner := bufio.NewScanner(stdin)
+		for scanner.Scan() {
+			pathnames = append(pathnames, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read stdin, %v", err)
+		}
+	}
+	if len(pathnames) == 0 {
+		return errors.New("no path specified")
+	}
+
+	matches, err := local.CheckIgnore(pathnames)
+	if err != nil {
+		return err
+	}
+	ignored := 0
+	for i, match := range matches {
+		if match != nil && !match.Negated() {
+			ignored++
+		}
+		switch {
+		case match != nil && *verbose:
+			fmt.Fprintf(stdout, "%v:%v:%v\t%v\n", match.Source, match.Line, match.Pattern, pathnames[i])
+		case match != nil && !match.Negated():
+			fmt.Fprintln(stdout, pathnames[i])
+		case match == nil && *nonMatching:
+			fmt.Fprintf(stdout, "::\t%v\n", pathnames[i])
+		}
+	}
+	// like git, the exit status tells whether a path is ignored
+	if ignored == 0 {
+		return exitStatus(1)
+	}
+	return nil
+}
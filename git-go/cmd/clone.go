@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/klemjul/build-my-own-in-go/git-go/internal"
+)
+
+// the name of the remote a repository is cloned from
+const defaultRemote = "origin"
+
+// https://git-scm.com/docs/git-clone
+func clone(wd string, args []string) error {
+	clone := flag.NewFlagSet("clone", flag.ExitOnError)
+	branch := clone.String("branch", "", "check out a branch, or a tag detached, instead of the remote HEAD")
+	clone.StringVar(branch, "b", "", "check out a branch, or a tag detached, instead of the remote HEAD")
+	singleBranch := clone.Bool("single-branch", false, "only fetch the history of the checked out branch")
+	noTags := clone.Bool("no-tags", false, "do not fetch tags and do not follow them in later fetches")
+	positionals := []string{}
+	for clone.Parse(args); clone.NArg() > 0; clone.Parse(args) {
+		positionals = append(positionals, clone.Arg(0))
+		args = clone.Args()[1:]
+	}
+	if len(positionals) == 0 {
+		return errors.New("no clone url provided")
+	}
+	rawUrl := positionals[0]
+
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return fmt.Errorf("invalid clone url %v, %v", rawUrl, err)
+	}
+
+	pathParts := strings.Split(parsedUrl.Path, "/")
+	projectName := pathParts[len(pathParts)-1]
+
+	remote, err := internal.NewRemoteRepository(parsedUrl.String())
+	if err != nil {
+		return err
+	}
+	refs, err := remote.DiscoveringReferences()
+	if err != nil {
+		return err
+	}
+	options := cloneOptions{Head: remoteHead(refs), SingleBranch: *singleBranch, NoTags: *noTags}
+	options.Checkout = options.Head
+	if *branch != "" {
+		options.Checkout = findRemoteBranch(refs, *branch)
+		if options.Checkout == nil {
+			return fmt.Errorf("remote branch %v not found in upstream %v", *branch, defaultRemote)
+		}
+	}
+
+	local := internal.LocalRepository{
+		RootName: filepath.Join(wd, projectName),
+	}
+
+	fmt.Printf("Cloning into '%s'...\n", projectName)
+	err = os.Mkdir(local.RootName, 0755)
+	if err != nil {
+		return err
+	}
+
+	// never leave a half cloned repository behind
+	err = fetchClone(local, remote, cloneWants(refs, options), !options.NoTags)
+	if err == nil {
+		err = writeCloneRefs(&local, remote.BaseUrl, refs, options)
+	}
+	if err == nil && options.Checkout != nil {
+		_, err = local.CheckoutTree(options.Checkout.RefSha)
+	}
+	if err != nil {
+		os.RemoveAll(local.RootName)
+		return err
+	}
+	switch {
+	case len(refs) == 0:
+		fmt.Fprintln(os.Stderr, "warning: You appear to have cloned an empty repository.")
+	case options.Checkout == nil:
+		fmt.Fprintln(os.Stderr, "warning: remote HEAD refers to nonexistent ref, unable to checkout")
+	}
+	return nil
+}
+
+// cloneOptions are the refs a clone checks out and fetches
+type cloneOptions struct {
+	// the branch of the remote HEAD, or HEAD itself when detached
+	Head *internal.GitReference
+	// the branch or tag checked out, the remote HEAD without --branch
+	Checkout     *internal.GitReference
+	SingleBranch bool
+	NoTags       bool
+}
+
+// cloneWants returns the shas of the remote HEAD, the branches and the tags without duplicates,
+// only the checked out ref with a single branch, like git the tags pointing into its history are
+// then sent by the server with include-tag
+func cloneWants(refs []internal.GitReference, options cloneOptions) []string {
+	wants := []string{}
+	want := func(sha string) {
+		if !slices.Contains(wants, sha) {
+			wants = append(wants, sha)
+		}
+	}
+	if options.Checkout != nil {
+		want(options.Checkout.RefSha)
+	}
+	if options.SingleBranch {
+		return wants
+	}
+	for _, ref := range refs {
+		isTag := strings.HasPrefix(ref.Ref, "refs/tags/")
+		if ref.Ref == "HEAD" || strings.HasPrefix(ref.Ref, internal.BRANCH_PREFIX) || (isTag && !options.NoTags) {
+			want(ref.RefSha)
+		}
+	}
+	return wants
+}
+
+func fetchClone(local internal.LocalRepository, remote internal.RemoteRepository, wants []string, includeTag bool) error {
+	err := local.Init()
+	if err != nil || len(wants) == 0 {
+		return err
+	}
+
+	body, err := remote.FetchPack(wants, includeTag)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	// objects are written to the pack while the response is still being received, they are
+	// counted apart from the deltas resolved once the whole pack is stored
+	nbObjects, nbDeltas := 0, 0
+	index, err := local.WritePackFile(body, internal.PackFileHandler{
+		OnHeader: func(n int) error {
+			fmt.Printf("remote: Enumerating objects: %v, done.\n", n)
+			return nil
+		},
+		OnObject: func(object internal.GitObject) error {
+			nbObjects++
+			return nil
+		},
+		OnDelta: func(delta internal.GitObjectDelta) error {
+			nbDeltas++
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Receiving objects: (%v,%v), done.\n", nbObjects, nbObjects)
+	fmt.Printf("Receiving deltas: (%v,%v), done.\n", nbDeltas, nbDeltas)
+
+	// the advertised ref tips must have been received, tags may point to any kind of object
+	for _, sha := range wants {
+		if !index.Contains(sha) {
+			return fmt.Errorf("remote did not send object %v", sha)
+		}
+	}
+	return nil
+}
+
+// remoteHead returns the branch the remote HEAD points to, guessed from its sha when the server
+// does not advertise the symref, or HEAD itself when detached, nil without a remote HEAD
+func remoteHead(refs []internal.GitReference) *internal.GitReference {
+	var head *internal.GitReference
+	for i := range refs {
+		if refs[i].Ref == "HEAD" {
+			head = &refs[i]
+		}
+	}
+	if head == nil {
+		return nil
+	}
+	// like git, refs/heads/master is preferred among the branches matching HEAD
+	var guessed *internal.GitReference
+	for i := range refs {
+		if head.Symref != "" && refs[i].Ref == head.Symref {
+			return &refs[i]
+		}
+		if head.Symref == "" && strings.HasPrefix(refs[i].Ref, internal.BRANCH_PREFIX) && refs[i].RefSha == head.RefSha {
+			if guessed == nil || refs[i].Ref == internal.BRANCH_PREFIX+"master" {
+				guessed = &refs[i]
+			}
+		}
+	}
+	if guessed != nil {
+		return guessed
+	}
+	if head.Symref != "" {
+		return nil
+	}
+	return head
+}
+
+// findRemoteBranch returns the branch of --branch, or the tag with this name
+func findRemoteBranch(refs []internal.GitReference, name string) *internal.GitReference {
+	for _, prefix := range []string{internal.BRANCH_PREFIX, "refs/tags/"} {
+		for i := range refs {
+			if refs[i].Ref == prefix+name {
+				return &refs[i]
+			}
+		}
+	}
+	return nil
+}
+
+// writeCloneRefs writes the origin remote in the config, its remote-tracking branches and the tags,
+// then creates the checked out branch tracking its upstream and points HEAD at it
+// https://git-scm.com/docs/git-clone#_description
+func writeCloneRefs(local *internal.LocalRepository, url string, refs []internal.GitReference, options cloneOptions) error {
+	config, err := internal.OpenConfigFile(local.ConfigName())
+	if err != nil {
+		return err
+	}
+	err = config.Set("remote."+defaultRemote+".url", url)
+	if err == nil && options.NoTags {
+		err = config.Set("remote."+defaultRemote+".tagOpt", "--no-tags")
+	}
+	// like git, a single branch clone of a detached HEAD has no refspec and fetches HEAD
+	refspec := "+refs/heads/*:refs/remotes/" + defaultRemote + "/*"
+	if options.SingleBranch && options.Checkout != nil {
+		refspec = ""
+		if branch, ok := strings.CutPrefix(options.Checkout.Ref, internal.BRANCH_PREFIX); ok {
+			refspec = "+" + options.Checkout.Ref + ":refs/remotes/" + defaultRemote + "/" + branch
+		} else if strings.HasPrefix(options.Checkout.Ref, "refs/tags/") {
+			refspec = "+" + options.Checkout.Ref + ":" + options.Checkout.Ref
+		}
+	}
+	if err == nil && refspec != "" {
+		err = config.Set("remote."+defaultRemote+".fetch", refspec)
+	}
+	if err != nil {
+		return err
+	}
+
+	headTracked := false
+	for _, ref := range refs {
+		name := ref.Ref
+		isCheckout := options.Checkout != nil && name == options.Checkout.Ref
+		if branch, ok := strings.CutPrefix(name, internal.BRANCH_PREFIX); ok {
+			if options.SingleBranch && !isCheckout {
+				continue
+			}
+			headTracked = headTracked || (options.Head != nil && name == options.Head.Ref)
+			name = "refs/remotes/" + defaultRemote + "/" + branch
+		} else if !strings.HasPrefix(name, "refs/tags/") || (options.NoTags && !(isCheckout && options.SingleBranch)) {
+			continue
+		}
+		// like git, the tags whose objects were not sent are skipped
+		if !local.ObjectExists(ref.RefSha) {
+			continue
+		}
+		err = local.UpdateRef(name, ref.RefSha, internal.ZERO_SHA, false)
+		if err != nil {
+			return err
+		}
+	}
+	if headTracked {
+		branch := strings.TrimPrefix(options.Head.Ref, internal.BRANCH_PREFIX)
+		err = local.WriteSymbolicRef("refs/remotes/"+defaultRemote+"/HEAD", "refs/remotes/"+defaultRemote+"/"+branch)
+		if err != nil {
+			return err
+		}
+	}
+
+	checkout := options.Checkout
+	branch, isBranch := "", false
+	if checkout != nil {
+		branch, isBranch = strings.CutPrefix(checkout.Ref, internal.BRANCH_PREFIX)
+	}
+	switch {
+	case checkout == nil:
+	case !isBranch:
+		// a tag or a detached remote HEAD is checked out detached at its commit
+		sha := checkout.RefSha
+		if checkout.Peeled != "" {
+			sha = checkout.Peeled
+		}
+		err = local.UpdateRef("HEAD", sha, "", false)
+	default:
+		err = local.UpdateRef(checkout.Ref, checkout.RefSha, internal.ZERO_SHA, false)
+		if err == nil {
+			err = local.WriteSymbolicRef("HEAD", checkout.Ref)
+		}
+		if err == nil {
+			err = config.Set("branch."+branch+".remote", defaultRemote)
+		}
+		if err == nil {
+			err = config.Set("branch."+branch+".merge", checkout.Ref)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return config.Write()
+}
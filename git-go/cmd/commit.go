@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klemjul/build-my-own-in-go/git-go/internal"
+)
+
+// https://git-scm.com/docs/git-commit
+func commit(local *internal.LocalRepository, args []string, stdin io.Reader, stdout io.Writer) error {
+	commit := flag.NewFlagSet("commit", flag.ExitOnError)
+	paragraphs := []string{}
+	commit.Func("m", "commit message paragraph, can be given several times", func(value string) error {
+		paragraphs = append(paragraphs, value)
+		return nil
+	})
+	commit.Func("F", "read the commit message from a file, - for stdin", func(value string) error {
+		var content []byte
+		var err error
+		if value == "-" {
+			content, err = io.ReadAll(stdin)
+		} else {
+			content, err = os.ReadFile(value)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read commit message from %v, %v", value, err)
+		}
+		paragraphs = append(paragraphs, string(content))
+		return nil
+	})
+	amend := commit.Bool("amend", false, "replace the HEAD commit")
+	allowEmpty := commit.Bool("allow-empty", false, "allow a commit with the same tree as its parent")
+	commit.Parse(args)
+	if commit.NArg() > 0 {
+		return errors.New("committing paths is not supported, stage them with gitgo add")
+	}
+	if len(paragraphs) == 0 && !*amend {
+		return errors.New("please provide a commit message with -m or -F")
+	}
+
+	result, err := local.Commit(strings.Join(paragraphs, "\n\n"), *amend, *allowEmpty)
+	if errors.Is(err, internal.ErrNothingToCommit) {
+		fmt.Fprintln(stdout, "nothing to commit, use --allow-empty to record an empty commit")
+		return exitStatus(1)
+	}
+	if err != nil {
+		return err
+	}
+
+	summary := result.Branch
+	if summary == "" {
+		summary = "detached HEAD"
+	}
+	if result.Root {
+		summary += " (root-commit)"
+	}
+	created, err := local.ReadCommit(result.Sha)
+	if err != nil {
+		return err
+	}
+	// like git, the subject is the first paragraph on one line
+	subject, _, _ := strings.Cut(created.Message, "\n\n")
+	subject = strings.ReplaceAll(strings.TrimSpace(subject), "\n", " ")
+	fmt.Fprintf(stdout, "[%v %v] %v\n", summary, result.Sha[:7], subject)
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/klemjul/build-my-own-in-go/git-go/internal"
+)
+
+// https://git-scm.com/docs/git-commit-tree
+func commitTree(local *internal.LocalRepository, args []string, stdin io.Reader, stdout io.Writer) error {
+	committree := flag.NewFlagSet("commit-tree", flag.ExitOnError)
+	parents := []string{}
+	message := strings.Builder{}
+	messageGiven := false
+	committree.Func("p", "parent commit, can be given several times", func(value string) error {
+		parent, err := local.ResolveRevision(strings.TrimSpace(value))
+		if err != nil {
+			return err
+		}
+		if slices.Contains(parents, parent) {
+			fmt.Fprintf(os.Stderr, "duplicate parent %v ignored\n", parent)
+			return nil
+		}
+		parents = append(parents, parent)
+		return nil
+	})
+	// like git, each -m is a paragraph and -F files are taken as they are
+	committree.Func("m", "commit message paragraph, can be given several times", func(value string) error {
+		if message.Len() > 0 {
+			message.WriteString("\n")
+		}
+		message.WriteString(value)
+		if !strings.HasSuffix(value, "\n") {
+			message.WriteString("\n")
+		}
+		messageGiven = true
+		return nil
+	})
+	committree.Func("F", "read the commit message from a file, - for stdin", func(value string) error {
+		if message.Len() > 0 {
+			message.WriteString("\n")
+		}
+		var content []byte
+		var err error
+		if value == "-" {
+			content, err = io.ReadAll(stdin)
+		} else {
+			content, err = os.ReadFile(value)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read commit message from %v, %v", value, err)
+		}
+		message.Write(content)
+		messageGiven = true
+		return nil
+	})
+
+	// like git, the tree can be mixed with the options
+	positionals := []string{}
+	for committree.Parse(args); committree.NArg() > 0; committree.Parse(args) {
+		positionals = append(positionals, committree.Arg(0))
+		args = committree.Args()[1:]
+	}
+	if len(positionals) != 1 {
+		return errors.New("usage: gitgo commit-tree <tree> [(-p <parent>)...] [(-m <message>)...] [(-F <file>)...]")
+	}
+	tree := positionals[0]
+	treeSha, err := local.ResolveRevision(tree)
+	if err != nil {
+		return err
+	}
+	if !messageGiven {
+		content, err := io.ReadAll(stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read commit message from stdin, %v", err)
+		}
+		message.Write(content)
+	}
+
+	commitSha, err := local.WriteCommitObject(treeSha, parents, nil, message.String())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, commitSha)
+	return nil
+}
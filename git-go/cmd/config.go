@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/klemjul/build-my-own-in-go/git-go/internal"
+)
+
+// git exits with 5 when a variable can not be unset or set
+const configExitInvalid = 5
+
+// https://git-scm.com/docs/git-config
+func config(local *internal.LocalRepository, args []string, stdout io.Writer) error {
+	config := flag.NewFlagSet("config", flag.ExitOnError)
+	global := config.Bool("global", false, "use the global config file")
+	system := config.Bool("system", false, "use the system config file")
+	localScope := config.Bool("local", false, "use the repository config file")
+	file := config.String("file", "", "use the given config file")
+	config.StringVar(file, "f", "", "use the given config file")
+	get := config.Bool("get", false, "get the last value of a key")
+	getAll := config.Bool("get-all", false, "get all the values of a multi-valued key")
+	unset := config.Bool("unset", false, "remove a key")
+	unsetAll := config.Bool("unset-all", false, "remove all the values of a multi-valued key")
+	add := config.Bool("add", false, "add a value to a key without replacing the existing ones")
+	list := config.Bool("list", false, "list all the variables")
+	config.BoolVar(list, "l", false, "list all the variables")
+	asBool := config.Bool("bool", false, "read and write the value as a boolean")
+	includes := config.Bool("includes", false, "follow the includes of a single config file")
+	config.Parse(args)
+
+	scope := ""
+	writeName := local.ConfigName()
+	switch {
+	case *file != "":
+		scope, writeName = "file", *file
+	case *global:
+		scope, writeName = internal.CONFIG_GLOBAL, local.GlobalConfigName()
+	case *system:
+		scope, writeName = internal.CONFIG_SYSTEM, local.ConfigFiles(internal.CONFIG_SYSTEM)[0]
+	case *localScope:
+		scope = internal.CONFIG_LOCAL
+	}
+	readConfig := func() (*internal.Config, error) {
+		switch scope {
+		case "":
+			return local.ReadConfig()
+		case "file":
+			return local.ReadConfigFileName(*file, *includes)
+		}
+		return local.ReadConfigScope(scope, *includes)
+	}
+
+	switch {
+	case *list:
+		if config.NArg() != 0 {
+			return errors.New("usage: gitgo config --list")
+		}
+		result, err := readConfig()
+		if err != nil {
+			return err
+		}
+		for _, entry := range result.Entries {
+			if entry.HasValue {
+				fmt.Fprintf(stdout, "%v=%v\n", entry.Key, entry.Value)
+			} else {
+				fmt.Fprintln(stdout, entry.Key)
+			}
+		}
+	case *get || *getAll || (config.NArg() == 1 && !*unset && !*unsetAll):
+		if config.NArg() != 1 {
+			return errors.New("usage: gitgo config --get <key>")
+		}
+		key := config.Arg(0)
+		err := internal.ValidateConfigKey(key)
+		if err != nil {
+			return err
+		}
+		result, err := readConfig()
+		if err != nil {
+			return err
+		}
+		values := result.GetAll(key)
+		if len(values) == 0 {
+			return exitStatus(1)
+		}
+		if !*getAll {
+			values = values[len(values)-1:]
+		}
+		if *asBool && !*getAll {
+			// a variable without value is true, its value is empty
+			boolValue, err := result.GetBool(key, false)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(stdout, boolValue)
+			return nil
+		}
+		for _, value := range values {
+			if *asBool {
+				boolValue, err := internal.ParseConfigBool(value)
+				if err != nil {
+					return err
+				}
+				value = fmt.Sprint(boolValue)
+			}
+			fmt.Fprintln(stdout, value)
+		}
+	case *unset || *unsetAll:
+		if config.NArg() != 1 {
+			return errors.New("usage: gitgo config --unset <key>")
+		}
+		return editConfig(writeName, func(configFile *internal.ConfigFile) error {
+			return configFile.Unset(config.Arg(0), *unsetAll)
+		})
+	case config.NArg() == 2:
+		err := internal.ValidateConfigKey(config.Arg(0))
+		if err != nil {
+			return err
+		}
+		value := config.Arg(1)
+		if *asBool {
+			boolValue, err := internal.ParseConfigBool(value)
+			if err != nil {
+				return err
+			}
+			value = fmt.Sprint(boolValue)
+		}
+		return editConfig(writeName, func(configFile *internal.ConfigFile) error {
+			if *add {
+				return configFile.Add(config.Arg(0), value)
+			}
+			return configFile.Set(config.Arg(0), value)
+		})
+	default:
+		return errors.New("usage: gitgo config [--global | --system | --local | -f <file>] [--get | --get-all | --unset | --unset-all | --add | --list] [<key> [<value>]]")
+	}
+	return nil
+}
+
+// editConfig applies a change to a config file and writes it, a variable that can not be
+// changed exits with git's status
+func editConfig(filename string, edit func(configFile *internal.ConfigFile) error) error {
+	configFile, err := internal.OpenConfigFile(filename)
+	if err != nil {
+		return err
+	}
+	err = edit(configFile)
+	if errors.Is(err, internal.ErrConfigKeyNotFound) {
+		return exitStatus(configExitInvalid)
+	}
+	if err != nil {
+		return &exitError{code: configExitInvalid, err: err}
+	}
+	return configFile.Write()
+}
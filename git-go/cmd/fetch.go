@@ -0,0 +1,513 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/klemjul/build-my-own-in-go/git-go/internal"
+)
+
+// like git, the refs of FETCH_HEAD to merge are written and reported first and the refs only
+// updated for a refspec given on the command line are not written
+const (
+	fetchHeadMerge = iota
+	fetchHeadNotForMerge
+	fetchHeadIgnore
+)
+
+// the width of the abbreviated old and new shas of an update in the fetch report
+const fetchSummaryWidth = 2*7 + 3
+
+// fetchedRef is a remote ref fetched to a local ref, only to FETCH_HEAD without Dst
+type fetchedRef struct {
+	Remote internal.GitReference
+	Dst    string
+	Force  bool
+	Status int
+}
+
+// https://git-scm.com/docs/git-fetch
+func fetch(local *internal.LocalRepository, args []string, stderr io.Writer) error {
+	fetch := flag.NewFlagSet("fetch", flag.ExitOnError)
+	positionals := []string{}
+	for fetch.Parse(args); fetch.NArg() > 0; fetch.Parse(args) {
+		positionals = append(positionals, fetch.Arg(0))
+		args = fetch.Args()[1:]
+	}
+
+	config, err := local.ReadConfig()
+	if err != nil {
+		return err
+	}
+	branch, err := local.CurrentBranch()
+	if err != nil {
+		return err
+	}
+	remoteName := defaultRemote
+	if name, ok := config.Get("branch." + branch + ".remote"); ok && branch != "" {
+		remoteName = name
+	}
+	if len(positionals) > 0 {
+		remoteName = positionals[0]
+	}
+	rawUrl, configured := config.Get("remote." + remoteName + ".url")
+	if !configured {
+		if !strings.Contains(remoteName, "://") {
+			return fmt.Errorf("'%v' does not appear to be a git repository", remoteName)
+		}
+		rawUrl = remoteName
+	}
+	configuredSpecs := []internal.Refspec{}
+	tagOpt := ""
+	if configured {
+		for _, value := range config.GetAll("remote." + remoteName + ".fetch") {
+			spec, err := internal.ParseRefspec(value)
+			if err != nil {
+				return err
+			}
+			configuredSpecs = append(configuredSpecs, spec)
+		}
+		tagOpt, _ = config.Get("remote." + remoteName + ".tagOpt")
+	}
+	specs := []internal.Refspec{}
+	for _, value := range positionals[min(1, len(positionals)):] {
+		spec, err := internal.ParseRefspec(value)
+		if err != nil {
+			return err
+		}
+		specs = append(specs, spec)
+	}
+
+	// like git, FETCH_HEAD is emptied even when the fetch fails
+	fetchHeadName := local.GitDir() + "/FETCH_HEAD"
+	err = os.WriteFile(fetchHeadName, nil, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write FETCH_HEAD, %v", err)
+	}
+
+	remote, err := internal.NewRemoteRepository(rawUrl)
+	if err != nil {
+		return err
+	}
+	refs, err := remote.DiscoveringReferences()
+	if err != nil {
+		return err
+	}
+
+	refMap := []fetchedRef{}
+	// like git, tags are only followed when a refspec stores refs
+	followTags := false
+	switch {
+	case len(specs) > 0:
+		for _, spec := range specs {
+			mapped, err := mapRefspec(refs, spec, fetchHeadMerge, false)
+			if err != nil {
+				return err
+			}
+			refMap = append(refMap, mapped...)
+			followTags = followTags || spec.Dst != ""
+		}
+		// the fetched refs also update their remote-tracking refs
+		fetched := []internal.GitReference{}
+		for _, ref := range refMap {
+			fetched = append(fetched, ref.Remote)
+		}
+		for _, spec := range configuredSpecs {
+			mapped, _ := mapRefspec(fetched, spec, fetchHeadIgnore, true)
+			refMap = append(refMap, mapped...)
+		}
+	case len(configuredSpecs) > 0:
+		merges := config.GetAll("branch." + branch + ".merge")
+		if branch == "" {
+			merges = []string{}
+		}
+		for i, spec := range configuredSpecs {
+			mapped, err := mapRefspec(refs, spec, fetchHeadNotForMerge, false)
+			if err != nil {
+				return err
+			}
+			refMap = append(refMap, mapped...)
+			followTags = followTags || spec.Dst != ""
+			// like git, a single branch is merged without a merge config
+			if i == 0 && len(merges) == 0 && len(refMap) > 0 && !spec.IsPattern() {
+				refMap[0].Status = fetchHeadMerge
+			}
+		}
+		if branchRemote, _ := config.Get("branch." + branch + ".remote"); branchRemote == remoteName {
+			for _, merge := range merges {
+				i := slices.IndexFunc(refMap, func(ref fetchedRef) bool {
+					return refNameMatches(merge, ref.Remote.Ref)
+				})
+				if i >= 0 {
+					refMap[i].Status = fetchHeadMerge
+					continue
+				}
+				mapped, _ := mapRefspec(refs, internal.Refspec{Src: merge}, fetchHeadMerge, true)
+				refMap = append(refMap, mapped...)
+			}
+		}
+	default:
+		mapped, err := mapRefspec(refs, internal.Refspec{Src: "HEAD"}, fetchHeadMerge, false)
+		if err != nil {
+			return err
+		}
+		refMap = append(refMap, mapped...)
+	}
+	switch {
+	case tagOpt == "--tags":
+		mapped, _ := mapRefspec(refs, internal.Refspec{Src: "refs/tags/*", Dst: "refs/tags/*"}, fetchHeadNotForMerge, true)
+		refMap = append(refMap, mapped...)
+	case tagOpt != "--no-tags" && followTags:
+		tips := []string{}
+		for _, ref := range refMap {
+			tips = append(tips, ref.Remote.RefSha)
+		}
+		followed, err := followedTags(local, refs, refMap, func(sha string) bool {
+			return local.ObjectExists(sha) || slices.Contains(tips, sha)
+		})
+		if err != nil {
+			return err
+		}
+		refMap = append(refMap, followed...)
+	}
+	refMap, err = removeDuplicateRefs(refMap)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refMap {
+		if branch != "" && ref.Dst == internal.BRANCH_PREFIX+branch {
+			return fmt.Errorf("refusing to fetch into branch '%v' checked out at '%v'", ref.Dst, local.RootName)
+		}
+	}
+
+	// like git, only the objects of the refs that are not complete locally are wanted
+	wants := []string{}
+	for _, ref := range refMap {
+		if !local.ObjectExists(ref.Remote.RefSha) && !slices.Contains(wants, ref.Remote.RefSha) {
+			wants = append(wants, ref.Remote.RefSha)
+		}
+	}
+	if len(wants) > 0 {
+		remoteTips := []string{}
+		for _, ref := range refs {
+			remoteTips = append(remoteTips, ref.RefSha)
+		}
+		body, err := remote.NegotiatePack(local, wants, remoteTips, tagOpt != "--no-tags" && followTags)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		index, err := local.WritePackFile(body, internal.PackFileHandler{})
+		if err != nil {
+			return err
+		}
+		for _, sha := range wants {
+			if !index.Contains(sha) {
+				return fmt.Errorf("remote did not send object %v", sha)
+			}
+		}
+	}
+
+	report := &fetchReport{url: displayUrl(rawUrl), refWidth: refColumnWidth(refMap), stderr: stderr}
+	rejected, err := storeFetchedRefs(local, refMap, report)
+	if err != nil {
+		return err
+	}
+	// the tags pointing into the fetched history were sent with include-tag
+	if tagOpt != "--no-tags" && tagOpt != "--tags" && followTags {
+		backfilled, err := followedTags(local, refs, refMap, local.ObjectExists)
+		if err != nil {
+			return err
+		}
+		backfillRejected, err := storeFetchedRefs(local, backfilled, report)
+		if err != nil {
+			return err
+		}
+		rejected = rejected || backfillRejected
+	}
+	err = os.WriteFile(fetchHeadName, []byte(report.fetchHead.String()), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write FETCH_HEAD, %v", err)
+	}
+	if rejected {
+		return exitStatus(1)
+	}
+	return nil
+}
+
+// mapRefspec returns the remote refs matched by a refspec with their local ref, a ref without
+// glob is looked up like a revision, missingOk ignores a ref that is not advertised
+func mapRefspec(refs []internal.GitReference, spec internal.Refspec, status int, missingOk bool) ([]fetchedRef, error) {
+	mapped := []fetchedRef{}
+	if spec.IsPattern() {
+		for _, ref := range refs {
+			dst, ok := spec.MapRef(ref.Ref)
+			if !ok || (dst != "" && internal.CheckRefFormat(dst, false) != nil) {
+				continue
+			}
+			mapped = append(mapped, fetchedRef{Remote: ref, Dst: dst, Force: spec.Force, Status: status})
+		}
+		return mapped, nil
+	}
+	for _, ref := range refs {
+		if refNameMatches(spec.Src, ref.Ref) {
+			return append(mapped, fetchedRef{Remote: ref, Dst: spec.Dst, Force: spec.Force, Status: status}), nil
+		}
+	}
+	if missingOk {
+		return mapped, nil
+	}
+	return nil, fmt.Errorf("couldn't find remote ref %v", spec.Src)
+}
+
+// refNameMatches tells whether a short ref name designates a full one, with the rules of git
+// rev-parse
+// https://git-scm.com/docs/gitrevisions#Documentation/gitrevisions.txt-emltrefnamegtemegemmasterememheadsmasterememrefsheadsmasterem
+func refNameMatches(short string, name string) bool {
+	for _, rule := range []string{"%v", "refs/%v", "refs/tags/%v", "refs/heads/%v", "refs/remotes/%v", "refs/remotes/%v/HEAD"} {
+		if fmt.Sprintf(rule, short) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// followedTags returns the advertised tags missing locally whose object, or the one they peel
+// to, is wanted
+func followedTags(local *internal.LocalRepository, refs []internal.GitReference, refMap []fetchedRef, wanted func(sha string) bool) ([]fetchedRef, error) {
+	followed := []fetchedRef{}
+	for _, ref := range refs {
+		if !strings.HasPrefix(ref.Ref, "refs/tags/") || slices.ContainsFunc(refMap, func(fetched fetchedRef) bool { return fetched.Dst == ref.Ref }) {
+			continue
+		}
+		sha, err := local.ResolveRef(ref.Ref)
+		if err != nil {
+			return nil, err
+		}
+		if sha == "" && (wanted(ref.RefSha) || (ref.Peeled != "" && wanted(ref.Peeled))) {
+			followed = append(followed, fetchedRef{Remote: ref, Dst: ref.Ref, Status: fetchHeadNotForMerge})
+		}
+	}
+	return followed, nil
+}
+
+// removeDuplicateRefs keeps the first remote ref fetched to a local ref
+func removeDuplicateRefs(refMap []fetchedRef) ([]fetchedRef, error) {
+	unique := []fetchedRef{}
+	sources := map[string]string{}
+	for _, ref := range refMap {
+		if ref.Dst == "" {
+			unique = append(unique, ref)
+			continue
+		}
+		if source, found := sources[ref.Dst]; found {
+			if source != ref.Remote.Ref {
+				return nil, fmt.Errorf("%v tracks both %v and %v", ref.Dst, source, ref.Remote.Ref)
+			}
+			continue
+		}
+		sources[ref.Dst] = ref.Remote.Ref
+		unique = append(unique, ref)
+	}
+	return unique, nil
+}
+
+// prettyRefName strips the refs/heads/, refs/tags/ or refs/remotes/ prefix of a ref
+func prettyRefName(name string) string {
+	for _, prefix := range []string{internal.BRANCH_PREFIX, "refs/tags/", "refs/remotes/"} {
+		if short, ok := strings.CutPrefix(name, prefix); ok {
+			return short
+		}
+	}
+	return name
+}
+
+// refColumnWidth returns the width of the remote refs in the report, like git the ones making a
+// line longer than the terminal are left out
+func refColumnWidth(refMap []fetchedRef) int {
+	columns := 80
+	if value, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && value > 0 {
+		columns = value
+	}
+	width := 10
+	for _, ref := range refMap {
+		if ref.Dst == "" || ref.Remote.Ref == "HEAD" {
+			continue
+		}
+		remoteLength, localLength := len(prettyRefName(ref.Remote.Ref)), len(prettyRefName(ref.Dst))
+		if 21+remoteLength+4+localLength < columns {
+			width = max(width, remoteLength)
+		}
+	}
+	return width
+}
+
+// displayUrl removes the credentials, the trailing slashes and .git of a url
+func displayUrl(rawUrl string) string {
+	if parsedUrl, err := url.Parse(rawUrl); err == nil {
+		parsedUrl.User = nil
+		rawUrl = parsedUrl.String()
+	}
+	rawUrl = strings.TrimRight(rawUrl, "/")
+	if len(rawUrl) > 5 {
+		rawUrl = strings.TrimSuffix(rawUrl, ".git")
+	}
+	return rawUrl
+}
+
+// fetchReport prints the updated refs under the url of the remote and collects FETCH_HEAD
+type fetchReport struct {
+	url       string
+	refWidth  int
+	shownUrl  bool
+	stderr    io.Writer
+	fetchHead strings.Builder
+}
+
+func (r *fetchReport) print(code byte, summary string, remoteName string, localName string, reason string) {
+	if !r.shownUrl {
+		fmt.Fprintf(r.stderr, "From %v\n", r.url)
+		r.shownUrl = true
+	}
+	line := fmt.Sprintf(" %c %-*v %-*v -> %v", code, fetchSummaryWidth, summary, r.refWidth, remoteName, localName)
+	if reason != "" {
+		line += "  (" + reason + ")"
+	}
+	fmt.Fprintln(r.stderr, line)
+}
+
+// storeFetchedRefs updates the local refs and reports them, the refs to merge first, it returns
+// whether an update was rejected
+// https://git-scm.com/docs/git-fetch#_output
+func storeFetchedRefs(local *internal.LocalRepository, refMap []fetchedRef, report *fetchReport) (bool, error) {
+	rejected := false
+	for _, status := range []int{fetchHeadMerge, fetchHeadNotForMerge, fetchHeadIgnore} {
+		for _, ref := range refMap {
+			if ref.Status != status {
+				continue
+			}
+			kind, what := "", ref.Remote.Ref
+			switch {
+			case what == "HEAD":
+				what = ""
+			case strings.HasPrefix(what, internal.BRANCH_PREFIX):
+				kind, what = "branch", strings.TrimPrefix(what, internal.BRANCH_PREFIX)
+			case strings.HasPrefix(what, "refs/tags/"):
+				kind, what = "tag", strings.TrimPrefix(what, "refs/tags/")
+			case strings.HasPrefix(what, "refs/remotes/"):
+				kind, what = "remote-tracking branch", strings.TrimPrefix(what, "refs/remotes/")
+			}
+			if status != fetchHeadIgnore {
+				writeFetchHead(&report.fetchHead, ref.Remote.RefSha, status, kind, what, report.url)
+			}
+
+			if ref.Dst == "" {
+				if kind == "" {
+					kind = "branch"
+				}
+				if what == "" {
+					what = "HEAD"
+				}
+				report.print('*', kind, what, "FETCH_HEAD", "")
+				continue
+			}
+			refRejected, err := updateFetchedRef(local, ref, what, report)
+			if err != nil {
+				return false, err
+			}
+			rejected = rejected || refRejected
+		}
+	}
+	return rejected, nil
+}
+
+// writeFetchHead adds the line of a fetched ref to FETCH_HEAD
+// https://git-scm.com/docs/git-fetch#_description
+func writeFetchHead(fetchHead *strings.Builder, sha string, status int, kind string, what string, url string) {
+	marker := ""
+	if status == fetchHeadNotForMerge {
+		marker = "not-for-merge"
+	}
+	note := ""
+	if kind != "" {
+		note += kind + " "
+	}
+	if what != "" {
+		note += "'" + what + "' of "
+	}
+	fmt.Fprintf(fetchHead, "%v\t%v\t%v%v\n", sha, marker, note, url)
+}
+
+// updateFetchedRef updates a local ref when it is new or a fast-forward, a forced refspec allows
+// other updates, it returns whether the update was rejected
+func updateFetchedRef(local *internal.LocalRepository, ref fetchedRef, what string, report *fetchReport) (bool, error) {
+	remoteName, localName := what, prettyRefName(ref.Dst)
+	oldSha, err := local.ResolveRef(ref.Dst)
+	if err != nil {
+		return false, err
+	}
+	newSha := ref.Remote.RefSha
+	switch {
+	case oldSha == newSha:
+		return false, nil
+	case oldSha != "" && strings.HasPrefix(ref.Dst, "refs/tags/"):
+		if !ref.Force {
+			report.print('!', "[rejected]", remoteName, localName, "would clobber existing tag")
+			return true, nil
+		}
+		err = local.UpdateRef(ref.Dst, newSha, oldSha, false)
+		if err != nil {
+			return false, err
+		}
+		report.print('t', "[tag update]", remoteName, localName, "")
+		return false, nil
+	}
+
+	oldCommit, oldErr := local.ResolveRevision(oldSha + "^{commit}")
+	newCommit, newErr := local.ResolveRevision(newSha + "^{commit}")
+	if oldSha == "" || oldErr != nil || newErr != nil {
+		summary := "[new ref]"
+		switch {
+		case strings.HasPrefix(ref.Remote.Ref, "refs/tags/"):
+			summary = "[new tag]"
+		case strings.HasPrefix(ref.Remote.Ref, internal.BRANCH_PREFIX):
+			summary = "[new branch]"
+		}
+		if oldSha == "" {
+			oldSha = internal.ZERO_SHA
+		}
+		err = local.UpdateRef(ref.Dst, newSha, oldSha, false)
+		if err != nil {
+			return false, err
+		}
+		report.print('*', summary, remoteName, localName, "")
+		return false, nil
+	}
+
+	fastForward, err := local.IsAncestor(oldCommit, newCommit)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case fastForward:
+		err = local.UpdateRef(ref.Dst, newSha, oldSha, false)
+		if err == nil {
+			report.print(' ', oldCommit[:7]+".."+newSha[:7], remoteName, localName, "")
+		}
+	case ref.Force:
+		err = local.UpdateRef(ref.Dst, newSha, oldSha, false)
+		if err == nil {
+			report.print('+', oldCommit[:7]+"..."+newSha[:7], remoteName, localName, "forced update")
+		}
+	default:
+		report.print('!', "[rejected]", remoteName, localName, "non-fast-forward")
+		return true, nil
+	}
+	return false, err
+}
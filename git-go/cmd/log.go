@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/klemjul/build-my-own-in-go/git-go/internal"
+)
+
+var maxCountShorthandRegexp = regexp.MustCompile(`^-n?(\d+)$`)
+
+// https://git-scm.com/docs/git-log
+func log(local *internal.LocalRepository, args []string, stdout io.Writer) error {
+	log := flag.NewFlagSet("log", flag.ExitOnError)
+	oneline := log.Bool("oneline", false, "show each commit on one line with its abbreviated sha")
+	format := log.String("format", "", "a builtin format or a format string with placeholders")
+	log.StringVar(format, "pretty", "", "a builtin format or a format string with placeholders")
+	options := internal.LogOptions{Order: internal.LOG_ORDER_DEFAULT}
+	log.IntVar(&options.MaxCount, "n", -1, "show at most n commits")
+	log.IntVar(&options.MaxCount, "max-count", -1, "show at most n commits")
+	graph := log.Bool("graph", false, "draw the history on the left of the commits")
+	log.Func("author", "show the commits of an author matching a regular expression, can be given several times", func(value string) error {
+		options.Authors = append(options.Authors, value)
+		return nil
+	})
+	now := time.Now()
+	parseDate := func(bound *int64) func(string) error {
+		return func(value string) error {
+			var err error
+			*bound, err = internal.ParseApproxDate(value, now)
+			return err
+		}
+	}
+	log.Func("since", "show the commits more recent than a date", parseDate(&options.Since))
+	log.Func("after", "show the commits more recent than a date", parseDate(&options.Since))
+	log.Func("until", "show the commits older than a date", parseDate(&options.Until))
+	log.Func("before", "show the commits older than a date", parseDate(&options.Until))
+	topoOrder := log.Bool("topo-order", false, "show children before parents without intermixing lines of history")
+	dateOrder := log.Bool("date-order", false, "show children before parents, then by commit date")
+
+	// like git, -<n> and -n<n> limit the number of commits and revisions can be mixed with the options
+	args = slices.Clone(args)
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		args[i] = maxCountShorthandRegexp.ReplaceAllString(arg, "-n=$1")
+	}
+	revisions := []string{}
+	for log.Parse(args); log.NArg() > 0; log.Parse(args) {
+		revisions = append(revisions, log.Arg(0))
+		args = log.Args()[1:]
+	}
+
+	switch {
+	case *dateOrder:
+		options.Order = internal.LOG_ORDER_DATE
+	case *topoOrder || *graph:
+		options.Order = internal.LOG_ORDER_TOPO
+	}
+	pretty := internal.PRETTY_MEDIUM
+	userFormat := ""
+	// oneline and tformat end each commit with a line feed, other formats separate commits
+	useTerminator := false
+	switch name := *format; {
+	case *oneline || name == internal.PRETTY_ONELINE:
+		pretty, useTerminator = internal.PRETTY_ONELINE, true
+	case name == "":
+	case strings.HasPrefix(name, "format:"):
+		pretty, userFormat = "", strings.TrimPrefix(name, "format:")
+	case strings.HasPrefix(name, "tformat:"):
+		pretty, userFormat, useTerminator = "", strings.TrimPrefix(name, "tformat:"), true
+	case slices.Contains([]string{internal.PRETTY_SHORT, internal.PRETTY_MEDIUM, internal.PRETTY_FULL, internal.PRETTY_FULLER}, name):
+		pretty = name
+	case strings.Contains(name, "%"):
+		pretty, userFormat, useTerminator = "", name, true
+	default:
+		return fmt.Errorf("invalid --pretty format: %v", name)
+	}
+
+	entries, err := local.Log(revisions, options)
+	if err != nil {
+		return err
+	}
+	var history *internal.Graph
+	if *graph {
+		history = internal.NewGraph()
+	}
+	// this follows show_log in git's log-tree.c to interleave the graph with the messages
+	missingNewline := false
+	for i, entry := range entries {
+		if history != nil {
+			history.Update(entry.Sha, entry.ShownParents)
+		}
+		if i > 0 && !useTerminator {
+			if !missingNewline && history != nil {
+				fmt.Fprint(stdout, history.PaddingLine())
+			}
+			fmt.Fprintln(stdout)
+		}
+		printGraphCommit(history, stdout)
+
+		var message string
+		switch pretty {
+		case "":
+			message = internal.FormatCommit(userFormat, entry.Sha, entry.Commit)
+		case internal.PRETTY_ONELINE:
+			fmt.Fprintf(stdout, "%v ", entry.Sha[:7])
+			message = internal.PrettyCommit(pretty, entry.Commit)
+		default:
+			fmt.Fprintf(stdout, "commit %v\n", entry.Sha)
+			if history != nil {
+				line, _ := history.NextLine()
+				fmt.Fprint(stdout, line)
+			}
+			message = internal.PrettyCommit(pretty, entry.Commit)
+		}
+		missingNewline = !strings.HasSuffix(message, "\n")
+		printGraphMessage(history, message, stdout)
+		if useTerminator && (pretty != "" || userFormat != "") {
+			if !missingNewline && history != nil {
+				fmt.Fprint(stdout, history.PaddingLine())
+			}
+			fmt.Fprintln(stdout)
+		}
+	}
+	return nil
+}
+
+// printGraphCommit prints the graph lines of a commit up to the one holding it, without line feed
+func printGraphCommit(history *internal.Graph, stdout io.Writer) {
+	if history == nil {
+		return
+	}
+	if history.IsCommitFinished() {
+		fmt.Fprint(stdout, history.PaddingLine())
+		return
+	}
+	for isCommitLine := false; !isCommitLine && !history.IsCommitFinished(); {
+		var line string
+		line, isCommitLine = history.NextLine()
+		fmt.Fprint(stdout, line)
+		if !isCommitLine {
+			fmt.Fprintln(stdout)
+		}
+	}
+}
+
+// printGraphMessage prints a message with a graph line before each line but the first, then the
+// remaining graph lines of the commit
+func printGraphMessage(history *internal.Graph, message string, stdout io.Writer) {
+	if history == nil {
+		fmt.Fprint(stdout, message)
+		return
+	}
+	lines := strings.SplitAfter(message, "\n")
+	for i, line := range lines {
+		fmt.Fprint(stdout, line)
+		if i < len(lines)-1 && lines[i+1] != "" {
+			graphLine, _ := history.NextLine()
+			fmt.Fprint(stdout, graphLine)
+		}
+	}
+	if history.IsCommitFinished() {
+		return
+	}
+	terminated := strings.HasSuffix(message, "\n")
+	if !terminated {
+		fmt.Fprintln(stdout)
+	}
+	for !history.IsCommitFinished() {
+		line, _ := history.NextLine()
+		fmt.Fprint(stdout, line)
+		if !history.IsCommitFinished() {
+			fmt.Fprintln(stdout)
+		}
+	}
+	if terminated {
+		fmt.Fprintln(stdout)
+	}
+}
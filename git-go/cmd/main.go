@@ -4,19 +4,50 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"net/url"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/klemjul/build-my-own-in-go/git-go/internal"
 )
 
+// exitError ends a command with a status other than 1, like git commands telling a result with
+// their exit status, err is printed when not nil
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit status %v", e.code)
+	}
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// exitStatus returns an error ending a command silently with code
+func exitStatus(code int) error {
+	return &exitError{code: code}
+}
+
 func handleError(err error) {
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	if err == nil {
+		return
+	}
+	var exit *exitError
+	if errors.As(err, &exit) {
+		if exit.err != nil {
+			fmt.Fprintln(os.Stderr, exit.err)
+		}
+		os.Exit(exit.code)
 	}
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
 }
 
 func main() {
@@ -37,18 +68,8 @@ func main() {
 		handleError(err)
 		fmt.Printf("Initialized empty Git repository in %v\n", wd)
 	case "cat-file":
-		catfile := flag.NewFlagSet("cat-file", flag.ExitOnError)
-		var p string
-		catfile.StringVar(&p, "p", "", "sha1 object hash")
-		catfile.Parse(os.Args[2:])
-		if p == "" {
-			handleError(errors.New("please provide -p flag with object hash"))
-		}
-		file, err := local.CatFile(p)
-		if err != nil {
-			handleError(err)
-		}
-		fmt.Printf("%v", file)
+		err = catFile(&local, os.Args[2:], os.Stdin, os.Stdout)
+		handleError(err)
 	case "hash-object":
 		hashobject := flag.NewFlagSet("hash-object", flag.ExitOnError)
 		var w string
@@ -57,74 +78,149 @@ func main() {
 		if w == "" {
 			handleError(errors.New("please provide -w flag with file path"))
 		}
-		_, hashHex, err := local.WriteBlobObject(w)
+		hashHex, err := local.WriteBlobObject(w)
 		handleError(err)
 		fmt.Printf("%v\n", hashHex)
 	case "write-tree":
-		_, hashHex, err := local.WriteTreeObject(local.RootName)
+		hashHex, err := local.WriteTreeObject()
 		handleError(err)
 		fmt.Printf("%v\n", hashHex)
+	case "add":
+		add := flag.NewFlagSet("add", flag.ExitOnError)
+		force := add.Bool("f", false, "allow adding otherwise ignored files")
+		add.Parse(os.Args[2:])
+		if add.NArg() == 0 {
+			handleError(errors.New("nothing specified, nothing added"))
+		}
+		err = local.AddToIndex(add.Args(), *force)
+		handleError(err)
+	case "rm":
+		rm := flag.NewFlagSet("rm", flag.ExitOnError)
+		cached := rm.Bool("cached", false, "only remove from the index")
+		recursive := rm.Bool("r", false, "allow recursive removal of directories")
+		rm.Parse(os.Args[2:])
+		if !*cached {
+			handleError(errors.New("only rm --cached is supported"))
+		}
+		if rm.NArg() == 0 {
+			handleError(errors.New("no pathspec given, which files should I remove?"))
+		}
+		removed, err := local.RemoveFromIndex(rm.Args(), *recursive)
+		handleError(err)
+		for _, name := range removed {
+			fmt.Printf("rm '%v'\n", name)
+		}
+	case "branch":
+		err = branch(&local, os.Args[2:], os.Stdout)
+		handleError(err)
+	case "update-ref":
+		err = updateRef(&local, os.Args[2:])
+		handleError(err)
+	case "symbolic-ref":
+		err = symbolicRef(&local, os.Args[2:], os.Stdout)
+		handleError(err)
+	case "show-ref":
+		err = showRef(&local, os.Args[2:], os.Stdout)
+		handleError(err)
+	case "pack-refs":
+		err = packRefs(&local, os.Args[2:])
+		handleError(err)
+	case "config":
+		err = config(&local, os.Args[2:], os.Stdout)
+		handleError(err)
+	case "check-ignore":
+		err = checkIgnore(&local, os.Args[2:], os.Stdin, os.Stdout)
+		handleError(err)
+	case "status":
+		err = status(&local, os.Args[2:], os.Stdout)
+		handleError(err)
+	case "ls-files":
+		lsfiles := flag.NewFlagSet("ls-files", flag.ExitOnError)
+		stage := lsfiles.Bool("s", false, "show mode, sha and stage of the entries")
+		lsfiles.Parse(os.Args[2:])
+		index, err := local.ReadIndex()
+		handleError(err)
+		for _, entry := range index.Entries {
+			if !internal.PathspecsMatch(lsfiles.Args(), entry.Name) {
+				continue
+			}
+			if *stage {
+				fmt.Printf("%06o %v %v\t%v\n", entry.Mode, entry.Sha, entry.Stage(), entry.Name)
+			} else {
+				fmt.Println(entry.Name)
+			}
+		}
 	case "ls-tree":
 		lstree := flag.NewFlagSet("ls-tree", flag.ExitOnError)
-		nameOnly := lstree.Bool("name-only", true, "get only the file name")
+		nameOnly := lstree.Bool("name-only", false, "get only the file name")
+		options := internal.LsTreeOptions{}
+		lstree.BoolVar(&options.Recursive, "r", false, "recurse into sub trees")
+		lstree.BoolVar(&options.ShowTrees, "t", false, "show trees when recursing")
+		lstree.BoolVar(&options.Long, "l", false, "show the size of blobs")
 		lstree.Parse(os.Args[2:])
-		hashHex := os.Args[len(os.Args)-1]
-		treeNames, err := local.ReadTreeObject(hashHex, *nameOnly)
+		if lstree.NArg() == 0 {
+			handleError(errors.New("please provide a tree-ish"))
+		}
+		options.Paths = lstree.Args()[1:]
+		entries, err := local.ReadTreeObject(lstree.Arg(0), options)
 		handleError(err)
 
-		fmt.Printf("%v\n", strings.Join(treeNames, "\n"))
+		for _, entry := range entries {
+			switch {
+			case *nameOnly:
+				fmt.Printf("%v\n", entry.Name)
+			case options.Long && entry.Size >= 0:
+				fmt.Printf("%v %v %v %7d\t%v\n", entry.Mode, entry.Type, entry.Sha, entry.Size, entry.Name)
+			case options.Long:
+				fmt.Printf("%v %v %v %7s\t%v\n", entry.Mode, entry.Type, entry.Sha, "-", entry.Name)
+			default:
+				fmt.Printf("%v %v %v\t%v\n", entry.Mode, entry.Type, entry.Sha, entry.Name)
+			}
+		}
 	case "commit-tree":
-		committree := flag.NewFlagSet("commit-tree", flag.ExitOnError)
-		var p, m string
-		committree.StringVar(&p, "p", "", "previous commit hash")
-		committree.StringVar(&m, "m", "", "commit message")
-		committree.Parse(os.Args[3:])
-		treeHash := os.Args[2]
-		commitHash, err := local.WriteCommitObject(treeHash, p, m)
+		err = commitTree(&local, os.Args[2:], os.Stdin, os.Stdout)
 		handleError(err)
-
-		fmt.Printf("%v\n", commitHash)
-	case "clone":
-		if len(os.Args) < 3 {
-			handleError(errors.New("no clone url provided"))
-		}
-		parsedUrl, err := url.Parse(os.Args[2])
-		if err != nil {
-			handleError(nil)
-		}
-
-		pathParts := strings.Split(parsedUrl.Path, "/")
-		projectName := pathParts[len(pathParts)-1]
-
-		remote, err := internal.NewRemoteRepository(parsedUrl.String())
+	case "commit":
+		err = commit(&local, os.Args[2:], os.Stdin, os.Stdout)
 		handleError(err)
-		res, err := remote.DiscoveringReferences()
+	case "log":
+		err = log(&local, os.Args[2:], os.Stdout)
 		handleError(err)
-
-		local = internal.LocalRepository{
-			RootName: filepath.Join(wd, projectName),
+	case "fsck":
+		issues, err := local.Fsck()
+		handleError(err)
+		nbErrors := 0
+		for _, issue := range issues {
+			fmt.Println(issue)
+			if issue.Kind != internal.FSCK_DANGLING {
+				nbErrors++
+			}
 		}
-
-		fmt.Printf("Cloning into '%s'...\n", projectName)
-		err = os.Mkdir(projectName, 0755)
-		if err != nil {
-			handleError(err)
+		if nbErrors > 0 {
+			handleError(fmt.Errorf("fsck found %v errors", nbErrors))
 		}
-		local.Init()
-
-		objects, deltas, err := remote.UploadPack([]string{res[0].Ref})
+	case "gc":
+		gc := flag.NewFlagSet("gc", flag.ExitOnError)
+		prune := gc.String("prune", "2w", "prune unreachable loose objects older than this, now, <n>d, <n>w or a go duration")
+		gc.Parse(os.Args[2:])
+		pruneExpire, err := parseExpire(*prune)
 		handleError(err)
-
-		fmt.Printf("remote: Enumerating objects: %v, done.\n", len(objects))
-		for i := range objects {
-			fmt.Printf("Receiving objects: (%v,%v), done.\n", i+1, len(objects))
-			local.WriteObjectWithType(objects[i].ObjectName, objects[i].Content)
-		}
-		for i := range deltas {
-			fmt.Printf("Receiving deltas: (%v,%v), done.\n", i+1, len(deltas))
-			err := internal.ApplyObjectDelta(local, deltas[i])
-			handleError(err)
+		result, err := local.Gc(pruneExpire)
+		handleError(err)
+		if result.Packed > 0 {
+			fmt.Printf("Writing objects: (%v,%v), done.\n", result.Packed, result.Packed)
+			fmt.Printf("pack-%v\n", result.PackSha)
 		}
+		fmt.Printf("Removed %v loose objects, pruned %v unreachable objects\n", result.Removed, result.Pruned)
+	case "pack-objects":
+		err = packObjects(&local, os.Args[2:], os.Stdin, os.Stdout)
+		handleError(err)
+	case "clone":
+		err = clone(wd, os.Args[2:])
+		handleError(err)
+	case "fetch":
+		err = fetch(&local, os.Args[2:], os.Stderr)
+		handleError(err)
 	default:
 		handleError(errors.New("unknown command"))
 	}
@@ -132,3 +228,20 @@ func main() {
 	os.Exit(0)
 
 }
+
+// parseExpire reads a grace period like git's "now", "3d" or "2w", or a go duration
+func parseExpire(expire string) (time.Duration, error) {
+	if expire == "now" {
+		return 0, nil
+	}
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if count, found := strings.CutSuffix(expire, suffix); found {
+			n, err := strconv.Atoi(count)
+			if err != nil {
+				return 0, fmt.Errorf("invalid expire %v, %v", expire, err)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	return time.ParseDuration(expire)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klemjul/build-my-own-in-go/git-go/internal"
+)
+
+// packObjects reads object ids, or revisions with --revs, from stdin and writes them in a pack
+// https://git-scm.com/docs/git-pack-objects
+func packObjects(local *internal.LocalRepository, args []string, stdin io.Reader, stdout io.Writer) error {
+	packobjects := flag.NewFlagSet("pack-objects", flag.ExitOnError)
+	toStdout := packobjects.Bool("stdout", false, "write the pack to stdout")
+	revs := packobjects.Bool("revs", false, "read revisions like A..B or ^A instead of object ids")
+	window := packobjects.Int("window", internal.DefaultPackObjectsOptions.Window, "number of objects tried as delta base")
+	depth := packobjects.Int("depth", internal.DefaultPackObjectsOptions.Depth, "maximum delta chain length")
+	noOfsDelta := packobjects.Bool("no-ofs-delta", false, "reference delta bases by sha instead of offset")
+	packobjects.Parse(args)
+	if !*toStdout && packobjects.NArg() != 1 {
+		return fmt.Errorf("usage: gitgo pack-objects [--stdout] [--revs] [--window=<n>] [--depth=<n>] [--no-ofs-delta] [base-name]")
+	}
+	options := internal.PackObjectsOptions{Window: *window, Depth: *depth, OfsDelta: !*noOfsDelta}
+
+	objects := []internal.PackObject{}
+	roots, excludedRoots := []string{}, []string{}
+	scanner := bufio.NewScanner(stdin)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !*revs {
+			// rev-list --objects output, <sha> [<path>]
+			sha, name, _ := strings.Cut(line, " ")
+			objects = append(objects, internal.PackObject{Sha: sha, Name: name})
+			continue
+		}
+		if from, to, isRange := strings.Cut(line, ".."); isRange {
+			excludedRoots = append(excludedRoots, from)
+			roots = append(roots, to)
+		} else if excluded, isExcluded := strings.CutPrefix(line, "^"); isExcluded {
+			excludedRoots = append(excludedRoots, excluded)
+		} else {
+			roots = append(roots, line)
+		}
+	}
+	err := scanner.Err()
+	if err != nil {
+		return fmt.Errorf("failed to read stdin, %v", err)
+	}
+
+	if *revs {
+		excludedShas, err := resolveRevisions(local, excludedRoots)
+		if err != nil {
+			return err
+		}
+		excludedObjects, err := local.WalkObjects(excludedShas, nil)
+		if err != nil {
+			return err
+		}
+		excluded := make(map[string]string, len(excludedObjects))
+		for _, object := range excludedObjects {
+			excluded[object.Sha] = object.Name
+		}
+		rootShas, err := resolveRevisions(local, roots)
+		if err != nil {
+			return err
+		}
+		objects, err = local.WalkObjects(rootShas, excluded)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *toStdout {
+		writer := bufio.NewWriter(stdout)
+		_, _, err = local.WritePack(writer, objects, options)
+		if err != nil {
+			return err
+		}
+		return writer.Flush()
+	}
+
+	baseName := packobjects.Arg(0)
+	packFile, err := os.CreateTemp(filepath.Dir(baseName), "tmp_pack_")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary pack, %v", err)
+	}
+	defer func() {
+		packFile.Close()
+		os.Remove(packFile.Name())
+	}()
+	writer := bufio.NewWriter(packFile)
+	packSha, entries, err := local.WritePack(writer, objects, options)
+	if err != nil {
+		return err
+	}
+	err = writer.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to write pack, %v", err)
+	}
+	err = packFile.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write pack, %v", err)
+	}
+	packName := fmt.Sprintf("%v-%v", baseName, packSha)
+	err = os.Rename(packFile.Name(), packName+".pack")
+	if err != nil {
+		return fmt.Errorf("failed to rename pack, %v", err)
+	}
+	err = internal.WritePackIndex(packName+".idx", internal.NewPackIndex(packSha, entries))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, packSha)
+	return nil
+}
+
+func resolveRevisions(local *internal.LocalRepository, revisions []string) ([]string, error) {
+	shas := make([]string, 0, len(revisions))
+	for _, revision := range revisions {
+		sha, err := local.ResolveRevision(revision)
+		if err != nil {
+			return nil, err
+		}
+		shas = append(shas, sha)
+	}
+	return shas, nil
+}
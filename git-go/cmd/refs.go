@@ -0,0 +1,325 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/klemjul/build-my-own-in-go/git-go/internal"
+)
+
+// https://git-scm.com/docs/git-branch
+func branch(local *internal.LocalRepository, args []string, stdout io.Writer) error {
+	branch := flag.NewFlagSet("branch", flag.ExitOnError)
+	deleteMerged := branch.Bool("d", false, "delete a branch merged into HEAD")
+	deleteForce := branch.Bool("D", false, "delete a branch even if not merged")
+	move := branch.Bool("m", false, "rename a branch, the current one by default")
+	moveForce := branch.Bool("M", false, "rename a branch even if the new name exists")
+	force := branch.Bool("f", false, "reset the branch to the start point if it exists")
+	remotes := branch.Bool("r", false, "list the remote-tracking branches")
+	all := branch.Bool("a", false, "list both local and remote-tracking branches")
+	showCurrent := branch.Bool("show-current", false, "print the name of the current branch")
+	branch.Parse(args)
+
+	current, err := local.CurrentBranch()
+	if err != nil {
+		return err
+	}
+	switch {
+	case *showCurrent:
+		if current != "" {
+			fmt.Fprintln(stdout, current)
+		}
+	case *deleteMerged || *deleteForce:
+		if branch.NArg() == 0 {
+			return errors.New("branch name required")
+		}
+		for _, name := range branch.Args() {
+			sha, err := local.DeleteBranch(name, *deleteForce)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(stdout, "Deleted branch %v (was %v).\n", name, sha[:7])
+		}
+	case *move || *moveForce:
+		switch branch.NArg() {
+		case 1:
+			if current == "" {
+				return errors.New("cannot rename the current branch while not on any")
+			}
+			return local.RenameBranch(current, branch.Arg(0), *moveForce)
+		case 2:
+			return local.RenameBranch(branch.Arg(0), branch.Arg(1), *moveForce)
+		}
+		return errors.New("usage: gitgo branch (-m | -M) [<old-branch>] <new-branch>")
+	case branch.NArg() > 0:
+		if branch.NArg() > 2 {
+			return errors.New("usage: gitgo branch [-f] <branch-name> [<start-point>]")
+		}
+		startPoint := "HEAD"
+		if branch.NArg() == 2 {
+			startPoint = branch.Arg(1)
+		}
+		return local.CreateBranch(branch.Arg(0), startPoint, *force)
+	default:
+		return listBranches(local, current, !*remotes, *remotes || *all, *all, stdout)
+	}
+	return nil
+}
+
+// listBranches prints the branches like git branch, remote-tracking branches are prefixed
+// with remotes/ when listed with the local ones
+func listBranches(local *internal.LocalRepository, current string, withLocal bool, withRemotes bool, prefixRemotes bool, stdout io.Writer) error {
+	if withLocal && current == "" {
+		head, err := local.ResolveRef("HEAD")
+		if err != nil {
+			return err
+		}
+		if head != "" {
+			fmt.Fprintf(stdout, "* (HEAD detached at %v)\n", head[:7])
+		}
+	}
+	refs, err := local.ListRefs()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if withLocal {
+		for _, name := range names {
+			if short, isBranch := strings.CutPrefix(name, internal.BRANCH_PREFIX); isBranch {
+				marker := " "
+				if short == current {
+					marker = "*"
+				}
+				fmt.Fprintf(stdout, "%v %v\n", marker, short)
+			}
+		}
+	}
+	if withRemotes {
+		for _, name := range names {
+			short, isRemote := strings.CutPrefix(name, "refs/remotes/")
+			if !isRemote {
+				continue
+			}
+			if prefixRemotes {
+				short = "remotes/" + short
+			}
+			target, isSymbolic, err := local.ReadSymbolicRef(name)
+			if err != nil {
+				return err
+			}
+			if isSymbolic {
+				short += " -> " + strings.TrimPrefix(target, "refs/remotes/")
+			}
+			fmt.Fprintf(stdout, "  %v\n", short)
+		}
+	}
+	return nil
+}
+
+// https://git-scm.com/docs/git-update-ref
+func updateRef(local *internal.LocalRepository, args []string) error {
+	updateref := flag.NewFlagSet("update-ref", flag.ExitOnError)
+	deleteRef := updateref.Bool("d", false, "delete the ref")
+	noDeref := updateref.Bool("no-deref", false, "update the symbolic ref itself rather than the ref it points to")
+	updateref.String("m", "", "reflog message, reflogs are not written")
+	updateref.Parse(args)
+
+	// an empty or zero old value means the ref must not exist, a zero new value deletes it
+	resolve := func(value string) (string, error) {
+		if strings.Trim(value, "0") == "" {
+			return internal.ZERO_SHA, nil
+		}
+		return local.ResolveRevision(value)
+	}
+	oldSha := ""
+	var err error
+	if *deleteRef {
+		if updateref.NArg() < 1 || updateref.NArg() > 2 {
+			return errors.New("usage: gitgo update-ref -d <ref> [<old-value>]")
+		}
+		if updateref.NArg() == 2 {
+			oldSha, err = resolve(updateref.Arg(1))
+		}
+		if err != nil {
+			return err
+		}
+		return local.DeleteRef(updateref.Arg(0), oldSha, !*noDeref)
+	}
+	if updateref.NArg() < 2 || updateref.NArg() > 3 {
+		return errors.New("usage: gitgo update-ref [--no-deref] <ref> <new-value> [<old-value>]")
+	}
+	newSha, err := resolve(updateref.Arg(1))
+	if err == nil && updateref.NArg() == 3 {
+		oldSha, err = resolve(updateref.Arg(2))
+	}
+	if err != nil {
+		return err
+	}
+	if newSha == internal.ZERO_SHA {
+		return local.DeleteRef(updateref.Arg(0), oldSha, !*noDeref)
+	}
+	return local.UpdateRef(updateref.Arg(0), newSha, oldSha, !*noDeref)
+}
+
+// https://git-scm.com/docs/git-symbolic-ref
+func symbolicRef(local *internal.LocalRepository, args []string, stdout io.Writer) error {
+	symbolicref := flag.NewFlagSet("symbolic-ref", flag.ExitOnError)
+	quiet := symbolicref.Bool("q", false, "do not print an error for a non symbolic ref")
+	short := symbolicref.Bool("short", false, "shorten the printed ref name")
+	deleteRef := symbolicref.Bool("d", false, "delete the symbolic ref")
+	symbolicref.BoolVar(deleteRef, "delete", false, "delete the symbolic ref")
+	symbolicref.String("m", "", "reflog message, reflogs are not written")
+	symbolicref.Parse(args)
+
+	switch {
+	case *deleteRef && symbolicref.NArg() == 1:
+		return local.DeleteSymbolicRef(symbolicref.Arg(0))
+	case symbolicref.NArg() == 2:
+		return local.WriteSymbolicRef(symbolicref.Arg(0), symbolicref.Arg(1))
+	case symbolicref.NArg() == 1:
+		target, isSymbolic, err := local.ReadSymbolicRef(symbolicref.Arg(0))
+		if err != nil {
+			return err
+		}
+		if !isSymbolic {
+			if *quiet {
+				return exitStatus(1)
+			}
+			return fmt.Errorf("ref %v is not a symbolic ref", symbolicref.Arg(0))
+		}
+		if *short {
+			target = shortRefName(target)
+		}
+		fmt.Fprintln(stdout, target)
+		return nil
+	}
+	return errors.New("usage: gitgo symbolic-ref [-q] [--short] [-d] <name> [<ref>]")
+}
+
+// shortRefName strips the refs/heads/, refs/tags/, refs/remotes/ or refs/ prefix of a ref
+func shortRefName(name string) string {
+	for _, prefix := range []string{internal.BRANCH_PREFIX, "refs/tags/", "refs/remotes/", "refs/"} {
+		if short, found := strings.CutPrefix(name, prefix); found {
+			return short
+		}
+	}
+	return name
+}
+
+// https://git-scm.com/docs/git-show-ref
+func showRef(local *internal.LocalRepository, args []string, stdout io.Writer) error {
+	showref := flag.NewFlagSet("show-ref", flag.ExitOnError)
+	heads := showref.Bool("heads", false, "only show branches")
+	showref.BoolVar(heads, "branches", false, "only show branches")
+	tags := showref.Bool("tags", false, "only show tags")
+	withHead := showref.Bool("head", false, "show HEAD too")
+	dereference := showref.Bool("dereference", false, "show the peeled object of tags with a ^{} suffix")
+	showref.BoolVar(dereference, "d", false, "show the peeled object of tags with a ^{} suffix")
+	hashOnly := showref.Bool("hash", false, "only show the sha")
+	showref.BoolVar(hashOnly, "s", false, "only show the sha")
+	verify := showref.Bool("verify", false, "only accept exact ref names")
+	quiet := showref.Bool("q", false, "do not print anything, only set the exit status")
+	showref.BoolVar(quiet, "quiet", false, "do not print anything, only set the exit status")
+	showref.Parse(args)
+
+	refs, err := local.ListRefs()
+	if err != nil {
+		return err
+	}
+	head, err := local.ResolveRef("HEAD")
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	if *verify {
+		for _, name := range showref.Args() {
+			_, isRef := refs[name]
+			if !isRef && (name != "HEAD" || head == "") {
+				if *quiet {
+					return exitStatus(1)
+				}
+				return fmt.Errorf("'%v' - not a valid ref", name)
+			}
+			if name == "HEAD" {
+				refs[name] = head
+			}
+			names = append(names, name)
+		}
+	} else {
+		for name := range refs {
+			switch {
+			case (*heads || *tags) && !(*heads && strings.HasPrefix(name, internal.BRANCH_PREFIX)) && !(*tags && strings.HasPrefix(name, "refs/tags/")):
+			case !refPatternsMatch(showref.Args(), name):
+			default:
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		if *withHead && head != "" {
+			refs["HEAD"] = head
+			names = append([]string{"HEAD"}, names...)
+		}
+	}
+	if len(names) == 0 {
+		return exitStatus(1)
+	}
+	if *quiet {
+		return nil
+	}
+	for _, name := range names {
+		printRef := func(sha string, name string) {
+			if *hashOnly {
+				fmt.Fprintln(stdout, sha)
+			} else {
+				fmt.Fprintf(stdout, "%v %v\n", sha, name)
+			}
+		}
+		printRef(refs[name], name)
+		if !*dereference {
+			continue
+		}
+		tag, err := local.ReadTag(refs[name])
+		if err != nil {
+			continue
+		}
+		for {
+			next, err := local.ReadTag(tag.Object)
+			if err != nil {
+				break
+			}
+			tag = next
+		}
+		printRef(tag.Object, name+"^{}")
+	}
+	return nil
+}
+
+// refPatternsMatch tells whether a ref ends with one of the patterns on a component boundary
+func refPatternsMatch(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if name == pattern || strings.HasSuffix(name, "/"+pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// https://git-scm.com/docs/git-pack-refs
+func packRefs(local *internal.LocalRepository, args []string) error {
+	packrefs := flag.NewFlagSet("pack-refs", flag.ExitOnError)
+	all := packrefs.Bool("all", false, "pack all refs, not only the tags and the refs already packed")
+	noPrune := packrefs.Bool("no-prune", false, "keep the loose refs")
+	packrefs.Parse(args)
+	return local.PackRefs(*all, !*noPrune)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klemjul/build-my-own-in-go/git-go/internal"
+)
+
+// https://git-scm.com/docs/git-status#_output
+func status(local *internal.LocalRepository, args []string, stdout io.Writer) error {
+	status := flag.NewFlagSet("status", flag.ExitOnError)
+	short := status.Bool("short", false, "give the output in the short format")
+	status.BoolVar(short, "s", false, "give the output in the short format")
+	porcelain := status.String("porcelain", "", "give the output in a stable format for scripts, only v1 is supported")
+	status.Parse(normalizePorcelainFlag(args))
+	if *porcelain != "" && *porcelain != "v1" {
+		return fmt.Errorf("unsupported porcelain format %v", *porcelain)
+	}
+
+	result, err := local.Status()
+	if err != nil {
+		return err
+	}
+	if *short || *porcelain != "" {
+		for _, entry := range result.Entries {
+			fmt.Fprintf(stdout, "%c%c %v\n", entry.Staged, entry.Unstaged, entry.Name)
+		}
+		return nil
+	}
+	printLongStatus(result, stdout)
+	return nil
+}
+
+// normalizePorcelainFlag turns a bare --porcelain into --porcelain=v1, the flag package needs a value
+func normalizePorcelainFlag(args []string) []string {
+	normalized := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "--porcelain" || arg == "-porcelain" {
+			arg = "--porcelain=v1"
+		}
+		normalized[i] = arg
+	}
+	return normalized
+}
+
+var statusLabels = map[byte]string{
+	internal.STATUS_ADDED:      "new file:   ",
+	internal.STATUS_MODIFIED:   "modified:   ",
+	internal.STATUS_DELETED:    "deleted:    ",
+	internal.STATUS_TYPECHANGE: "typechange: ",
+	internal.STATUS_UNMERGED:   "both modified:   ",
+}
+
+// printLongStatus prints the sections of git status without the advice hints
+func printLongStatus(result *internal.Status, stdout io.Writer) {
+	if result.Branch != "" {
+		fmt.Fprintf(stdout, "On branch %v\n", result.Branch)
+	} else {
+		fmt.Fprintf(stdout, "HEAD detached at %v\n", result.Head[:7])
+	}
+	if result.Head == "" {
+		fmt.Fprint(stdout, "\nNo commits yet\n\n")
+	}
+
+	unmerged, staged, unstaged, untracked := []string{}, []string{}, []string{}, []string{}
+	for _, entry := range result.Entries {
+		switch {
+		case entry.Staged == internal.STATUS_UNTRACKED:
+			untracked = append(untracked, entry.Name)
+			continue
+		case entry.Staged == internal.STATUS_UNMERGED:
+			unmerged = append(unmerged, statusLabels[entry.Staged]+entry.Name)
+			continue
+		}
+		if entry.Staged != internal.STATUS_UNMODIFIED {
+			staged = append(staged, statusLabels[entry.Staged]+entry.Name)
+		}
+		if entry.Unstaged != internal.STATUS_UNMODIFIED {
+			unstaged = append(unstaged, statusLabels[entry.Unstaged]+entry.Name)
+		}
+	}
+	printSection := func(title string, lines []string) {
+		if len(lines) == 0 {
+			return
+		}
+		fmt.Fprintf(stdout, "%v:\n\t%v\n\n", title, strings.Join(lines, "\n\t"))
+	}
+	printSection("Unmerged paths", unmerged)
+	printSection("Changes to be committed", staged)
+	printSection("Changes not staged for commit", unstaged)
+	printSection("Untracked files", untracked)
+
+	switch {
+	case len(staged) > 0 || len(unmerged) > 0:
+	case len(unstaged) > 0:
+		fmt.Fprintln(stdout, "no changes added to commit")
+	case len(untracked) > 0:
+		fmt.Fprintln(stdout, "nothing added to commit but untracked files present")
+	case result.Head == "":
+		fmt.Fprintln(stdout, "nothing to commit")
+	default:
+		fmt.Fprintln(stdout, "nothing to commit, working tree clean")
+	}
+}
@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+const BRANCH_PREFIX = "refs/heads/"
+
+// CurrentBranch returns the short name of the branch HEAD points to, empty when HEAD is detached
+func (r *LocalRepository) CurrentBranch() (string, error) {
+	target, isSymbolic, err := r.ReadSymbolicRef("HEAD")
+	if err != nil || !isSymbolic {
+		return "", err
+	}
+	return strings.TrimPrefix(target, BRANCH_PREFIX), nil
+}
+
+// CheckBranchName validates the short name of a branch
+// https://git-scm.com/docs/git-check-ref-format#Documentation/git-check-ref-format.txt---branch
+func CheckBranchName(name string) error {
+	if name == "HEAD" || strings.HasPrefix(name, "-") {
+		return fmt.Errorf("'%v' is not a valid branch name", name)
+	}
+	err := CheckRefFormat(BRANCH_PREFIX+name, false)
+	if err != nil {
+		return fmt.Errorf("'%v' is not a valid branch name", name)
+	}
+	return nil
+}
+
+// CreateBranch creates a branch at a revision, an existing branch is only reset with force
+// https://git-scm.com/docs/git-branch
+func (r *LocalRepository) CreateBranch(name string, startPoint string, force bool) error {
+	err := CheckBranchName(name)
+	if err != nil {
+		return err
+	}
+	sha, err := r.ResolveRevision(startPoint)
+	if err != nil {
+		return fmt.Errorf("not a valid object name: '%v'", startPoint)
+	}
+	if _, err := r.ReadCommit(sha); err != nil {
+		return fmt.Errorf("not a valid branch point: '%v'", startPoint)
+	}
+	existing, err := r.ResolveRef(BRANCH_PREFIX + name)
+	if err != nil {
+		return err
+	}
+	if existing != "" && !force {
+		return fmt.Errorf("a branch named '%v' already exists", name)
+	}
+	current, err := r.CurrentBranch()
+	if err != nil {
+		return err
+	}
+	if existing != "" && current == name {
+		return fmt.Errorf("cannot force update the current branch")
+	}
+	return r.UpdateRef(BRANCH_PREFIX+name, sha, "", false)
+}
+
+// DeleteBranch deletes a branch merged into HEAD, or any branch with force, it returns the sha
+// the branch was at
+func (r *LocalRepository) DeleteBranch(name string, force bool) (string, error) {
+	sha, err := r.ResolveRef(BRANCH_PREFIX + name)
+	if err != nil {
+		return "", err
+	}
+	if sha == "" {
+		return "", fmt.Errorf("branch '%v' not found", name)
+	}
+	current, err := r.CurrentBranch()
+	if err != nil {
+		return "", err
+	}
+	if current == name {
+		return "", fmt.Errorf("cannot delete branch '%v' checked out at '%v'", name, r.RootName)
+	}
+	if !force {
+		head, err := r.ResolveRef("HEAD")
+		if err != nil {
+			return "", err
+		}
+		merged, err := r.IsAncestor(sha, head)
+		if err != nil {
+			return "", err
+		}
+		if !merged {
+			return "", fmt.Errorf("the branch '%v' is not fully merged, use -D to delete it anyway", name)
+		}
+	}
+	return sha, r.DeleteRef(BRANCH_PREFIX+name, sha, false)
+}
+
+// RenameBranch moves a branch and HEAD when it points to it, an existing branch is only
+// overwritten with force
+func (r *LocalRepository) RenameBranch(oldName string, newName string, force bool) error {
+	err := CheckBranchName(newName)
+	if err != nil {
+		return err
+	}
+	current, err := r.CurrentBranch()
+	if err != nil {
+		return err
+	}
+	sha, err := r.ResolveRef(BRANCH_PREFIX + oldName)
+	if err != nil {
+		return err
+	}
+	// the current branch can be renamed before its first commit
+	if sha == "" && oldName != current {
+		return fmt.Errorf("no branch named '%v'", oldName)
+	}
+	existing, err := r.ResolveRef(BRANCH_PREFIX + newName)
+	if err != nil {
+		return err
+	}
+	if existing != "" && !force && oldName != newName {
+		return fmt.Errorf("a branch named '%v' already exists", newName)
+	}
+	if sha != "" {
+		if oldName != newName {
+			err = r.DeleteRef(BRANCH_PREFIX+oldName, sha, false)
+			if err != nil {
+				return err
+			}
+		}
+		err = r.UpdateRef(BRANCH_PREFIX+newName, sha, "", false)
+		if err != nil {
+			return err
+		}
+	}
+	if oldName == current {
+		return r.WriteSymbolicRef("HEAD", BRANCH_PREFIX+newName)
+	}
+	return nil
+}
+
+// IsAncestor tells whether a commit is reachable from another one by following parents
+func (r *LocalRepository) IsAncestor(ancestor string, descendant string) (bool, error) {
+	if descendant == "" {
+		return false, nil
+	}
+	seen := map[string]bool{}
+	pending := []string{descendant}
+	for len(pending) > 0 {
+		sha := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if sha == ancestor {
+			return true, nil
+		}
+		if seen[sha] {
+			continue
+		}
+		seen[sha] = true
+		commit, err := r.ReadCommit(sha)
+		if err != nil {
+			return false, err
+		}
+		pending = append(pending, commit.Parents...)
+	}
+	return false, nil
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// CheckoutTree writes the files of a tree-ish in the working tree and an index matching them,
+// like after a clone the working tree is expected to hold none of them, it returns the number of
+// entries written
+// https://git-scm.com/docs/git-checkout
+func (r *LocalRepository) CheckoutTree(treeish string) (int, error) {
+	treeSha, err := r.peelToTree(treeish)
+	if err != nil {
+		return 0, err
+	}
+	files, err := r.readTreeFiles(treeSha)
+	if err != nil {
+		return 0, err
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	index := &Index{}
+	checkedDirs := map[string]bool{}
+	for _, name := range names {
+		entry := files[name]
+		filename := filepath.Join(r.RootName, filepath.FromSlash(name))
+		err = r.checkNoSymlinkDir(path.Dir(name), checkedDirs)
+		if err != nil {
+			return 0, err
+		}
+		err = os.MkdirAll(filepath.Dir(filename), 0755)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create directory for %v, %v", name, err)
+		}
+		// like git, a submodule is an empty directory until it is initialized
+		if entry.Mode == "160000" {
+			err = os.Mkdir(filename, 0755)
+			if err != nil && !os.IsExist(err) {
+				return 0, fmt.Errorf("failed to create directory %v, %v", name, err)
+			}
+			index.Entries = append(index.Entries, IndexEntry{Mode: MODE_GITLINK, Sha: entry.Sha, Name: name})
+			continue
+		}
+
+		blob, err := r.ReadBlob(entry.Sha)
+		if err != nil {
+			return 0, err
+		}
+		switch entry.Mode {
+		case "120000":
+			err = os.Symlink(string(blob.Content), filename)
+		case "100755":
+			err = os.WriteFile(filename, blob.Content, 0755)
+		default:
+			err = os.WriteFile(filename, blob.Content, 0644)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to write %v, %v", name, err)
+		}
+		info, err := os.Lstat(filename)
+		if err != nil {
+			return 0, fmt.Errorf("failed to stat %v, %v", name, err)
+		}
+		index.Entries = append(index.Entries, newIndexEntry(name, info, entry.Sha))
+	}
+	return len(index.Entries), r.WriteIndex(index)
+}
+
+// checkNoSymlinkDir refuses to write beneath a symlink of the working tree, each directory of a
+// path is checked once, the ones that do not exist yet are created as directories
+func (r *LocalRepository) checkNoSymlinkDir(dir string, checked map[string]bool) error {
+	if dir == "." || checked[dir] {
+		return nil
+	}
+	err := r.checkNoSymlinkDir(path.Dir(dir), checked)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(filepath.Join(r.RootName, filepath.FromSlash(dir)))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to stat %v, %v", dir, err)
+	}
+	if err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("refusing to write beyond symbolic link %v", dir)
+	}
+	checked[dir] = true
+	return nil
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// the sha of the tree without entries
+const emptyTreeSha = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+var ErrNothingToCommit = errors.New("nothing to commit")
+
+var blankLinesRegexp = regexp.MustCompile(`\n{3,}`)
+
+type CommitResult struct {
+	Sha string
+	// empty when HEAD is detached
+	Branch string
+	Root   bool
+}
+
+// Commit writes the tree of the index as a child of HEAD and moves the branch HEAD points to, or
+// HEAD itself when detached, amend replaces the HEAD commit keeping its author and by default its
+// message, a commit with the same tree as its parent needs allowEmpty, amended or not
+// https://git-scm.com/docs/git-commit
+func (r *LocalRepository) Commit(message string, amend bool, allowEmpty bool) (*CommitResult, error) {
+	head, err := r.ResolveRef("HEAD")
+	if err != nil {
+		return nil, err
+	}
+	branch, err := r.CurrentBranch()
+	if err != nil {
+		return nil, err
+	}
+	treeSha, err := r.WriteTreeObject()
+	if err != nil {
+		return nil, err
+	}
+
+	parents := []string{}
+	var author *Signature
+	if amend {
+		if head == "" {
+			return nil, errors.New("you have nothing to amend")
+		}
+		headCommit, err := r.ReadCommit(head)
+		if err != nil {
+			return nil, err
+		}
+		parents = headCommit.Parents
+		author = headCommit.Author
+		if message == "" {
+			message = headCommit.Message
+		}
+	} else if head != "" {
+		parents = append(parents, head)
+	}
+
+	// like git, a commit with the tree of its only parent is empty, a merge never is
+	if !allowEmpty && len(parents) <= 1 {
+		parentTree := ""
+		if len(parents) == 1 {
+			parentTree, err = r.peelToTree(parents[0])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if parentTree == treeSha || (parentTree == "" && treeSha == emptyTreeSha) {
+			return nil, ErrNothingToCommit
+		}
+	}
+
+	message = CleanupMessage(message)
+	if message == "" {
+		return nil, errors.New("aborting commit due to empty commit message")
+	}
+	sha, err := r.WriteCommitObject(treeSha, parents, author, message)
+	if err != nil {
+		return nil, err
+	}
+	oldHead := head
+	if oldHead == "" {
+		oldHead = ZERO_SHA
+	}
+	err = r.UpdateRef("HEAD", sha, oldHead, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update HEAD, %v", err)
+	}
+	return &CommitResult{Sha: sha, Branch: branch, Root: len(parents) == 0}, nil
+}
+
+// CleanupMessage strips trailing whitespace, leading and trailing blank lines and collapses
+// consecutive blank lines, a non empty message ends with a line feed
+// https://git-scm.com/docs/git-commit#Documentation/git-commit.txt---cleanupltmodegt
+func CleanupMessage(message string) string {
+	lines := strings.Split(message, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r\v\f")
+	}
+	message = strings.Trim(strings.Join(lines, "\n"), "\n")
+	if message == "" {
+		return ""
+	}
+	return blankLinesRegexp.ReplaceAllString(message, "\n\n") + "\n"
+}
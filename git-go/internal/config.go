@@ -0,0 +1,680 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// https://git-scm.com/docs/git-config#_configuration_file
+const (
+	CONFIG_SYSTEM = "system"
+	CONFIG_GLOBAL = "global"
+	CONFIG_LOCAL  = "local"
+
+	// git gives up on deeper include chains, they are most likely loops
+	maxConfigIncludeDepth = 10
+)
+
+var (
+	ErrConfigKeyNotFound    = errors.New("key not found")
+	ErrConfigMultipleValues = errors.New("cannot overwrite multiple values with a single value")
+)
+
+// ConfigEntry is a variable, Key is section[.subsection].name with the section and the name
+// lowercased, a variable without "=" has no value and is a true boolean
+type ConfigEntry struct {
+	Key      string
+	Value    string
+	HasValue bool
+	Filename string
+}
+
+// Config holds the variables of one or several files, from the lowest to the highest precedence
+type Config struct {
+	Entries []ConfigEntry
+}
+
+// configVariable is a variable of a parsed file, with the bytes of its line(s)
+type configVariable struct {
+	ConfigEntry
+	// the name as written in the file
+	name  string
+	start int
+	end   int
+}
+
+// configSection is a section header of a parsed file, end is where its last variable ends
+type configSection struct {
+	name       string
+	subsection string
+	end        int
+}
+
+// ConfigFile is a parsed config file that can be modified and written back, keeping the
+// formatting and the comments of the untouched lines
+type ConfigFile struct {
+	Filename  string
+	content   []byte
+	variables []configVariable
+	sections  []configSection
+}
+
+func (r *LocalRepository) ConfigName() string {
+	return r.GitDir() + "/config"
+}
+
+func xdgConfigHome() string {
+	if configHome := os.Getenv("XDG_CONFIG_HOME"); configHome != "" {
+		return configHome
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config")
+}
+
+// expandHome replaces a leading ~/ of a path with the home directory
+func expandHome(name string) string {
+	if rest, found := strings.CutPrefix(name, "~/"); found {
+		home, _ := os.UserHomeDir()
+		return filepath.Join(home, rest)
+	}
+	return name
+}
+
+// ConfigFiles returns the files of a scope, from the lowest to the highest precedence
+func (r *LocalRepository) ConfigFiles(scope string) []string {
+	switch scope {
+	case CONFIG_SYSTEM:
+		if os.Getenv("GIT_CONFIG_NOSYSTEM") != "" {
+			return nil
+		}
+		if system := os.Getenv("GIT_CONFIG_SYSTEM"); system != "" {
+			return []string{system}
+		}
+		return []string{"/etc/gitconfig"}
+	case CONFIG_GLOBAL:
+		if global := os.Getenv("GIT_CONFIG_GLOBAL"); global != "" {
+			return []string{global}
+		}
+		home, _ := os.UserHomeDir()
+		return []string{filepath.Join(xdgConfigHome(), "git", "config"), filepath.Join(home, ".gitconfig")}
+	}
+	return []string{r.ConfigName()}
+}
+
+// GlobalConfigName is the file written by config --global
+func (r *LocalRepository) GlobalConfigName() string {
+	files := r.ConfigFiles(CONFIG_GLOBAL)
+	return files[len(files)-1]
+}
+
+// ReadConfig merges the system, global and local config files with their includes
+func (r *LocalRepository) ReadConfig() (*Config, error) {
+	config := &Config{}
+	for _, scope := range []string{CONFIG_SYSTEM, CONFIG_GLOBAL, CONFIG_LOCAL} {
+		scopeConfig, err := r.ReadConfigScope(scope, true)
+		if err != nil {
+			return nil, err
+		}
+		config.Entries = append(config.Entries, scopeConfig.Entries...)
+	}
+	return config, nil
+}
+
+// ReadConfigScope reads the files of a single scope, like git includes are only followed
+// when asked to
+func (r *LocalRepository) ReadConfigScope(scope string, includes bool) (*Config, error) {
+	config := &Config{}
+	for _, filename := range r.ConfigFiles(scope) {
+		err := r.readConfigFile(config, filename, includes, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// ReadConfigFileName reads a single file
+func (r *LocalRepository) ReadConfigFileName(filename string, includes bool) (*Config, error) {
+	config := &Config{}
+	return config, r.readConfigFile(config, filename, includes, 0)
+}
+
+// readConfigFile appends the variables of a file, included files are read in place of
+// their include.path or matching includeIf.<condition>.path variable, a missing file is empty
+// https://git-scm.com/docs/git-config#_includes
+func (r *LocalRepository) readConfigFile(config *Config, filename string, includes bool, depth int) error {
+	if depth > maxConfigIncludeDepth {
+		return fmt.Errorf("exceeded maximum include depth (%v) while including %v", maxConfigIncludeDepth, filename)
+	}
+	file, err := OpenConfigFile(filename)
+	if err != nil {
+		return err
+	}
+	for _, variable := range file.variables {
+		config.Entries = append(config.Entries, variable.ConfigEntry)
+		if !includes || !variable.HasValue || !strings.HasSuffix(variable.Key, ".path") {
+			continue
+		}
+		section, subsection, _ := splitConfigKey(variable.Key)
+		if section != "include" && (section != "includeif" || !r.includeConditionMatches(subsection, filename)) {
+			continue
+		}
+		included := expandHome(variable.Value)
+		if !filepath.IsAbs(included) {
+			included = filepath.Join(filepath.Dir(filename), included)
+		}
+		err = r.readConfigFile(config, included, includes, depth+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// includeConditionMatches evaluates the gitdir:, gitdir/i: and onbranch: conditions
+func (r *LocalRepository) includeConditionMatches(condition string, filename string) bool {
+	kind, pattern, _ := strings.Cut(condition, ":")
+	var value string
+	switch kind {
+	case "gitdir", "gitdir/i":
+		gitDir, err := filepath.Abs(r.GitDir())
+		if err != nil {
+			return false
+		}
+		value = filepath.ToSlash(gitDir)
+		switch {
+		case strings.HasPrefix(pattern, "./"):
+			pattern = filepath.ToSlash(filepath.Dir(filename)) + pattern[1:]
+		case strings.HasPrefix(pattern, "~/"):
+			pattern = filepath.ToSlash(expandHome(pattern))
+		case !strings.HasPrefix(pattern, "/"):
+			pattern = "**/" + pattern
+		}
+		if kind == "gitdir/i" {
+			value, pattern = strings.ToLower(value), strings.ToLower(pattern)
+		}
+	case "onbranch":
+		head, err := os.ReadFile(r.HeadName())
+		if err != nil {
+			return false
+		}
+		var isBranch bool
+		value, isBranch = strings.CutPrefix(strings.TrimSpace(string(head)), "ref: refs/heads/")
+		if !isBranch {
+			return false
+		}
+	default:
+		return false
+	}
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "**"
+	}
+	// a pattern that cannot be matched such as an invalid range includes nothing
+	compiled, err := regexp.Compile("^" + globToRegexp(pattern) + "$")
+	return err == nil && compiled.MatchString(value)
+}
+
+// Get returns the last value of a variable
+func (c *Config) Get(key string) (string, bool) {
+	values := c.GetAll(key)
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[len(values)-1], true
+}
+
+// GetAll returns the values of a multi-valued variable, in order
+func (c *Config) GetAll(key string) []string {
+	key = NormalizeConfigKey(key)
+	values := []string{}
+	for _, entry := range c.Entries {
+		if entry.Key == key {
+			values = append(values, entry.Value)
+		}
+	}
+	return values
+}
+
+// GetBool reads a boolean variable, a variable without value is true
+// https://git-scm.com/docs/git-config#Documentation/git-config.txt-boolean
+func (c *Config) GetBool(key string, defaultValue bool) (bool, error) {
+	key = NormalizeConfigKey(key)
+	for i := len(c.Entries) - 1; i >= 0; i-- {
+		entry := c.Entries[i]
+		if entry.Key != key {
+			continue
+		}
+		if !entry.HasValue {
+			return true, nil
+		}
+		value, err := ParseConfigBool(entry.Value)
+		if err != nil {
+			return false, fmt.Errorf("%v for '%v'", err, key)
+		}
+		return value, nil
+	}
+	return defaultValue, nil
+}
+
+// ParseConfigBool reads true, yes, on, 1 and false, no, off, 0 or an empty value
+func ParseConfigBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0", "":
+		return false, nil
+	}
+	return false, fmt.Errorf("bad boolean config value '%v'", value)
+}
+
+// ConfigValue returns the last value of a variable in the merged config, empty when not set
+func (r *LocalRepository) ConfigValue(key string) (string, error) {
+	config, err := r.ReadConfig()
+	if err != nil {
+		return "", err
+	}
+	value, _ := config.Get(key)
+	return value, nil
+}
+
+// SetConfigValue sets a variable of the local config
+func (r *LocalRepository) SetConfigValue(key string, value string) error {
+	file, err := OpenConfigFile(r.ConfigName())
+	if err != nil {
+		return err
+	}
+	err = file.Set(key, value)
+	if err != nil {
+		return err
+	}
+	return file.Write()
+}
+
+// splitConfigKey splits section.subsection.name, the subsection may contain dots
+func splitConfigKey(key string) (string, string, string) {
+	first := strings.Index(key, ".")
+	last := strings.LastIndex(key, ".")
+	if first == -1 {
+		return "", "", key
+	}
+	if first == last {
+		return key[:first], "", key[last+1:]
+	}
+	return key[:first], key[first+1 : last], key[last+1:]
+}
+
+// NormalizeConfigKey lowercases the section and the name of a key, subsections are case sensitive
+func NormalizeConfigKey(key string) string {
+	section, subsection, name := splitConfigKey(key)
+	if subsection == "" {
+		return strings.ToLower(section) + "." + strings.ToLower(name)
+	}
+	return strings.ToLower(section) + "." + subsection + "." + strings.ToLower(name)
+}
+
+// ValidateConfigKey checks that a key has a section and a valid name
+func ValidateConfigKey(key string) error {
+	section, _, name := splitConfigKey(key)
+	if section == "" {
+		return fmt.Errorf("key does not contain a section: %v", key)
+	}
+	if name == "" || !isConfigNameStart(name[0]) || strings.IndexFunc(name, func(c rune) bool {
+		return c > 0x7f || !isConfigNameChar(byte(c))
+	}) != -1 {
+		return fmt.Errorf("invalid key: %v", key)
+	}
+	if strings.IndexFunc(section, func(c rune) bool { return c > 0x7f || !isConfigNameChar(byte(c)) }) != -1 {
+		return fmt.Errorf("invalid key: %v", key)
+	}
+	return nil
+}
+
+func isConfigNameStart(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isConfigNameChar(c byte) bool {
+	return isConfigNameStart(c) || (c >= '0' && c <= '9') || c == '-'
+}
+
+// OpenConfigFile parses a config file, a missing file is an empty one
+func OpenConfigFile(filename string) (*ConfigFile, error) {
+	content, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &ConfigFile{Filename: filename}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %v, %v", filename, err)
+	}
+	file := &ConfigFile{Filename: filename, content: content}
+	err = file.parse()
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// parse reads the sections and the variables, with git's quoting and escaping rules
+func (f *ConfigFile) parse() error {
+	data := f.content
+	position := 0
+	line := 1
+	lineStart := 0
+	section := ""
+	badLine := func() error {
+		return fmt.Errorf("bad config line %v in file %v", line, f.Filename)
+	}
+	skipLine := func() {
+		for position < len(data) && data[position] != '\n' {
+			position++
+		}
+	}
+
+	for position < len(data) {
+		c := data[position]
+		switch {
+		case c == '\n':
+			position++
+			line++
+			lineStart = position
+		case c == ' ' || c == '\t' || c == '\r':
+			position++
+		case c == '#' || c == ';':
+			skipLine()
+		case c == '[':
+			position++
+			nameStart := position
+			for position < len(data) && (isConfigNameChar(data[position]) || data[position] == '.') {
+				position++
+			}
+			header := configSection{name: strings.ToLower(string(data[nameStart:position]))}
+			if position < len(data) && (data[position] == ' ' || data[position] == '\t') {
+				// [section "subsection"], the subsection keeps its case
+				for position < len(data) && (data[position] == ' ' || data[position] == '\t') {
+					position++
+				}
+				if position >= len(data) || data[position] != '"' {
+					return badLine()
+				}
+				position++
+				subsection := strings.Builder{}
+				for position < len(data) && data[position] != '"' {
+					if data[position] == '\n' {
+						return badLine()
+					}
+					if data[position] == '\\' && position+1 < len(data) && data[position+1] != '\n' {
+						position++
+					}
+					subsection.WriteByte(data[position])
+					position++
+				}
+				position++
+				header.subsection = subsection.String()
+			} else if dot := strings.Index(header.name, "."); dot != -1 {
+				// deprecated [section.subsection] syntax
+				header.name, header.subsection = header.name[:dot], header.name[dot+1:]
+			}
+			if position >= len(data) || data[position] != ']' || header.name == "" {
+				return badLine()
+			}
+			position++
+			// the header owns the rest of its line unless a variable follows it
+			end := position
+			for end < len(data) && (data[end] == ' ' || data[end] == '\t' || data[end] == '\r') {
+				end++
+			}
+			if end < len(data) && (data[end] == '#' || data[end] == ';') {
+				for end < len(data) && data[end] != '\n' {
+					end++
+				}
+			}
+			if end < len(data) && data[end] == '\n' {
+				position = end + 1
+				line++
+				lineStart = position
+			} else if end == len(data) {
+				position = end
+			}
+			header.end = position
+			f.sections = append(f.sections, header)
+			section = header.name
+			if header.subsection != "" {
+				section += "." + header.subsection
+			}
+		case isConfigNameStart(c):
+			if section == "" {
+				return badLine()
+			}
+			start := position
+			// a variable on the same line as its section header starts right after it
+			if strings.TrimSpace(string(data[lineStart:position])) == "" {
+				start = lineStart
+			} else {
+				start = f.sections[len(f.sections)-1].end
+			}
+			nameStart := position
+			for position < len(data) && isConfigNameChar(data[position]) {
+				position++
+			}
+			variable := configVariable{name: string(data[nameStart:position]), start: start}
+			variable.Filename = f.Filename
+			variable.Key = section + "." + strings.ToLower(variable.name)
+			for position < len(data) && (data[position] == ' ' || data[position] == '\t' || data[position] == '\r') {
+				position++
+			}
+			if position < len(data) && data[position] == '=' {
+				position++
+				value, newPosition, lines, err := parseConfigValue(data, position)
+				if err != nil {
+					return fmt.Errorf("%v at line %v in file %v", err, line, f.Filename)
+				}
+				variable.Value, variable.HasValue = value, true
+				position = newPosition
+				line += lines
+			} else if position < len(data) && data[position] != '\n' && data[position] != '#' && data[position] != ';' {
+				return badLine()
+			} else {
+				skipLine()
+			}
+			if position < len(data) {
+				// the variable owns its line feed
+				position++
+				line++
+				lineStart = position
+			}
+			variable.end = position
+			f.sections[len(f.sections)-1].end = position
+			f.variables = append(f.variables, variable)
+		default:
+			return badLine()
+		}
+	}
+	return nil
+}
+
+// parseConfigValue reads a value up to the end of its line, a trailing comment or its last
+// continued line, it returns the position of the line feed and the number of continued lines
+func parseConfigValue(data []byte, position int) (string, int, int, error) {
+	value := strings.Builder{}
+	quoted := false
+	spaces := 0
+	lines := 0
+	for ; position < len(data); position++ {
+		c := data[position]
+		if c == '\n' {
+			if quoted {
+				return "", 0, 0, errors.New("unterminated quoted value")
+			}
+			break
+		}
+		if !quoted && (c == ';' || c == '#') {
+			for position < len(data) && data[position] != '\n' {
+				position++
+			}
+			break
+		}
+		if !quoted && (c == ' ' || c == '\t' || c == '\r') {
+			// inner whitespace is kept as spaces, leading and trailing whitespace is dropped
+			if value.Len() > 0 {
+				spaces++
+			}
+			continue
+		}
+		value.WriteString(strings.Repeat(" ", spaces))
+		spaces = 0
+		switch c {
+		case '\\':
+			position++
+			if position >= len(data) {
+				return "", 0, 0, errors.New("bad escape at end of value")
+			}
+			switch data[position] {
+			case '\n':
+				lines++
+			case 't':
+				value.WriteByte('\t')
+			case 'b':
+				value.WriteByte('\b')
+			case 'n':
+				value.WriteByte('\n')
+			case '\\', '"':
+				value.WriteByte(data[position])
+			default:
+				return "", 0, 0, fmt.Errorf("invalid escape \\%c", data[position])
+			}
+		case '"':
+			quoted = !quoted
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return value.String(), position, lines, nil
+}
+
+// Config returns the variables of the file itself, without includes
+func (f *ConfigFile) Config() *Config {
+	config := &Config{}
+	for _, variable := range f.variables {
+		config.Entries = append(config.Entries, variable.ConfigEntry)
+	}
+	return config
+}
+
+func (f *ConfigFile) find(key string) []int {
+	key = NormalizeConfigKey(key)
+	found := []int{}
+	for i, variable := range f.variables {
+		if variable.Key == key {
+			found = append(found, i)
+		}
+	}
+	return found
+}
+
+// Set replaces the value of a variable or adds it, a multi-valued variable can not be set
+func (f *ConfigFile) Set(key string, value string) error {
+	err := ValidateConfigKey(key)
+	if err != nil {
+		return err
+	}
+	found := f.find(key)
+	if len(found) > 1 {
+		return ErrConfigMultipleValues
+	}
+	if len(found) == 0 {
+		return f.Add(key, value)
+	}
+	variable := f.variables[found[0]]
+	_, _, name := splitConfigKey(key)
+	line := formatConfigVariable(name, value)
+	if variable.start > 0 && f.content[variable.start-1] != '\n' {
+		line = "\n" + line
+	}
+	return f.replace(variable.start, variable.end, line)
+}
+
+// Add appends a value to the last section of the key, or to a new section
+func (f *ConfigFile) Add(key string, value string) error {
+	err := ValidateConfigKey(key)
+	if err != nil {
+		return err
+	}
+	section, subsection, name := splitConfigKey(key)
+	for i := len(f.sections) - 1; i >= 0; i-- {
+		if f.sections[i].name == strings.ToLower(section) && f.sections[i].subsection == subsection {
+			line := formatConfigVariable(name, value)
+			if f.content[f.sections[i].end-1] != '\n' {
+				line = "\n" + line
+			}
+			return f.replace(f.sections[i].end, f.sections[i].end, line)
+		}
+	}
+	header := "[" + section + "]\n"
+	if subsection != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(subsection)
+		header = "[" + section + " \"" + escaped + "\"]\n"
+	}
+	if len(f.content) > 0 && f.content[len(f.content)-1] != '\n' {
+		header = "\n" + header
+	}
+	return f.replace(len(f.content), len(f.content), header+formatConfigVariable(name, value))
+}
+
+// Unset removes a variable, all its values with all, it fails when the key is not set
+func (f *ConfigFile) Unset(key string, all bool) error {
+	found := f.find(key)
+	if len(found) == 0 {
+		return ErrConfigKeyNotFound
+	}
+	if len(found) > 1 && !all {
+		return fmt.Errorf("%v has multiple values", key)
+	}
+	for i := len(found) - 1; i >= 0; i-- {
+		variable := f.variables[found[i]]
+		// a section header keeps its line feed
+		text := ""
+		if variable.start > 0 && f.content[variable.start-1] != '\n' {
+			text = "\n"
+		}
+		err := f.replace(variable.start, variable.end, text)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replace splices the content and parses it again
+func (f *ConfigFile) replace(start int, end int, text string) error {
+	content := append([]byte{}, f.content[:start]...)
+	content = append(content, text...)
+	f.content = append(content, f.content[end:]...)
+	f.variables, f.sections = nil, nil
+	return f.parse()
+}
+
+// Write writes the file through a lock file
+func (f *ConfigFile) Write() error {
+	err := os.MkdirAll(filepath.Dir(f.Filename), 0755)
+	if err == nil {
+		err = writeLockedFile(f.Filename, f.content)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write config %v, %v", f.Filename, err)
+	}
+	return nil
+}
+
+// formatConfigVariable quotes the values git would not read back as they are
+func formatConfigVariable(name string, value string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`, "\b", `\b`).Replace(value)
+	if strings.TrimSpace(value) != value || strings.ContainsAny(value, "#;") {
+		escaped = `"` + escaped + `"`
+	}
+	return "\t" + name + " = " + escaped + "\n"
+}
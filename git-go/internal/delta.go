@@ -0,0 +1,124 @@
+package internal
+
+// https://git-scm.com/docs/pack-format#_deltified_representation
+const (
+	// base blocks are indexed on this size, shorter matches are inserted
+	deltaBlockSize = 16
+	// largest copy of a single instruction, bigger matches are split
+	maxDeltaCopySize   = 0x10000
+	maxDeltaInsertSize = 0x7f
+	// offsets kept for a block, like limit_hash_buckets in git's diff-delta.c, so repetitive
+	// content does not try every offset of base
+	maxDeltaBlockOffsets = 64
+)
+
+// createDelta encodes target as copy instructions from base and insert instructions
+// for the bytes not found in base, applyDelta(base, delta) returns target
+func createDelta(base []byte, target []byte) []byte {
+	delta := appendDeltaSize(nil, int64(len(base)))
+	delta = appendDeltaSize(delta, int64(len(target)))
+
+	// offsets of the aligned blocks of base by content
+	blocks := map[string][]int{}
+	for offset := 0; offset+deltaBlockSize <= len(base); offset += deltaBlockSize {
+		key := string(base[offset : offset+deltaBlockSize])
+		blocks[key] = append(blocks[key], offset)
+	}
+	// the kept offsets are spread over the whole base
+	for key, offsets := range blocks {
+		if len(offsets) <= maxDeltaBlockOffsets {
+			continue
+		}
+		kept := make([]int, maxDeltaBlockOffsets)
+		for i := range kept {
+			kept[i] = offsets[i*len(offsets)/maxDeltaBlockOffsets]
+		}
+		blocks[key] = kept
+	}
+
+	insert := []byte{}
+	position := 0
+	for position < len(target) {
+		matchOffset, matchSize := 0, 0
+		if position+deltaBlockSize <= len(target) {
+			// a match is not extended past a single copy instruction, the next one starts a new lookup
+			maxSize := min(len(target)-position, maxDeltaCopySize)
+			for _, offset := range blocks[string(target[position:position+deltaBlockSize])] {
+				size := deltaBlockSize
+				for size < maxSize && offset+size < len(base) && base[offset+size] == target[position+size] {
+					size++
+				}
+				if size > matchSize {
+					matchOffset, matchSize = offset, size
+				}
+				if matchSize == maxSize {
+					break
+				}
+			}
+		}
+		if matchSize == 0 {
+			insert = append(insert, target[position])
+			position++
+			continue
+		}
+		position += matchSize
+
+		// the match can also cover the end of the pending insert
+		for len(insert) > 0 && matchOffset > 0 && base[matchOffset-1] == insert[len(insert)-1] {
+			insert = insert[:len(insert)-1]
+			matchOffset--
+			matchSize++
+		}
+		delta = appendDeltaInsert(delta, insert)
+		insert = insert[:0]
+		for matchSize > 0 {
+			size := min(matchSize, maxDeltaCopySize)
+			delta = appendDeltaCopy(delta, matchOffset, size)
+			matchOffset += size
+			matchSize -= size
+		}
+	}
+	return appendDeltaInsert(delta, insert)
+}
+
+// appendDeltaSize is the reverse of readDeltaSize, 7 bits per byte, least significant first
+func appendDeltaSize(delta []byte, size int64) []byte {
+	for size >= 0x80 {
+		delta = append(delta, byte(size)|msbMask)
+		size >>= 7
+	}
+	return append(delta, byte(size))
+}
+
+func appendDeltaInsert(delta []byte, insert []byte) []byte {
+	for len(insert) > 0 {
+		size := min(len(insert), maxDeltaInsertSize)
+		delta = append(delta, byte(size))
+		delta = append(delta, insert[:size]...)
+		insert = insert[size:]
+	}
+	return delta
+}
+
+// appendDeltaCopy writes the offset and size bytes that are not zero, flagged in the opcode
+func appendDeltaCopy(delta []byte, offset int, size int) []byte {
+	opcode := byte(0x80)
+	arguments := []byte{}
+	for i := 0; i < 4; i++ {
+		if b := byte(offset >> (8 * i)); b != 0 {
+			opcode |= 1 << i
+			arguments = append(arguments, b)
+		}
+	}
+	// a size of 0x10000 is encoded as 0
+	if size != maxDeltaCopySize {
+		for i := 0; i < 3; i++ {
+			if b := byte(size >> (8 * i)); b != 0 {
+				opcode |= 1 << (4 + i)
+				arguments = append(arguments, b)
+			}
+		}
+	}
+	delta = append(delta, opcode)
+	return append(delta, arguments...)
+}
@@ -0,0 +1,306 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	// haves sent before the first round trip, doubled each round like git over http
+	initialFlush = 16
+	// haves sent without any new common commit before giving up, once one was found
+	maxInVain = 256
+)
+
+// Refspec maps remote refs to local refs, like +refs/heads/*:refs/remotes/origin/*
+// https://git-scm.com/docs/git-fetch#_configured_remote_tracking_branches
+type Refspec struct {
+	// update the local ref even when it is not a fast-forward
+	Force bool
+	Src   string
+	// empty when the fetched refs are not stored in a local ref
+	Dst string
+}
+
+// ParseRefspec reads a [+]<src>[:<dst>] refspec, a dst without refs/ is a branch like in git
+// https://git-scm.com/docs/git-fetch#Documentation/git-fetch.txt-ltrefspecgt
+func ParseRefspec(spec string) (Refspec, error) {
+	refspec := Refspec{}
+	value, force := strings.CutPrefix(spec, "+")
+	refspec.Force = force
+	refspec.Src, refspec.Dst, _ = strings.Cut(value, ":")
+	if refspec.Src == "" {
+		refspec.Src = "HEAD"
+	}
+	srcStars, dstStars := strings.Count(refspec.Src, "*"), strings.Count(refspec.Dst, "*")
+	if srcStars > 1 || dstStars > 1 || (refspec.Dst != "" && srcStars != dstStars) {
+		return Refspec{}, fmt.Errorf("invalid refspec '%v'", spec)
+	}
+	if refspec.Dst != "" && !refspec.IsPattern() && !strings.HasPrefix(refspec.Dst, "refs/") {
+		if strings.HasPrefix(refspec.Dst, "heads/") || strings.HasPrefix(refspec.Dst, "tags/") || strings.HasPrefix(refspec.Dst, "remotes/") {
+			refspec.Dst = "refs/" + refspec.Dst
+		} else {
+			refspec.Dst = BRANCH_PREFIX + refspec.Dst
+		}
+	}
+	if refspec.Dst != "" && CheckRefFormat(strings.Replace(refspec.Dst, "*", "x", 1), false) != nil {
+		return Refspec{}, fmt.Errorf("invalid refspec '%v'", spec)
+	}
+	return refspec, nil
+}
+
+// IsPattern tells whether the refspec maps refs with a * glob
+func (s Refspec) IsPattern() bool {
+	return strings.Contains(s.Src, "*")
+}
+
+// MapRef returns the local ref of a remote ref matched by a pattern refspec
+func (s Refspec) MapRef(name string) (string, bool) {
+	prefix, suffix, _ := strings.Cut(s.Src, "*")
+	if !s.IsPattern() || len(name) < len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	if s.Dst == "" {
+		return "", true
+	}
+	return strings.Replace(s.Dst, "*", name[len(prefix):len(name)-len(suffix)], 1), true
+}
+
+// haveWalker walks the local commits newest first, the ancestors of commits known to be common
+// with the remote are not sent
+type haveWalker struct {
+	repository *LocalRepository
+	commits    map[string]*Commit
+	// commits sorted by committer date, newest first
+	pending []string
+	common  map[string]bool
+	// the commits advertised by the remote, sent but not their ancestors
+	remoteTips map[string]bool
+}
+
+// newHaveWalker starts from the commits of the local refs and HEAD
+func newHaveWalker(repository *LocalRepository, remoteTips []string) (*haveWalker, error) {
+	walker := &haveWalker{repository: repository, commits: map[string]*Commit{}, common: map[string]bool{}, remoteTips: map[string]bool{}}
+	refs, err := repository.ListRefs()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(refs)+1)
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	head, err := repository.ResolveRef("HEAD")
+	if err != nil {
+		return nil, err
+	}
+	shas := []string{}
+	if head != "" {
+		shas = append(shas, head)
+	}
+	for _, name := range names {
+		shas = append(shas, refs[name])
+	}
+	for _, sha := range remoteTips {
+		if repository.ObjectExists(sha) {
+			walker.remoteTips[sha] = true
+			shas = append(shas, sha)
+		}
+	}
+	for _, sha := range shas {
+		// tags are peeled, refs to other objects have no history to send
+		commitSha, err := repository.applyRevisionSuffix(sha, "^{commit}")
+		if err != nil {
+			continue
+		}
+		err = walker.push(commitSha)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return walker, nil
+}
+
+func (w *haveWalker) push(sha string) error {
+	if _, seen := w.commits[sha]; seen {
+		return nil
+	}
+	commit, err := w.repository.ReadCommit(sha)
+	if err != nil {
+		return err
+	}
+	w.commits[sha] = commit
+	i := 0
+	for i < len(w.pending) && commitDate(w.commits[w.pending[i]]) >= commitDate(commit) {
+		i++
+	}
+	w.pending = append(w.pending[:i], append([]string{sha}, w.pending[i:]...)...)
+	return nil
+}
+
+// next returns the next commit to send as have, empty when there is none left
+func (w *haveWalker) next() (string, error) {
+	for len(w.pending) > 0 {
+		sha := w.pending[0]
+		w.pending = w.pending[1:]
+		for _, parent := range w.commits[sha].Parents {
+			if w.common[sha] || w.remoteTips[sha] {
+				w.common[parent] = true
+			}
+			err := w.push(parent)
+			if err != nil {
+				return "", err
+			}
+		}
+		if !w.common[sha] {
+			return sha, nil
+		}
+	}
+	return "", nil
+}
+
+// markCommon marks a commit and the ancestors walked so far as common
+func (w *haveWalker) markCommon(sha string) {
+	visited := map[string]bool{}
+	pending := []string{sha}
+	for len(pending) > 0 {
+		sha := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if visited[sha] {
+			continue
+		}
+		visited[sha] = true
+		w.common[sha] = true
+		if commit, seen := w.commits[sha]; seen {
+			pending = append(pending, commit.Parents...)
+		}
+	}
+}
+
+// NegotiatePack sends the local commits as have lines in rounds until the remote is ready to send
+// the objects missing from the local repository, then returns the body of the response positioned
+// at the start of the pack, over http each round is a new request repeating the wants and the
+// commits found in common so far
+// https://git-scm.com/docs/pack-protocol#_packfile_negotiation
+// https://git-scm.com/docs/gitprotocol-http#_smart_service_git_upload_pack
+func (r *RemoteRepository) NegotiatePack(local *LocalRepository, wants []string, remoteTips []string, includeTag bool) (io.ReadCloser, error) {
+	if !slices.Contains(r.Capabilities, "multi_ack_detailed") {
+		return r.FetchPack(wants, includeTag)
+	}
+	walker, err := newHaveWalker(local, remoteTips)
+	if err != nil {
+		return nil, err
+	}
+
+	capabilities := "multi_ack_detailed ofs-delta"
+	if includeTag {
+		capabilities += " include-tag"
+	}
+	state := wantRequest(wants, capabilities)
+	round := ""
+	flushAt, count, inVain := initialFlush, 0, 0
+	gotContinue := false
+	for {
+		sha, err := walker.next()
+		if err != nil {
+			return nil, err
+		}
+		if sha == "" {
+			break
+		}
+		round += pktLine("have " + sha + "\n")
+		count++
+		inVain++
+		if count < flushAt {
+			continue
+		}
+
+		acks, err := r.sendHaves(state + round + "0000")
+		if err != nil {
+			return nil, err
+		}
+		round = ""
+		ready := false
+		for _, ack := range acks {
+			// like git, a new common commit is repeated in the next requests
+			if ack.status == "common" && !walker.common[ack.sha] {
+				state += pktLine("have " + ack.sha + "\n")
+				inVain = 0
+			} else if ack.status != "common" {
+				inVain = 0
+			}
+			gotContinue = true
+			ready = ready || ack.status == "ready"
+			walker.markCommon(ack.sha)
+		}
+		if ready || (gotContinue && inVain > maxInVain) {
+			break
+		}
+		flushAt *= 2
+	}
+
+	res, err := r.postUploadPack(state + round + pktLine("done\n"))
+	if err != nil {
+		return nil, err
+	}
+	// the commits of the last request are acknowledged again before the final ACK or NAK
+	for {
+		line, _, err := readPktLine(res.Body)
+		if err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 1 && fields[0] == "NAK", len(fields) == 2 && fields[0] == "ACK":
+			return res.Body, nil
+		case len(fields) == 3 && fields[0] == "ACK":
+		default:
+			res.Body.Close()
+			return nil, unexpectedNegotiationLine(line)
+		}
+	}
+}
+
+type acknowledgment struct {
+	sha string
+	// common or ready
+	status string
+}
+
+// sendHaves sends a round of have lines ended by a flush-pkt, the remote acknowledges the ones it
+// has until a NAK
+func (r *RemoteRepository) sendHaves(reqBody string) ([]acknowledgment, error) {
+	res, err := r.postUploadPack(reqBody)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	acks := []acknowledgment{}
+	for {
+		line, flush, err := readPktLine(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(line)
+		switch {
+		case flush:
+		case len(fields) == 1 && fields[0] == "NAK":
+			return acks, nil
+		case len(fields) == 3 && fields[0] == "ACK":
+			acks = append(acks, acknowledgment{sha: fields[1], status: fields[2]})
+		default:
+			return nil, unexpectedNegotiationLine(line)
+		}
+	}
+}
+
+func unexpectedNegotiationLine(line string) error {
+	if message, isError := strings.CutPrefix(line, "ERR "); isError {
+		return fmt.Errorf("remote error: %v", strings.TrimSpace(message))
+	}
+	return fmt.Errorf("unexpected negotiation line %v", strings.TrimSpace(line))
+}
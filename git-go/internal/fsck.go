@@ -0,0 +1,307 @@
+package internal
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	FSCK_MISSING  = "missing"
+	FSCK_DANGLING = "dangling"
+	FSCK_CORRUPT  = "corrupt"
+)
+
+type FsckIssue struct {
+	Kind       string
+	ObjectType string
+	Sha        string
+	Reason     string
+}
+
+func (i FsckIssue) String() string {
+	if i.Kind == FSCK_CORRUPT {
+		return fmt.Sprintf("error in %s %s: %s", i.ObjectType, i.Sha, i.Reason)
+	}
+	if i.Reason != "" {
+		return fmt.Sprintf("%s %s %s (%s)", i.Kind, i.ObjectType, i.Sha, i.Reason)
+	}
+	return fmt.Sprintf("%s %s %s", i.Kind, i.ObjectType, i.Sha)
+}
+
+// Fsck verifies every loose and packed object, then walks the objects reachable from HEAD
+// and the refs to report the missing and dangling ones
+func (r *LocalRepository) Fsck() ([]FsckIssue, error) {
+	issues := []FsckIssue{}
+	types := map[string]string{}
+	links := map[string][]objectLink{}
+
+	check := func(sha string, objType string, content []byte) {
+		objectLinks, err := fsckObject(objType, content)
+		if err != nil {
+			issues = append(issues, FsckIssue{Kind: FSCK_CORRUPT, ObjectType: objType, Sha: sha, Reason: err.Error()})
+		}
+		types[sha] = objType
+		links[sha] = objectLinks
+	}
+
+	looseShas, err := r.LooseObjects()
+	if err != nil {
+		return nil, err
+	}
+	for _, sha := range looseShas {
+		objType, content, err := r.readLooseObjectChecked(sha)
+		if err != nil {
+			issues = append(issues, FsckIssue{Kind: FSCK_CORRUPT, ObjectType: "object", Sha: sha, Reason: err.Error()})
+			continue
+		}
+		check(sha, objType, content)
+	}
+
+	packs, err := r.PackFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, pack := range packs {
+		packIssues, err := r.fsckPack(pack, check)
+		if err != nil {
+			return nil, err
+		}
+		issues = append(issues, packIssues...)
+	}
+
+	roots := map[string]string{}
+	refs, err := r.ListRefs()
+	if err != nil {
+		return nil, err
+	}
+	for name, sha := range refs {
+		roots[sha] = name
+	}
+	head, err := r.ResolveRef("HEAD")
+	if err != nil {
+		return nil, err
+	}
+	if head != "" {
+		roots[head] = "HEAD"
+	}
+
+	reachable := map[string]bool{}
+	queue := []string{}
+	for sha, name := range roots {
+		if _, ok := types[sha]; !ok {
+			issues = append(issues, FsckIssue{Kind: FSCK_MISSING, ObjectType: "object", Sha: sha, Reason: "pointed by " + name})
+			continue
+		}
+		reachable[sha] = true
+		queue = append(queue, sha)
+	}
+	for len(queue) > 0 {
+		sha := queue[0]
+		queue = queue[1:]
+		for _, link := range links[sha] {
+			if reachable[link.sha] {
+				continue
+			}
+			objType, ok := types[link.sha]
+			if !ok {
+				issues = append(issues, FsckIssue{Kind: FSCK_MISSING, ObjectType: link.objType, Sha: link.sha})
+				reachable[link.sha] = true
+				continue
+			}
+			if objType != link.objType {
+				issues = append(issues, FsckIssue{Kind: FSCK_CORRUPT, ObjectType: types[sha], Sha: sha, Reason: fmt.Sprintf("%s is a %s, not a %s", link.sha, objType, link.objType)})
+			}
+			reachable[link.sha] = true
+			queue = append(queue, link.sha)
+		}
+	}
+
+	index, err := r.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range index.Entries {
+		if entry.Mode == MODE_GITLINK || reachable[entry.Sha] {
+			continue
+		}
+		reachable[entry.Sha] = true
+		if _, ok := types[entry.Sha]; !ok {
+			issues = append(issues, FsckIssue{Kind: FSCK_MISSING, ObjectType: "blob", Sha: entry.Sha, Reason: "pointed by index entry " + entry.Name})
+		}
+	}
+
+	// like git, only unreachable objects that no other object references are dangling
+	referenced := map[string]bool{}
+	for _, objectLinks := range links {
+		for _, link := range objectLinks {
+			referenced[link.sha] = true
+		}
+	}
+	for sha, objType := range types {
+		if !reachable[sha] && !referenced[sha] {
+			issues = append(issues, FsckIssue{Kind: FSCK_DANGLING, ObjectType: objType, Sha: sha})
+		}
+	}
+
+	sort.SliceStable(issues, func(i, j int) bool {
+		if issues[i].Kind != issues[j].Kind {
+			return issues[i].Kind < issues[j].Kind
+		}
+		return issues[i].Sha < issues[j].Sha
+	})
+	return issues, nil
+}
+
+// readLooseObjectChecked inflates a loose object and verifies its header and hash
+func (r *LocalRepository) readLooseObjectChecked(hashHex string) (string, []byte, error) {
+	file, err := os.ReadFile(filepath.Join(r.ObjectsName(), hashHex[:2], hashHex[2:]))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read object, %v", err)
+	}
+	reader, err := zlib.NewReader(bytes.NewReader(file))
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid zlib stream, %v", err)
+	}
+	defer reader.Close()
+	object, err := io.ReadAll(reader)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid zlib stream, %v", err)
+	}
+
+	sum := sha1.Sum(object)
+	if hex.EncodeToString(sum[:]) != hashHex {
+		return "", nil, fmt.Errorf("hash mismatch, content hashes to %x", sum)
+	}
+	idx := bytes.IndexByte(object, 0)
+	if idx == -1 {
+		return "", nil, fmt.Errorf("missing object header")
+	}
+	objType, size, found := strings.Cut(string(object[:idx]), " ")
+	if !found {
+		return "", nil, fmt.Errorf("invalid object header %q", object[:idx])
+	}
+	if _, err := parsePackFileObjectType(objType); err != nil {
+		return "", nil, fmt.Errorf("invalid object type %q", objType)
+	}
+	if size != strconv.Itoa(len(object)-idx-1) {
+		return "", nil, fmt.Errorf("bad object size %v, content has %v bytes", size, len(object)-idx-1)
+	}
+	return objType, object[idx+1:], nil
+}
+
+// fsckPack verifies the pack checksum against its trailer and index, then rehashes every object of the pack
+func (r *LocalRepository) fsckPack(pack string, check func(sha string, objType string, content []byte)) ([]FsckIssue, error) {
+	issues := []FsckIssue{}
+	packName := filepath.Base(pack)
+	index, err := ReadPackIndex(strings.TrimSuffix(pack, ".pack") + ".idx")
+	if err != nil {
+		return append(issues, FsckIssue{Kind: FSCK_CORRUPT, ObjectType: "pack", Sha: packName, Reason: err.Error()}), nil
+	}
+
+	file, err := os.Open(pack)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pack %v, %v", pack, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat pack %v, %v", pack, err)
+	}
+	hasher := sha1.New()
+	_, err = io.Copy(hasher, io.NewSectionReader(file, 0, info.Size()-20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash pack %v, %v", pack, err)
+	}
+	trailer := make([]byte, 20)
+	_, err = file.ReadAt(trailer, info.Size()-20)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pack trailer %v, %v", pack, err)
+	}
+	checksum := hasher.Sum(nil)
+	if !bytes.Equal(checksum, trailer) || hex.EncodeToString(trailer) != index.PackSha {
+		issues = append(issues, FsckIssue{Kind: FSCK_CORRUPT, ObjectType: "pack", Sha: packName, Reason: fmt.Sprintf("checksum mismatch, computed %x", checksum)})
+	}
+
+	objects := &packObjectReader{repo: r, file: file, index: index}
+	for i, sha := range index.Shas {
+		objType, content, err := objects.readAt(index.Offsets[i])
+		if err != nil {
+			issues = append(issues, FsckIssue{Kind: FSCK_CORRUPT, ObjectType: "object", Sha: sha, Reason: err.Error()})
+			continue
+		}
+		computed, err := hashObject(objType, content)
+		if err != nil {
+			return nil, err
+		}
+		if computed != sha {
+			issues = append(issues, FsckIssue{Kind: FSCK_CORRUPT, ObjectType: objType, Sha: sha, Reason: fmt.Sprintf("hash mismatch in %v, content hashes to %v", packName, computed)})
+			continue
+		}
+		check(sha, objType, content)
+	}
+	return issues, nil
+}
+
+// fsckObject validates the syntax of an object and returns the objects it references
+func fsckObject(objType string, content []byte) ([]objectLink, error) {
+	object, err := ParseObject(objType, content)
+	if err != nil {
+		return nil, err
+	}
+	switch object := object.(type) {
+	case *Tree:
+		err = fsckTree(object)
+	case *Commit:
+		err = fsckCommit(object)
+	}
+	return objectLinks(object), err
+}
+
+func fsckTree(tree *Tree) error {
+	err := checkTreeEntryNames(tree)
+	if err != nil {
+		return err
+	}
+	for _, entry := range tree.Entries {
+		if _, err := entry.Type(); err != nil {
+			return fmt.Errorf("%v for %q", err, entry.Name)
+		}
+	}
+	return nil
+}
+
+// checkTreeEntryNames rejects the entry names that can not be written in a working tree, they
+// could escape it or write in .git, and the duplicates, a symlink and a directory with the same
+// name would write through the symlink
+func checkTreeEntryNames(tree *Tree) error {
+	names := map[string]bool{}
+	for _, entry := range tree.Entries {
+		if entry.Name == "" || entry.Name == "." || entry.Name == ".." || strings.EqualFold(entry.Name, ".git") || strings.Contains(entry.Name, "/") {
+			return fmt.Errorf("invalid tree entry name %q", entry.Name)
+		}
+		if names[entry.Name] {
+			return fmt.Errorf("duplicate tree entry %q", entry.Name)
+		}
+		names[entry.Name] = true
+	}
+	return nil
+}
+
+func fsckCommit(commit *Commit) error {
+	if commit.Author == nil {
+		return fmt.Errorf("missing author line")
+	}
+	if commit.Committer == nil {
+		return fmt.Errorf("missing committer line")
+	}
+	return nil
+}
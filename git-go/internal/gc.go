@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type GcResult struct {
+	Packed  int
+	Removed int
+	Pruned  int
+	PackSha string
+}
+
+func (r *LocalRepository) LogsName() string {
+	return r.GitDir() + "/logs"
+}
+
+// reflogShas returns the old and new sha of every entry of every reflog
+func (r *LocalRepository) reflogShas() ([]string, error) {
+	shas := []string{}
+	err := filepath.WalkDir(r.LogsName(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open reflog %v, %v", path, err)
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			// <old sha> <new sha> <identity> <timestamp> <timezone>\t<message>
+			fields := strings.SplitN(scanner.Text(), " ", 3)
+			if len(fields) < 3 {
+				continue
+			}
+			for _, sha := range fields[:2] {
+				if sha != ZERO_SHA && shaRegexp.MatchString(sha) {
+					shas = append(shas, sha)
+				}
+			}
+		}
+		return scanner.Err()
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read reflogs, %v", err)
+	}
+	return shas, nil
+}
+
+// ReachableObjects returns every object reachable from HEAD, the refs, the index and the reflogs, with its path
+func (r *LocalRepository) ReachableObjects() (map[string]string, error) {
+	roots := []string{}
+	refs, err := r.ListRefs()
+	if err != nil {
+		return nil, err
+	}
+	for _, sha := range refs {
+		roots = append(roots, sha)
+	}
+	head, err := r.ResolveRef("HEAD")
+	if err != nil {
+		return nil, err
+	}
+	if head != "" {
+		roots = append(roots, head)
+	}
+	for _, root := range roots {
+		if !r.ObjectExists(root) {
+			return nil, fmt.Errorf("ref points to missing object %v", root)
+		}
+	}
+	// staged blobs are not referenced by any commit yet
+	index, err := r.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range index.Entries {
+		if entry.Mode != MODE_GITLINK && r.ObjectExists(entry.Sha) {
+			roots = append(roots, entry.Sha)
+		}
+	}
+	// reflogs can mention objects already pruned
+	reflogShas, err := r.reflogShas()
+	if err != nil {
+		return nil, err
+	}
+	for _, sha := range reflogShas {
+		if r.ObjectExists(sha) {
+			roots = append(roots, sha)
+		}
+	}
+
+	objects, err := r.WalkObjects(roots, nil)
+	if err != nil {
+		return nil, err
+	}
+	reachable := make(map[string]string, len(objects))
+	for _, object := range objects {
+		reachable[object.Sha] = object.Name
+	}
+	return reachable, nil
+}
+
+// WalkObjects lists the objects reachable from roots that are not excluded, trees
+// and blobs are named after their path from the root tree
+func (r *LocalRepository) WalkObjects(roots []string, excluded map[string]string) ([]PackObject, error) {
+	objects := []PackObject{}
+	seen := map[string]bool{}
+	type walkEntry struct {
+		objectLink
+		name string
+	}
+	queue := []walkEntry{}
+	push := func(link objectLink, name string) {
+		if _, ok := excluded[link.sha]; ok || seen[link.sha] {
+			return
+		}
+		seen[link.sha] = true
+		objects = append(objects, PackObject{Sha: link.sha, Name: name})
+		queue = append(queue, walkEntry{objectLink: link, name: name})
+	}
+	for _, root := range roots {
+		push(objectLink{objType: "object", sha: root}, "")
+	}
+
+	for len(queue) > 0 {
+		entry := queue[0]
+		queue = queue[1:]
+		// blobs do not reference anything, no need to read them
+		if entry.objType == "blob" {
+			if !r.ObjectExists(entry.sha) {
+				return nil, fmt.Errorf("missing blob %v", entry.sha)
+			}
+			continue
+		}
+		object, err := r.ReadTypedObject(entry.sha)
+		if err != nil {
+			return nil, err
+		}
+		tree, isTree := object.(*Tree)
+		if !isTree {
+			for _, link := range objectLinks(object) {
+				push(link, "")
+			}
+			continue
+		}
+		for _, treeEntry := range tree.Entries {
+			objType, err := treeEntry.Type()
+			if err != nil {
+				return nil, fmt.Errorf("invalid tree %v, %v", entry.sha, err)
+			}
+			// submodule commits live in another repository
+			if objType == "commit" {
+				continue
+			}
+			push(objectLink{objType: objType, sha: treeEntry.Sha}, path.Join(entry.name, treeEntry.Name))
+		}
+	}
+	return objects, nil
+}
+
+// Gc moves the reachable loose objects to a new pack, removes the loose copies of packed
+// objects and prunes the unreachable loose objects older than pruneExpire
+func (r *LocalRepository) Gc(pruneExpire time.Duration) (*GcResult, error) {
+	result := &GcResult{}
+	reachable, err := r.ReachableObjects()
+	if err != nil {
+		return nil, err
+	}
+	looseShas, err := r.LooseObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	toPack := []PackObject{}
+	for _, sha := range looseShas {
+		if name, ok := reachable[sha]; ok && !r.packedObjectExists(sha) {
+			toPack = append(toPack, PackObject{Sha: sha, Name: name})
+		}
+	}
+	if len(toPack) > 0 {
+		index, err := r.WritePackObjects(toPack, DefaultPackObjectsOptions)
+		if err != nil {
+			return nil, err
+		}
+		result.Packed = len(toPack)
+		result.PackSha = index.PackSha
+	}
+
+	expire := time.Now().Add(-pruneExpire)
+	for _, sha := range looseShas {
+		filename := filepath.Join(r.ObjectsName(), sha[:2], sha[2:])
+		if r.packedObjectExists(sha) {
+			err = os.Remove(filename)
+			if err != nil {
+				return nil, fmt.Errorf("failed to remove %v, %v", filename, err)
+			}
+			result.Removed++
+			continue
+		}
+		if _, ok := reachable[sha]; ok {
+			continue
+		}
+		info, err := os.Stat(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %v, %v", filename, err)
+		}
+		if info.ModTime().After(expire) {
+			continue
+		}
+		err = os.Remove(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to remove %v, %v", filename, err)
+		}
+		result.Pruned++
+	}
+
+	// fan-out directories left empty
+	for _, sha := range looseShas {
+		os.Remove(filepath.Join(r.ObjectsName(), sha[:2]))
+	}
+	return result, nil
+}
@@ -0,0 +1,455 @@
+package internal
+
+import (
+	"slices"
+	"strings"
+)
+
+type graphState int
+
+const (
+	graphPadding graphState = iota
+	graphSkip
+	graphPreCommit
+	graphCommit
+	graphPostMerge
+	graphCollapsing
+)
+
+// the edges of a merge to its parents, from the leftmost possible one
+var graphMergeChars = []byte{'/', '|', '\\'}
+
+// Graph draws the history on the left of git log --graph, one line at a time, it is a port of
+// git's graph.c without colors
+// https://github.com/git/git/blob/master/graph.c
+type Graph struct {
+	commit  string
+	parents []string
+	// the width of the lines of the current commit, shorter lines are padded to it
+	width int
+	// the row of the expansion before an octopus merge
+	expansionRow    int
+	state           graphState
+	prevState       graphState
+	commitIndex     int
+	prevCommitIndex int
+	// 0 when the first parent of a merge is on the left of the commit, 1 otherwise
+	mergeLayout    int
+	edgesAdded     int
+	prevEdgesAdded int
+	// the commits expected on the current and the next line, one per column
+	columns    []string
+	newColumns []string
+	// the column of new columns each screen position of the line goes to, -1 for none
+	mapping     []int
+	oldMapping  []int
+	mappingSize int
+}
+
+func NewGraph() *Graph {
+	return &Graph{state: graphPadding, prevState: graphPadding}
+}
+
+// Update moves the graph to the next commit, parents are the ones shown in the log
+func (g *Graph) Update(commit string, parents []string) {
+	g.commit = commit
+	g.parents = parents
+	g.prevCommitIndex = g.commitIndex
+	g.updateColumns()
+	g.expansionRow = 0
+
+	// the previous commit did not output all its lines when the state is not padding
+	switch {
+	case g.state != graphPadding:
+		g.state = graphSkip
+	case g.needsPreCommitLine():
+		g.state = graphPreCommit
+	default:
+		g.state = graphCommit
+	}
+}
+
+// IsCommitFinished tells whether all the lines of the current commit were output
+func (g *Graph) IsCommitFinished() bool {
+	return g.state == graphPadding
+}
+
+// NextLine returns the next line of the graph and whether it holds the current commit
+func (g *Graph) NextLine() (string, bool) {
+	line := &strings.Builder{}
+	isCommitLine := false
+	switch g.state {
+	case graphPadding:
+		g.outputPaddingLine(line)
+	case graphSkip:
+		g.outputSkipLine(line)
+	case graphPreCommit:
+		g.outputPreCommitLine(line)
+	case graphCommit:
+		g.outputCommitLine(line)
+		isCommitLine = true
+	case graphPostMerge:
+		g.outputPostMergeLine(line)
+	case graphCollapsing:
+		g.outputCollapsingLine(line)
+	}
+	return g.padHorizontally(line), isCommitLine
+}
+
+// PaddingLine returns a line leaving all the branch lines unchanged, before the commit line
+// it continues the columns of the current commit
+func (g *Graph) PaddingLine() string {
+	if g.state != graphCommit {
+		line, _ := g.NextLine()
+		return line
+	}
+	line := &strings.Builder{}
+	for _, column := range g.columns {
+		line.WriteByte('|')
+		if column == g.commit && len(g.parents) > 2 {
+			line.WriteString(strings.Repeat(" ", (len(g.parents)-2)*2))
+		} else {
+			line.WriteByte(' ')
+		}
+	}
+	g.prevState = graphPadding
+	return g.padHorizontally(line)
+}
+
+func (g *Graph) padHorizontally(line *strings.Builder) string {
+	if line.Len() < g.width {
+		line.WriteString(strings.Repeat(" ", g.width-line.Len()))
+	}
+	return line.String()
+}
+
+func (g *Graph) updateState(state graphState) {
+	g.prevState = g.state
+	g.state = state
+}
+
+func (g *Graph) numDashedParents() int {
+	return len(g.parents) + g.mergeLayout - 3
+}
+
+// an octopus merge needs 2 rows to make room for each parent after the second
+func (g *Graph) needsPreCommitLine() bool {
+	return len(g.parents) >= 3 && g.commitIndex < len(g.columns)-1 && g.expansionRow < g.numDashedParents()*2
+}
+
+func (g *Graph) updateColumns() {
+	g.columns, g.newColumns = g.newColumns, g.columns[:0]
+
+	maxNewColumns := len(g.columns) + len(g.parents)
+	// the old mapping is kept for the next commit line
+	for len(g.mapping) < 2*maxNewColumns {
+		g.mapping = append(g.mapping, -1)
+		g.oldMapping = append(g.oldMapping, -1)
+	}
+	g.mappingSize = 2 * maxNewColumns
+	for i := 0; i < g.mappingSize; i++ {
+		g.mapping[i] = -1
+	}
+	g.width = 0
+	g.prevEdgesAdded = g.edgesAdded
+	g.edgesAdded = 0
+
+	// the commit gets its own column when none of its children was shown
+	seenThis := false
+	for i := 0; i <= len(g.columns); i++ {
+		columnCommit := g.commit
+		if i < len(g.columns) {
+			columnCommit = g.columns[i]
+		} else if seenThis {
+			break
+		}
+		if columnCommit != g.commit {
+			g.insertIntoNewColumns(columnCommit, -1)
+			continue
+		}
+		seenThis = true
+		g.commitIndex = i
+		g.mergeLayout = -1
+		for _, parent := range g.parents {
+			g.insertIntoNewColumns(parent, i)
+		}
+		// the commit always takes at least 2 characters
+		if len(g.parents) == 0 {
+			g.width += 2
+		}
+	}
+
+	for g.mappingSize > 1 && g.mapping[g.mappingSize-1] < 0 {
+		g.mappingSize--
+	}
+}
+
+func (g *Graph) insertIntoNewColumns(commit string, commitIndex int) {
+	i := slices.Index(g.newColumns, commit)
+	if i < 0 {
+		i = len(g.newColumns)
+		g.newColumns = append(g.newColumns, commit)
+	}
+
+	mappingIndex := g.width
+	switch {
+	case len(g.parents) > 1 && commitIndex > -1 && g.mergeLayout == -1:
+		// the layout of the merge depends on whether its first parent is on its left
+		dist := commitIndex - i
+		shift := 1
+		if dist > 1 {
+			shift = 2*dist - 3
+		}
+		g.mergeLayout = 1
+		if dist > 0 {
+			g.mergeLayout = 0
+		}
+		g.edgesAdded = len(g.parents) + g.mergeLayout - 2
+		mappingIndex = g.width + (g.mergeLayout-1)*shift
+		g.width += 2 * g.mergeLayout
+	case g.edgesAdded > 0 && g.width >= 2 && i == g.mapping[g.width-2]:
+		// the edge joins the last existing column immediately
+		mappingIndex = g.width - 2
+		g.edgesAdded = -1
+	default:
+		g.width += 2
+	}
+	g.mapping[mappingIndex] = i
+}
+
+// the mapping is correct when each branch line is at its column, or one character right of it
+// as a / already leads it there
+func (g *Graph) isMappingCorrect() bool {
+	for i := 0; i < g.mappingSize; i++ {
+		target := g.mapping[i]
+		if target >= 0 && target != i/2 {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *Graph) outputPaddingLine(line *strings.Builder) {
+	for range g.newColumns {
+		line.WriteString("| ")
+	}
+}
+
+func (g *Graph) outputSkipLine(line *strings.Builder) {
+	line.WriteString("...")
+	if g.needsPreCommitLine() {
+		g.updateState(graphPreCommit)
+	} else {
+		g.updateState(graphCommit)
+	}
+}
+
+func (g *Graph) outputPreCommitLine(line *strings.Builder) {
+	seenThis := false
+	for i, column := range g.columns {
+		switch {
+		case column == g.commit:
+			seenThis = true
+			line.WriteByte('|')
+			line.WriteString(strings.Repeat(" ", g.expansionRow))
+		case seenThis && g.expansionRow == 0:
+			// the lines after a merge keep their \ on the first row
+			if g.prevState == graphPostMerge && g.prevCommitIndex < i {
+				line.WriteByte('\\')
+			} else {
+				line.WriteByte('|')
+			}
+		case seenThis:
+			line.WriteByte('\\')
+		default:
+			line.WriteByte('|')
+		}
+		line.WriteByte(' ')
+	}
+
+	g.expansionRow++
+	if !g.needsPreCommitLine() {
+		g.updateState(graphCommit)
+	}
+}
+
+func (g *Graph) outputCommitLine(line *strings.Builder) {
+	seenThis := false
+	for i := 0; i <= len(g.columns); i++ {
+		columnCommit := g.commit
+		if i < len(g.columns) {
+			columnCommit = g.columns[i]
+		} else if seenThis {
+			break
+		}
+
+		switch {
+		case columnCommit == g.commit:
+			seenThis = true
+			line.WriteByte('*')
+			if len(g.parents) > 2 {
+				dashed := g.numDashedParents()
+				line.WriteString(strings.Repeat("-", 2*dashed-1) + ".")
+			}
+		case seenThis && g.edgesAdded > 1:
+			line.WriteByte('\\')
+		case seenThis && g.edgesAdded == 1:
+			// the line coming from a previous merge may still be a \
+			if g.prevState == graphPostMerge && g.prevEdgesAdded > 0 && g.prevCommitIndex < i {
+				line.WriteByte('\\')
+			} else {
+				line.WriteByte('|')
+			}
+		case g.prevState == graphCollapsing && g.oldMapping[2*i+1] == i && g.mapping[2*i] < i:
+			// a line collapsing on the previous row keeps going left
+			line.WriteByte('/')
+		default:
+			line.WriteByte('|')
+		}
+		line.WriteByte(' ')
+	}
+
+	switch {
+	case len(g.parents) > 1:
+		g.updateState(graphPostMerge)
+	case g.isMappingCorrect():
+		g.updateState(graphPadding)
+	default:
+		g.updateState(graphCollapsing)
+	}
+}
+
+func (g *Graph) outputPostMergeLine(line *strings.Builder) {
+	seenThis := false
+	// on the left of the commit, the columns after the first parent are joined with _
+	seenFirstParent := false
+	for i := 0; i <= len(g.columns); i++ {
+		columnCommit := g.commit
+		if i < len(g.columns) {
+			columnCommit = g.columns[i]
+		} else if seenThis {
+			break
+		}
+
+		switch {
+		case columnCommit == g.commit:
+			seenThis = true
+			charIndex := g.mergeLayout
+			for j := range g.parents {
+				line.WriteByte(graphMergeChars[charIndex])
+				if charIndex < 2 {
+					charIndex++
+				} else if g.edgesAdded > 0 || j < len(g.parents)-1 {
+					line.WriteByte(' ')
+				}
+			}
+			if g.edgesAdded == 0 {
+				line.WriteByte(' ')
+			}
+		case seenThis:
+			if g.edgesAdded > 0 {
+				line.WriteByte('\\')
+			} else {
+				line.WriteByte('|')
+			}
+			line.WriteByte(' ')
+		default:
+			line.WriteByte('|')
+			if g.mergeLayout != 0 || i != g.commitIndex-1 {
+				if seenFirstParent {
+					line.WriteByte('_')
+				} else {
+					line.WriteByte(' ')
+				}
+			}
+		}
+		if columnCommit == g.parents[0] {
+			seenFirstParent = true
+		}
+	}
+
+	if g.isMappingCorrect() {
+		g.updateState(graphPadding)
+	} else {
+		g.updateState(graphCollapsing)
+	}
+}
+
+// outputCollapsingLine moves each branch line one character left towards its column, a single
+// line can cross others with a horizontal edge of _
+func (g *Graph) outputCollapsingLine(line *strings.Builder) {
+	horizontalEdge := -1
+	horizontalEdgeTarget := -1
+	usedHorizontal := false
+
+	g.mapping, g.oldMapping = g.oldMapping, g.mapping
+	for i := 0; i < g.mappingSize; i++ {
+		g.mapping[i] = -1
+	}
+
+	for i := 0; i < g.mappingSize; i++ {
+		target := g.oldMapping[i]
+		if target < 0 {
+			continue
+		}
+		// branch lines never move right
+		switch {
+		case target*2 == i:
+			g.mapping[i] = target
+		case g.mapping[i-1] < 0:
+			// nothing on the left, move one character left
+			g.mapping[i-1] = target
+			if horizontalEdge == -1 {
+				horizontalEdge = i
+				horizontalEdgeTarget = target
+				for j := target*2 + 3; j < i-2; j += 2 {
+					g.mapping[j] = target
+				}
+			}
+		case g.mapping[i-1] == target:
+			// the line on the left goes to the same column, they merge
+		default:
+			// cross the line on the left
+			g.mapping[i-2] = target
+			if horizontalEdge == -1 {
+				horizontalEdgeTarget = target
+				horizontalEdge = i - 1
+				for j := target*2 + 3; j < i-2; j += 2 {
+					g.mapping[j] = target
+				}
+			}
+		}
+	}
+
+	// the next commit line looks at this line
+	copy(g.oldMapping, g.mapping[:g.mappingSize])
+	if g.mapping[g.mappingSize-1] < 0 {
+		g.mappingSize--
+	}
+
+	for i := 0; i < g.mappingSize; i++ {
+		target := g.mapping[i]
+		switch {
+		case target < 0:
+			line.WriteByte(' ')
+		case target*2 == i:
+			line.WriteByte('|')
+		case target == horizontalEdgeTarget && i != horizontalEdge-1:
+			// only the first segment of the horizontal edge goes on to the next line
+			if i != target*2+3 {
+				g.mapping[i] = -1
+			}
+			usedHorizontal = true
+			line.WriteByte('_')
+		default:
+			if usedHorizontal && i < horizontalEdge {
+				g.mapping[i] = -1
+			}
+			line.WriteByte('/')
+		}
+	}
+
+	if g.isMappingCorrect() {
+		g.updateState(graphPadding)
+	}
+}
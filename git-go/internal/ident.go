@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	IDENT_AUTHOR    = "author"
+	IDENT_COMMITTER = "committer"
+)
+
+// date formats accepted in GIT_AUTHOR_DATE and GIT_COMMITTER_DATE besides git's internal format
+// https://git-scm.com/docs/git-commit#_date_formats
+var identDateLayouts = []string{
+	time.RFC1123Z,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 -0700",
+	time.RFC3339,
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+}
+
+var internalDateRegexp = regexp.MustCompile(`^@?(\d+) ([+-]\d{4})$`)
+
+// Ident returns the signature of the author or the committer, from the GIT_AUTHOR_* or
+// GIT_COMMITTER_* environment variables, then the config, then the system user
+// https://git-scm.com/book/en/v2/Git-Internals-Environment-Variables#_committing
+func (r *LocalRepository) Ident(role string) (*Signature, error) {
+	prefix := "GIT_" + strings.ToUpper(role) + "_"
+	name, err := r.identValue(os.Getenv(prefix+"NAME"), role+".name", "user.name")
+	if err != nil {
+		return nil, err
+	}
+	email, err := r.identValue(os.Getenv(prefix+"EMAIL"), role+".email", "user.email")
+	if err != nil {
+		return nil, err
+	}
+	if email == "" {
+		email = os.Getenv("EMAIL")
+	}
+
+	if name == "" || email == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("%v identity unknown, please set user.name and user.email, %v", role, err)
+		}
+		if name == "" {
+			name = strings.SplitN(current.Name, ",", 2)[0]
+		}
+		if name == "" {
+			name = current.Username
+		}
+		if email == "" {
+			// like git, a host name without a domain gives no usable email address
+			hostname, err := os.Hostname()
+			if err != nil || !strings.Contains(hostname, ".") {
+				return nil, fmt.Errorf("%v identity unknown, please set user.name and user.email, unable to auto-detect email address", role)
+			}
+			email = current.Username + "@" + hostname
+		}
+	}
+	name = withoutCrud(name)
+	email = withoutCrud(email)
+	if name == "" {
+		return nil, fmt.Errorf("empty %v name not allowed", role)
+	}
+
+	signature := &Signature{Name: name, Email: email}
+	date := os.Getenv(prefix + "DATE")
+	if date == "" {
+		now := time.Now()
+		signature.Timestamp = now.Unix()
+		signature.Timezone = now.Format("-0700")
+		return signature, nil
+	}
+	signature.Timestamp, signature.Timezone, err = parseIdentDate(date)
+	if err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
+
+// withoutCrud trims the spaces and punctuation around a name or an email, then removes the
+// characters that would break the signature line, like strbuf_addstr_without_crud in git's ident.c
+func withoutCrud(value string) string {
+	value = strings.TrimFunc(value, func(c rune) bool {
+		return c <= ' ' || strings.ContainsRune(".,:;<>\"\\'", c)
+	})
+	return strings.Map(func(c rune) rune {
+		if c == '\n' || c == '<' || c == '>' {
+			return -1
+		}
+		return c
+	}, value)
+}
+
+// identValue returns the environment value if set, else the first set config variable
+func (r *LocalRepository) identValue(env string, names ...string) (string, error) {
+	if env != "" {
+		return env, nil
+	}
+	for _, name := range names {
+		value, err := r.ConfigValue(name)
+		if err != nil || value != "" {
+			return value, err
+		}
+	}
+	return "", nil
+}
+
+// parseIdentDate reads git's internal "<unix timestamp> <+hhmm>" format, RFC 2822 and ISO 8601 dates
+func parseIdentDate(date string) (int64, string, error) {
+	date = strings.TrimSpace(date)
+	if match := internalDateRegexp.FindStringSubmatch(date); match != nil {
+		timestamp, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return 0, "", fmt.Errorf("invalid date %v, %v", date, err)
+		}
+		return timestamp, match[2], nil
+	}
+	for _, layout := range identDateLayouts {
+		parsed, err := time.ParseInLocation(layout, date, time.Local)
+		if err == nil {
+			return parsed.Unix(), parsed.Format("-0700"), nil
+		}
+	}
+	return 0, "", fmt.Errorf("invalid date format: %v", date)
+}
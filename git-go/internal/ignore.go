@@ -0,0 +1,311 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// IgnorePattern is a line of an ignore file
+// https://git-scm.com/docs/gitignore#_pattern_format
+type IgnorePattern struct {
+	// file the pattern comes from, as shown by check-ignore
+	Source string
+	Line   int
+	// the pattern as written, without trailing spaces
+	Pattern string
+	// directory of the .gitignore file relative to the root, empty for the other sources
+	base     string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+	regexp   *regexp.Regexp
+}
+
+// IgnoreMatcher tells which paths are ignored, .gitignore files are read the first time their
+// directory is matched against
+type IgnoreMatcher struct {
+	repo *LocalRepository
+	// core.excludesFile then info/exclude
+	global []IgnorePattern
+	dirs   map[string][]IgnorePattern
+}
+
+func (r *LocalRepository) InfoExcludeName() string {
+	return r.GitDir() + "/info/exclude"
+}
+
+func (r *LocalRepository) NewIgnoreMatcher() (*IgnoreMatcher, error) {
+	matcher := &IgnoreMatcher{repo: r, dirs: map[string][]IgnorePattern{}}
+	excludesFile, err := r.coreExcludesFile()
+	if err != nil {
+		return nil, err
+	}
+	for _, source := range []struct{ filename, name string }{
+		{excludesFile, excludesFile},
+		{r.InfoExcludeName(), ".git/info/exclude"},
+	} {
+		patterns, err := readIgnoreFile(source.filename, source.name, "")
+		if err != nil {
+			return nil, err
+		}
+		matcher.global = append(matcher.global, patterns...)
+	}
+	return matcher, nil
+}
+
+// coreExcludesFile returns core.excludesFile, or git's default $XDG_CONFIG_HOME/git/ignore
+func (r *LocalRepository) coreExcludesFile() (string, error) {
+	value, err := r.ConfigValue("core.excludesfile")
+	if err != nil || value != "" {
+		return expandHome(value), err
+	}
+	return filepath.Join(xdgConfigHome(), "git", "ignore"), nil
+}
+
+// readIgnoreFile parses the patterns of an ignore file, a missing file has no pattern
+func readIgnoreFile(filename string, source string, base string) ([]IgnorePattern, error) {
+	content, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v, %v", filename, err)
+	}
+	patterns := []IgnorePattern{}
+	for i, line := range strings.Split(string(content), "\n") {
+		pattern, ok := ParseIgnorePattern(strings.TrimSuffix(line, "\r"))
+		if !ok {
+			continue
+		}
+		pattern.Source = source
+		pattern.Line = i + 1
+		pattern.base = base
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// ParseIgnorePattern compiles a pattern, it returns false for blank lines, comments and invalid patterns
+func ParseIgnorePattern(line string) (IgnorePattern, bool) {
+	// trailing spaces are ignored unless escaped with a backslash
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return IgnorePattern{}, false
+	}
+	pattern := IgnorePattern{Pattern: line}
+	if rest, found := strings.CutPrefix(line, "!"); found {
+		pattern.negate = true
+		line = rest
+	}
+	if rest, found := strings.CutSuffix(line, "/"); found {
+		pattern.dirOnly = true
+		line = rest
+	}
+	// a slash at the beginning or in the middle anchors the pattern to the directory of its file
+	pattern.anchored = strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return IgnorePattern{}, false
+	}
+	// like git, a pattern that cannot be matched such as an invalid range is skipped
+	compiled, err := regexp.Compile("^" + globToRegexp(line) + "$")
+	if err != nil {
+		return IgnorePattern{}, false
+	}
+	pattern.regexp = compiled
+	return pattern, true
+}
+
+// globToRegexp converts wildcards that do not match slashes and the ** forms of gitignore
+func globToRegexp(glob string) string {
+	result := strings.Builder{}
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/") && (i == 0 || glob[i-1] == '/'):
+			// leading **/ or /**/ matches zero or more directories
+			result.WriteString("(?:.*/)?")
+			i += 2
+		case glob[i:] == "**" && i > 0 && glob[i-1] == '/':
+			// trailing /** matches everything inside
+			result.WriteString(".*")
+			i++
+		case c == '*':
+			result.WriteString("[^/]*")
+		case c == '?':
+			result.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == -1 {
+				result.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			result.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			result.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			result.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return result.String()
+}
+
+// matches tells whether a path relative to the root matches the pattern, ignoring negation
+func (p *IgnorePattern) matches(name string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	relative := name
+	if p.base != "" {
+		var found bool
+		relative, found = strings.CutPrefix(name, p.base+"/")
+		if !found {
+			return false
+		}
+	}
+	if !p.anchored {
+		relative = path.Base(relative)
+	}
+	return p.regexp.MatchString(relative)
+}
+
+// dirPatterns returns the patterns of the .gitignore of a directory relative to the root
+func (m *IgnoreMatcher) dirPatterns(dir string) ([]IgnorePattern, error) {
+	if patterns, ok := m.dirs[dir]; ok {
+		return patterns, nil
+	}
+	source := ".gitignore"
+	base := ""
+	if dir != "." {
+		source = dir + "/.gitignore"
+		base = dir
+	}
+	patterns, err := readIgnoreFile(filepath.Join(m.repo.RootName, source), source, base)
+	if err != nil {
+		return nil, err
+	}
+	m.dirs[dir] = patterns
+	return patterns, nil
+}
+
+// Match returns the last pattern matching a path itself, patterns of deeper .gitignore files win
+// over the ones of their parents, which win over info/exclude and core.excludesFile
+func (m *IgnoreMatcher) Match(name string, isDir bool) (*IgnorePattern, error) {
+	dirs := []string{}
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+		if dir == "." {
+			break
+		}
+	}
+	var match *IgnorePattern
+	for i := range m.global {
+		if m.global[i].matches(name, isDir) {
+			match = &m.global[i]
+		}
+	}
+	for _, dir := range dirs {
+		patterns, err := m.dirPatterns(dir)
+		if err != nil {
+			return nil, err
+		}
+		for i := range patterns {
+			if patterns[i].matches(name, isDir) {
+				match = &patterns[i]
+			}
+		}
+	}
+	return match, nil
+}
+
+// IsIgnored tells whether a path is ignored, a path inside an ignored directory is ignored
+// whatever its own patterns say, it returns the deciding pattern if any
+func (m *IgnoreMatcher) IsIgnored(name string, isDir bool) (bool, *IgnorePattern, error) {
+	parts := strings.Split(name, "/")
+	for i := 1; i <= len(parts); i++ {
+		current := strings.Join(parts[:i], "/")
+		match, err := m.Match(current, isDir || i < len(parts))
+		if err != nil {
+			return false, nil, err
+		}
+		if match != nil && (!match.negate || i == len(parts)) {
+			return !match.negate, match, nil
+		}
+	}
+	return false, nil, nil
+}
+
+// Negated tells whether a matching path is re-included by the pattern
+func (p *IgnorePattern) Negated() bool {
+	return p.negate
+}
+
+// ExcludeFunc tells whether a working tree path, relative to the root, is left out
+type ExcludeFunc func(name string, isDir bool) (bool, error)
+
+// ExcludeIgnored excludes the ignored paths, tracked files and directories holding tracked files
+// are never excluded
+func (r *LocalRepository) ExcludeIgnored(index *Index) (ExcludeFunc, error) {
+	matcher, err := r.NewIgnoreMatcher()
+	if err != nil {
+		return nil, err
+	}
+	tracked := map[string]bool{}
+	for _, entry := range index.Entries {
+		for name := entry.Name; name != "."; name = path.Dir(name) {
+			tracked[name] = true
+		}
+	}
+	return func(name string, isDir bool) (bool, error) {
+		if tracked[name] {
+			return false, nil
+		}
+		ignored, _, err := matcher.IsIgnored(name, isDir)
+		return ignored, err
+	}, nil
+}
+
+// CheckIgnore returns the pattern deciding whether each path is ignored, nil when none matches
+// or when the path is tracked
+// https://git-scm.com/docs/git-check-ignore
+func (r *LocalRepository) CheckIgnore(pathnames []string) ([]*IgnorePattern, error) {
+	matcher, err := r.NewIgnoreMatcher()
+	if err != nil {
+		return nil, err
+	}
+	index, err := r.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]*IgnorePattern, len(pathnames))
+	for i, pathname := range pathnames {
+		name, err := r.normalizePathspec(pathname)
+		if err != nil {
+			return nil, err
+		}
+		if _, tracked := index.Find(name); tracked || name == "." {
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(r.RootName, name))
+		isDir := strings.HasSuffix(pathname, "/") || (err == nil && info.IsDir())
+		_, matches[i], err = matcher.IsIgnored(name, isDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}
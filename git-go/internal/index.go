@@ -0,0 +1,517 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// https://git-scm.com/docs/index-format
+const (
+	indexSignature    = "DIRC"
+	indexVersion      = 2
+	indexEntryHeader  = 62
+	indexNameMask     = 0x0fff
+	indexStageMask    = 0x3000
+	indexStageShift   = 12
+	indexExtendedFlag = 0x4000
+
+	MODE_FILE       = 0o100644
+	MODE_EXECUTABLE = 0o100755
+	MODE_SYMLINK    = 0o120000
+	MODE_GITLINK    = 0o160000
+	MODE_TREE       = 0o040000
+)
+
+type IndexEntry struct {
+	CTimeSeconds     uint32
+	CTimeNanoseconds uint32
+	MTimeSeconds     uint32
+	MTimeNanoseconds uint32
+	Dev              uint32
+	Ino              uint32
+	Mode             uint32
+	Uid              uint32
+	Gid              uint32
+	Size             uint32
+	Sha              string
+	Flags            uint16
+	Name             string
+}
+
+type Index struct {
+	Entries []IndexEntry
+}
+
+func (e *IndexEntry) Stage() int {
+	return int(e.Flags&indexStageMask) >> indexStageShift
+}
+
+func (r *LocalRepository) IndexName() string {
+	return r.GitDir() + "/index"
+}
+
+// ReadIndex parses .git/index, a missing index is an empty one
+func (r *LocalRepository) ReadIndex() (*Index, error) {
+	content, err := os.ReadFile(r.IndexName())
+	if errors.Is(err, fs.ErrNotExist) {
+		return &Index{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index, %v", err)
+	}
+	return parseIndex(content)
+}
+
+func parseIndex(content []byte) (*Index, error) {
+	if len(content) < 12+sha1.Size {
+		return nil, errors.New("index file is too short")
+	}
+	checksum := sha1.Sum(content[:len(content)-sha1.Size])
+	if !bytes.Equal(checksum[:], content[len(content)-sha1.Size:]) {
+		return nil, errors.New("index file checksum mismatch")
+	}
+	content = content[:len(content)-sha1.Size]
+	if string(content[:4]) != indexSignature {
+		return nil, fmt.Errorf("invalid index signature %q", content[:4])
+	}
+	version := binary.BigEndian.Uint32(content[4:8])
+	if version != indexVersion {
+		return nil, fmt.Errorf("unsupported index version %v", version)
+	}
+	count := binary.BigEndian.Uint32(content[8:12])
+
+	index := &Index{Entries: make([]IndexEntry, 0, count)}
+	position := 12
+	for i := uint32(0); i < count; i++ {
+		if position+indexEntryHeader > len(content) {
+			return nil, fmt.Errorf("index entry %v is truncated", i)
+		}
+		header := content[position : position+indexEntryHeader]
+		fields := make([]uint32, 10)
+		for j := range fields {
+			fields[j] = binary.BigEndian.Uint32(header[j*4:])
+		}
+		entry := IndexEntry{
+			CTimeSeconds: fields[0], CTimeNanoseconds: fields[1],
+			MTimeSeconds: fields[2], MTimeNanoseconds: fields[3],
+			Dev: fields[4], Ino: fields[5], Mode: fields[6],
+			Uid: fields[7], Gid: fields[8], Size: fields[9],
+			Sha:   hex.EncodeToString(header[40:60]),
+			Flags: binary.BigEndian.Uint16(header[60:62]),
+		}
+		if entry.Flags&indexExtendedFlag != 0 {
+			return nil, fmt.Errorf("extended flags of index entry %v need index version 3", i)
+		}
+		// the name is NUL terminated, then padded so that the entry length is a multiple of 8
+		nameEnd := bytes.IndexByte(content[position+indexEntryHeader:], 0)
+		if nameEnd == -1 {
+			return nil, fmt.Errorf("index entry %v name is not terminated", i)
+		}
+		entry.Name = string(content[position+indexEntryHeader : position+indexEntryHeader+nameEnd])
+		position += indexEntryLength(len(entry.Name))
+		index.Entries = append(index.Entries, entry)
+	}
+
+	// extensions starting with an uppercase letter are optional caches, dropped when the index is rewritten
+	for position < len(content) {
+		if position+8 > len(content) {
+			return nil, errors.New("index extension header is truncated")
+		}
+		signature := content[position : position+4]
+		size := int(binary.BigEndian.Uint32(content[position+4 : position+8]))
+		if signature[0] < 'A' || signature[0] > 'Z' {
+			return nil, fmt.Errorf("unsupported index extension %q", signature)
+		}
+		position += 8 + size
+	}
+	if position != len(content) {
+		return nil, errors.New("index extension is truncated")
+	}
+	index.sort()
+	return index, nil
+}
+
+func indexEntryLength(nameLength int) int {
+	return (indexEntryHeader + nameLength + 8) / 8 * 8
+}
+
+// WriteIndex writes the entries sorted by name and stage through index.lock, like git
+func (r *LocalRepository) WriteIndex(index *Index) error {
+	index.sort()
+	content := bytes.Buffer{}
+	content.WriteString(indexSignature)
+	binary.Write(&content, binary.BigEndian, uint32(indexVersion))
+	binary.Write(&content, binary.BigEndian, uint32(len(index.Entries)))
+	for _, entry := range index.Entries {
+		sha, err := hex.DecodeString(entry.Sha)
+		if err != nil || len(sha) != sha1.Size {
+			return fmt.Errorf("invalid sha %v for index entry %v", entry.Sha, entry.Name)
+		}
+		fields := []uint32{
+			entry.CTimeSeconds, entry.CTimeNanoseconds,
+			entry.MTimeSeconds, entry.MTimeNanoseconds,
+			entry.Dev, entry.Ino, entry.Mode,
+			entry.Uid, entry.Gid, entry.Size,
+		}
+		binary.Write(&content, binary.BigEndian, fields)
+		content.Write(sha)
+		flags := entry.Flags &^ indexNameMask
+		flags |= uint16(min(len(entry.Name), indexNameMask))
+		binary.Write(&content, binary.BigEndian, flags)
+		content.WriteString(entry.Name)
+		content.Write(make([]byte, indexEntryLength(len(entry.Name))-indexEntryHeader-len(entry.Name)))
+	}
+	checksum := sha1.Sum(content.Bytes())
+	content.Write(checksum[:])
+
+	err := writeLockedFile(r.IndexName(), content.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to write index, %v", err)
+	}
+	return nil
+}
+
+func (index *Index) sort() {
+	sort.SliceStable(index.Entries, func(i, j int) bool {
+		if index.Entries[i].Name != index.Entries[j].Name {
+			return index.Entries[i].Name < index.Entries[j].Name
+		}
+		return index.Entries[i].Stage() < index.Entries[j].Stage()
+	})
+}
+
+// search returns the position of the first entry not sorted before name and stage
+func (index *Index) search(name string, stage int) int {
+	return sort.Search(len(index.Entries), func(i int) bool {
+		entry := &index.Entries[i]
+		return entry.Name > name || (entry.Name == name && entry.Stage() >= stage)
+	})
+}
+
+// Find returns the stage 0 entry of a path
+func (index *Index) Find(name string) (*IndexEntry, bool) {
+	i := index.search(name, 0)
+	if i < len(index.Entries) && index.Entries[i].Name == name && index.Entries[i].Stage() == 0 {
+		return &index.Entries[i], true
+	}
+	return nil, false
+}
+
+// Add replaces every entry of the path, and the entries of its parent directories or children
+// since a path cannot be both a file and a directory
+func (index *Index) Add(entry IndexEntry) {
+	index.Remove(entry.Name)
+	// children are sorted right after name + "/"
+	start := index.search(entry.Name+"/", 0)
+	end := start
+	for end < len(index.Entries) && strings.HasPrefix(index.Entries[end].Name, entry.Name+"/") {
+		end++
+	}
+	index.Entries = append(index.Entries[:start], index.Entries[end:]...)
+	for parent := path.Dir(entry.Name); parent != "."; parent = path.Dir(parent) {
+		index.Remove(parent)
+	}
+
+	i := index.search(entry.Name, entry.Stage())
+	index.Entries = append(index.Entries, IndexEntry{})
+	copy(index.Entries[i+1:], index.Entries[i:])
+	index.Entries[i] = entry
+}
+
+// Remove drops every entry of the path, it reports whether there was one
+func (index *Index) Remove(name string) bool {
+	start := index.search(name, 0)
+	end := start
+	for end < len(index.Entries) && index.Entries[end].Name == name {
+		end++
+	}
+	index.Entries = append(index.Entries[:start], index.Entries[end:]...)
+	return end > start
+}
+
+// Matches returns the names of the entries inside a pathspec, a path or a directory, "." is everything
+func (index *Index) Matches(pathspec string) []string {
+	names := []string{}
+	for _, entry := range index.Entries {
+		if pathspecMatches(pathspec, entry.Name) && (len(names) == 0 || names[len(names)-1] != entry.Name) {
+			names = append(names, entry.Name)
+		}
+	}
+	return names
+}
+
+func pathspecMatches(pathspec string, name string) bool {
+	pathspec = strings.TrimSuffix(pathspec, "/")
+	return pathspec == "." || pathspec == "" || name == pathspec || strings.HasPrefix(name, pathspec+"/")
+}
+
+// PathspecsMatch reports whether a path is inside one of the pathspecs, no pathspec matches everything
+func PathspecsMatch(pathspecs []string, name string) bool {
+	for _, pathspec := range pathspecs {
+		if pathspecMatches(pathspec, name) {
+			return true
+		}
+	}
+	return len(pathspecs) == 0
+}
+
+// newIndexEntry fills the stat data of a working tree file, git uses it to detect changes without hashing
+func newIndexEntry(name string, info fs.FileInfo, sha string) IndexEntry {
+	entry := IndexEntry{
+		MTimeSeconds:     uint32(info.ModTime().Unix()),
+		MTimeNanoseconds: uint32(info.ModTime().Nanosecond()),
+		Mode:             fileMode(info),
+		Size:             uint32(info.Size()),
+		Sha:              sha,
+		Name:             name,
+	}
+	fillIndexStat(&entry, info)
+	return entry
+}
+
+// fileMode is the git mode of a working tree file, only the owner executable bit is kept,
+// a directory is a nested repository
+func fileMode(info fs.FileInfo) uint32 {
+	if info.IsDir() {
+		return MODE_GITLINK
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return MODE_SYMLINK
+	}
+	if info.Mode()&0o100 != 0 {
+		return MODE_EXECUTABLE
+	}
+	return MODE_FILE
+}
+
+// isRacy reports whether an entry was written in the same second as the index or later, the file
+// can then change without changing its stat data
+// https://git-scm.com/docs/racy-git
+func (e *IndexEntry) isRacy(indexInfo fs.FileInfo) bool {
+	return indexInfo != nil && int64(e.MTimeSeconds) >= indexInfo.ModTime().Unix()
+}
+
+// StatMatches reports whether a working tree file still has the stat data of its entry
+func (e *IndexEntry) StatMatches(info fs.FileInfo) bool {
+	current := newIndexEntry(e.Name, info, e.Sha)
+	return current.MTimeSeconds == e.MTimeSeconds &&
+		current.MTimeNanoseconds == e.MTimeNanoseconds &&
+		current.CTimeSeconds == e.CTimeSeconds &&
+		current.CTimeNanoseconds == e.CTimeNanoseconds &&
+		current.Ino == e.Ino &&
+		current.Mode == e.Mode &&
+		current.Size == e.Size
+}
+
+// HashWorkingFile returns the blob sha of a working tree file, a symlink is stored as its target
+// and a nested repository as the commit of its HEAD
+func (r *LocalRepository) HashWorkingFile(name string, info fs.FileInfo, write bool) (string, error) {
+	filename := filepath.Join(r.RootName, name)
+	var content []byte
+	var err error
+	if info.IsDir() {
+		nested, err := openNestedRepository(filename)
+		if err != nil {
+			return "", err
+		}
+		head, err := nested.ResolveRef("HEAD")
+		if err != nil {
+			return "", err
+		}
+		if head == "" {
+			return "", fmt.Errorf("'%v' does not have a commit checked out", name)
+		}
+		return head, nil
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		var target string
+		target, err = os.Readlink(filename)
+		content = []byte(target)
+	} else {
+		content, err = os.ReadFile(filename)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read file %v, %v", filename, err)
+	}
+	if !write {
+		return hashObject("blob", content)
+	}
+	return r.WriteBlob(content)
+}
+
+// WriteBlob stores content as a blob object, it returns its sha
+func (r *LocalRepository) WriteBlob(content []byte) (string, error) {
+	return r.WriteTypedObject(&Blob{Content: content})
+}
+
+// WorkingFiles lists the files of the working tree under a pathspec, relative to the root, nested
+// repositories are listed as a whole, paths for which exclude is true are skipped
+func (r *LocalRepository) WorkingFiles(pathspec string, exclude ExcludeFunc) (map[string]fs.FileInfo, error) {
+	files := map[string]fs.FileInfo{}
+	root := filepath.Join(r.RootName, pathspec)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// the .git of a repository is never listed, a directory or a gitdir: file
+		if d.Name() == ".git" && d.IsDir() {
+			return filepath.SkipDir
+		}
+		if d.Name() == ".git" {
+			return nil
+		}
+		name, err := filepath.Rel(r.RootName, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if exclude != nil && name != "." {
+			excluded, err := exclude(filepath.ToSlash(name), d.IsDir())
+			if err != nil {
+				return err
+			}
+			if excluded && d.IsDir() {
+				return filepath.SkipDir
+			}
+			if excluded {
+				return nil
+			}
+		}
+		if d.IsDir() {
+			if _, err := os.Lstat(filepath.Join(path, ".git")); err != nil || name == "." {
+				return nil
+			}
+			files[filepath.ToSlash(name)] = info
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() && info.Mode()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		files[filepath.ToSlash(name)] = info
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to list files of %v, %v", pathspec, err)
+	}
+	return files, nil
+}
+
+// AddToIndex stages the working tree files of the pathspecs, files deleted from the working
+// tree are removed from the index, ignored files are only added with force
+func (r *LocalRepository) AddToIndex(pathspecs []string, force bool) error {
+	index, err := r.ReadIndex()
+	if err != nil {
+		return err
+	}
+	indexInfo, err := os.Stat(r.IndexName())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to stat index, %v", err)
+	}
+	var exclude ExcludeFunc
+	if !force {
+		exclude, err = r.ExcludeIgnored(index)
+		if err != nil {
+			return err
+		}
+	}
+	for _, pathspec := range pathspecs {
+		pathspec, err = r.normalizePathspec(pathspec)
+		if err != nil {
+			return err
+		}
+		if info, err := os.Lstat(filepath.Join(r.RootName, pathspec)); err == nil && exclude != nil && pathspec != "." {
+			ignored, err := exclude(pathspec, info.IsDir())
+			if err != nil {
+				return err
+			}
+			if ignored {
+				return fmt.Errorf("the following path is ignored by one of your .gitignore files: %v, use -f if you really want to add it", pathspec)
+			}
+		}
+		files, err := r.WorkingFiles(pathspec, exclude)
+		if err != nil {
+			return err
+		}
+		tracked := index.Matches(pathspec)
+		if len(files) == 0 && len(tracked) == 0 {
+			return fmt.Errorf("pathspec '%v' did not match any files", pathspec)
+		}
+		for _, name := range tracked {
+			if _, ok := files[name]; !ok {
+				index.Remove(name)
+			}
+		}
+		names := make([]string, 0, len(files))
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			info := files[name]
+			// unchanged files keep their sha, no need to hash them again unless racy, the HEAD of
+			// a nested repository can move without changing its directory
+			if entry, ok := index.Find(name); ok && entry.Mode != MODE_GITLINK && entry.StatMatches(info) && !entry.isRacy(indexInfo) {
+				continue
+			}
+			sha, err := r.HashWorkingFile(name, info, true)
+			if err != nil {
+				return err
+			}
+			index.Add(newIndexEntry(name, info, sha))
+		}
+	}
+	return r.WriteIndex(index)
+}
+
+// RemoveFromIndex unstages the pathspecs, directories need recursive
+func (r *LocalRepository) RemoveFromIndex(pathspecs []string, recursive bool) ([]string, error) {
+	index, err := r.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+	removed := []string{}
+	for _, pathspec := range pathspecs {
+		pathspec, err = r.normalizePathspec(pathspec)
+		if err != nil {
+			return nil, err
+		}
+		names := index.Matches(pathspec)
+		if len(names) == 0 {
+			return nil, fmt.Errorf("pathspec '%v' did not match any files", pathspec)
+		}
+		if !recursive && (len(names) > 1 || names[0] != pathspec) {
+			return nil, fmt.Errorf("not removing '%v' recursively without -r", pathspec)
+		}
+		for _, name := range names {
+			index.Remove(name)
+			removed = append(removed, name)
+		}
+	}
+	return removed, r.WriteIndex(index)
+}
+
+// normalizePathspec makes a pathspec relative to the root, with forward slashes
+func (r *LocalRepository) normalizePathspec(pathspec string) (string, error) {
+	absolute := pathspec
+	if !filepath.IsAbs(pathspec) {
+		absolute = filepath.Join(r.RootName, pathspec)
+	}
+	relative, err := filepath.Rel(r.RootName, absolute)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, "../") {
+		return "", fmt.Errorf("%v is outside repository at %v", pathspec, r.RootName)
+	}
+	return filepath.ToSlash(relative), nil
+}
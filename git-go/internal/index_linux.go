@@ -0,0 +1,19 @@
+package internal
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+func fillIndexStat(entry *IndexEntry, info fs.FileInfo) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	entry.CTimeSeconds = uint32(stat.Ctim.Sec)
+	entry.CTimeNanoseconds = uint32(stat.Ctim.Nsec)
+	entry.Dev = uint32(stat.Dev)
+	entry.Ino = uint32(stat.Ino)
+	entry.Uid = stat.Uid
+	entry.Gid = stat.Gid
+}
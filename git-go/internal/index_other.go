@@ -0,0 +1,11 @@
+//go:build !linux
+
+package internal
+
+import "io/fs"
+
+// only the modification time and the size are portable
+func fillIndexStat(entry *IndexEntry, info fs.FileInfo) {
+	entry.CTimeSeconds = entry.MTimeSeconds
+	entry.CTimeNanoseconds = entry.MTimeNanoseconds
+}
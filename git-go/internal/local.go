@@ -3,27 +3,60 @@ package internal
 import (
 	"bytes"
 	"compress/zlib"
-	"crypto/sha1"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
 )
 
 type LocalRepository struct {
 	RootName string
+	// the git directory of a submodule whose .git is a file, RootName/.git when empty
+	gitDir string
+	// the indexes of objects/pack, read again when the directory is modified
+	packs        []loadedPack
+	packsModTime time.Time
 }
 
 func (r *LocalRepository) GitDir() string {
+	if r.gitDir != "" {
+		return r.gitDir
+	}
 	return r.RootName + "/.git"
 }
 
+// openNestedRepository opens the repository of a working tree directory, its .git is a directory
+// or, like in submodules, a file holding "gitdir: <path>"
+// https://git-scm.com/docs/gitrepository-layout
+func openNestedRepository(root string) (*LocalRepository, error) {
+	nested := &LocalRepository{RootName: root}
+	dotGit := filepath.Join(root, ".git")
+	info, err := os.Stat(dotGit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %v, %v", dotGit, err)
+	}
+	if info.IsDir() {
+		return nested, nil
+	}
+	content, err := os.ReadFile(dotGit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v, %v", dotGit, err)
+	}
+	gitDir, found := strings.CutPrefix(strings.TrimSpace(string(content)), "gitdir: ")
+	if !found || gitDir == "" {
+		return nil, fmt.Errorf("invalid gitfile format %v", dotGit)
+	}
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(root, gitDir)
+	}
+	nested.gitDir = gitDir
+	return nested, nil
+}
+
 func (r *LocalRepository) ObjectsName() string {
 	return r.GitDir() + "/objects"
 }
@@ -100,8 +133,12 @@ func (r *LocalRepository) WriteObjectWithType(objType string, content []byte) er
 }
 
 func (r *LocalRepository) ReadObject(hashHex string) (string, error) {
-	if !r.ObjectExists(hashHex) {
-		return "", fmt.Errorf("object does not exists %s", hashHex)
+	if !r.looseObjectExists(hashHex) {
+		objType, content, err := r.readPackedObject(hashHex, 0)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %d\x00%s", objType, len(content), content), nil
 	}
 	filePath := filepath.Join(r.ObjectsName(), hashHex[:2], hashHex[2:])
 	file, err := os.ReadFile(filePath)
@@ -121,7 +158,67 @@ func (r *LocalRepository) ReadObject(hashHex string) (string, error) {
 	return decompressedData.String(), nil
 }
 
+// ReadObjectWithType returns the type and the content of an object, without its header
+func (r *LocalRepository) ReadObjectWithType(hashHex string) (string, []byte, error) {
+	object, err := r.ReadObject(hashHex)
+	if err != nil {
+		return "", nil, err
+	}
+	idx := FindNull(object)
+	if idx == -1 {
+		return "", nil, fmt.Errorf("invalid object %s, missing header", hashHex)
+	}
+	var (
+		objectType string
+		size       int
+	)
+	_, err = fmt.Sscanf(object[:idx], "%s %d", &objectType, &size)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid object %s header, %v", hashHex, err)
+	}
+	return objectType, []byte(object[idx+1:]), nil
+}
+
 func (r *LocalRepository) ObjectExists(hashHex string) bool {
+	return r.looseObjectExists(hashHex) || r.packedObjectExists(hashHex)
+}
+
+// shortest abbreviated sha accepted as a revision
+const minAbbrevLength = 4
+
+// expandShortSha returns the only object, loose or packed, whose sha starts with prefix
+// https://git-scm.com/docs/gitrevisions#_specifying_revisions
+func (r *LocalRepository) expandShortSha(prefix string) (string, error) {
+	matches := map[string]bool{}
+	entries, err := os.ReadDir(filepath.Join(r.ObjectsName(), prefix[:2]))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("failed to list objects %v, %v", prefix[:2], err)
+	}
+	for _, entry := range entries {
+		if len(entry.Name()) == 38 && strings.HasPrefix(entry.Name(), prefix[2:]) {
+			matches[prefix[:2]+entry.Name()] = true
+		}
+	}
+	packs, err := r.loadPacks()
+	if err != nil {
+		return "", err
+	}
+	for _, pack := range packs {
+		shas := pack.index.Shas
+		for i := sort.SearchStrings(shas, prefix); i < len(shas) && strings.HasPrefix(shas[i], prefix); i++ {
+			matches[shas[i]] = true
+		}
+	}
+	if len(matches) > 1 {
+		return "", fmt.Errorf("short object ID %v is ambiguous", prefix)
+	}
+	for sha := range matches {
+		return sha, nil
+	}
+	return "", fmt.Errorf("unknown revision %v", prefix)
+}
+
+func (r *LocalRepository) looseObjectExists(hashHex string) bool {
 	if len(hashHex) < 20 {
 		return false
 	}
@@ -132,142 +229,242 @@ func (r *LocalRepository) ObjectExists(hashHex string) bool {
 	return true
 }
 
-func (r *LocalRepository) CatFile(hashHex string) (string, error) {
-	content, err := r.ReadObject(hashHex)
+// LooseObjects returns the sha of every object stored under objects/xx/yyyy
+func (r *LocalRepository) LooseObjects() ([]string, error) {
+	dirs, err := os.ReadDir(r.ObjectsName())
 	if err != nil {
-		return "", fmt.Errorf("failed to read object %v", err)
+		return nil, fmt.Errorf("failed to read dir %v, %v", r.ObjectsName(), err)
+	}
+	shas := []string{}
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 2 || !isHex(dir.Name()) {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(r.ObjectsName(), dir.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dir %v, %v", dir.Name(), err)
+		}
+		for _, file := range files {
+			if len(file.Name()) == 38 && isHex(file.Name()) {
+				shas = append(shas, dir.Name()+file.Name())
+			}
+		}
 	}
-	return strings.Split(content, "\x00")[1], nil
+	return shas, nil
 }
 
-func (r *LocalRepository) WriteBlobObject(filename string) ([]byte, string, error) {
-	file, err := os.ReadFile(filename)
+// CatFile returns the content of an object, without its header
+func (r *LocalRepository) CatFile(hashHex string) ([]byte, error) {
+	object, err := r.ReadTypedObject(hashHex)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to read file %v, %v", filename, err)
+		return nil, fmt.Errorf("failed to read object %v", err)
 	}
+	return object.Serialize(), nil
+}
 
-	fileContent := "blob\x20" + strconv.Itoa(len(file)) + "\x00" + string(file)
-
-	hasher := sha1.New()
-	_, err = hasher.Write([]byte(fileContent))
+func (r *LocalRepository) WriteBlobObject(filename string) (string, error) {
+	file, err := os.ReadFile(filename)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to write to sha1 hasher, %v", err)
+		return "", fmt.Errorf("failed to read file %v, %v", filename, err)
 	}
-	hash := hasher.Sum(nil)
-	hashHex := hex.EncodeToString(hash)
-
-	r.WriteObject(hashHex, []byte(fileContent))
-
-	return hash, hashHex, nil
+	return r.WriteTypedObject(&Blob{Content: file})
 }
 
-func (r *LocalRepository) WriteTreeObject(dirname string) ([]byte, string, error) {
-	files, err := os.ReadDir(dirname)
+// WriteTreeObject writes the trees of the index, it returns the sha of the root tree
+func (r *LocalRepository) WriteTreeObject() (string, error) {
+	index, err := r.ReadIndex()
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to read dir %v, %v", dirname, err)
+		return "", err
 	}
-	type entry struct {
-		name    string
-		mode    string
-		byteSha []byte
-	}
-	var entries []entry
-	for _, file := range files {
-		fullname := fmt.Sprintf("%v/%v", dirname, file.Name())
-		if file.Name() == ".git" {
-			continue
+	for _, entry := range index.Entries {
+		if entry.Stage() != 0 {
+			return "", fmt.Errorf("%v: unmerged entry in index", entry.Name)
+		}
+		if entry.Mode != MODE_GITLINK && !r.ObjectExists(entry.Sha) {
+			return "", fmt.Errorf("invalid object %o %v for '%v'", entry.Mode, entry.Sha, entry.Name)
 		}
-		if file.IsDir() {
-			hash, _, err := r.WriteTreeObject(fullname)
+	}
+	sha, _, err := r.writeIndexTree(index.Entries, "")
+	return sha, err
+}
+
+// writeIndexTree writes the tree of the directory prefix from the sorted entries starting
+// with it, it returns its sha and the number of entries consumed
+func (r *LocalRepository) writeIndexTree(entries []IndexEntry, prefix string) (string, int, error) {
+	tree := &Tree{}
+	consumed := 0
+	for consumed < len(entries) && strings.HasPrefix(entries[consumed].Name, prefix) {
+		entry := entries[consumed]
+		name := entry.Name[len(prefix):]
+		// entries of a sub directory follow each other in the index
+		if dir, _, isNested := strings.Cut(name, "/"); isNested {
+			subSha, subConsumed, err := r.writeIndexTree(entries[consumed:], prefix+dir+"/")
 			if err != nil {
-				return nil, "", fmt.Errorf("failed to write tree object %v, %v", fullname, err)
+				return "", 0, err
 			}
-			entries = append(entries, entry{name: file.Name(), byteSha: hash, mode: "040000"})
+			tree.Entries = append(tree.Entries, TreeEntry{Mode: fmt.Sprintf("%o", MODE_TREE), Name: dir, Sha: subSha})
+			consumed += subConsumed
 			continue
 		}
-		hash, _, err := r.WriteBlobObject(fullname)
-		if err != nil {
-			return nil, "", fmt.Errorf("failed to create blob object for %v, %v", fullname, err)
-		}
-		file.Type()
-		entries = append(entries, entry{name: file.Name(), byteSha: hash, mode: "100644"})
+		tree.Entries = append(tree.Entries, TreeEntry{Mode: fmt.Sprintf("%o", entry.Mode), Name: name, Sha: entry.Sha})
+		consumed++
 	}
+	tree.Sort()
 
-	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].name < entries[j].name
-	})
-
-	var treeContent []string
-	treeContentLength := 0
-	for _, entry := range entries {
-		treeEntry := fmt.Sprintf("%v\x20%v\x00%v", entry.mode, entry.name, string(entry.byteSha))
-		treeContent = append(treeContent, treeEntry)
-		treeContentLength += len(treeEntry)
+	sha, err := r.WriteTypedObject(tree)
+	if err != nil {
+		return "", 0, err
 	}
+	return sha, consumed, nil
+}
 
-	treeHeader := fmt.Sprintf("tree\x20%v\x00", treeContentLength)
-	treeObject := []byte(treeHeader)
-	for _, entry := range treeContent {
-		treeObject = append(treeObject, []byte(entry)...)
-	}
+type LsTreeOptions struct {
+	// list the entries of sub trees
+	Recursive bool
+	// list the sub trees themselves when recursing
+	ShowTrees bool
+	// read the size of blobs
+	Long bool
+	// only the entries inside or leading to these paths, a trailing slash lists the content of a tree
+	Paths []string
+}
+
+type LsTreeEntry struct {
+	Mode string
+	Type string
+	Sha  string
+	// -1 unless the entry is a blob listed with Long
+	Size int64
+	Name string
+}
 
-	hasher := sha1.New()
-	_, err = hasher.Write(treeObject)
+// ReadTreeObject lists the entries of a tree-ish like git ls-tree, names are paths from the root tree
+// https://git-scm.com/docs/git-ls-tree
+func (r *LocalRepository) ReadTreeObject(treeish string, options LsTreeOptions) ([]LsTreeEntry, error) {
+	treeSha, err := r.peelToTree(treeish)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to hash tree object %v", err)
+		return nil, err
 	}
-	hash := hasher.Sum(nil)
-	hashHex := hex.EncodeToString(hash)
-
-	err = r.WriteObject(hashHex, treeObject)
+	entries := []LsTreeEntry{}
+	var walk func(sha string, prefix string) error
+	walk = func(sha string, prefix string) error {
+		tree, err := r.ReadTree(sha)
+		if err != nil {
+			return err
+		}
+		for _, treeEntry := range tree.Entries {
+			objType, err := treeEntry.Type()
+			if err != nil {
+				return fmt.Errorf("invalid tree %v, %v", sha, err)
+			}
+			name := prefix + treeEntry.Name
+			show, recurse := lsTreeMatch(name, objType == "tree", options)
+			if recurse && objType == "tree" {
+				if options.ShowTrees {
+					entries = append(entries, LsTreeEntry{Mode: fmt.Sprintf("%06s", treeEntry.Mode), Type: objType, Sha: treeEntry.Sha, Size: -1, Name: name})
+				}
+				err = walk(treeEntry.Sha, name+"/")
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if show {
+				entries = append(entries, LsTreeEntry{Mode: fmt.Sprintf("%06s", treeEntry.Mode), Type: objType, Sha: treeEntry.Sha, Size: -1, Name: name})
+			}
+		}
+		return nil
+	}
+	err = walk(treeSha, "")
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to write object %v", err)
+		return nil, err
+	}
+	if options.Long {
+		for i := range entries {
+			if entries[i].Type != "blob" {
+				continue
+			}
+			blob, err := r.ReadBlob(entries[i].Sha)
+			if err != nil {
+				return nil, err
+			}
+			entries[i].Size = int64(len(blob.Content))
+		}
 	}
+	return entries, nil
+}
 
-	return hash, hashHex, nil
+// lsTreeMatch tells whether an entry is listed, and whether a tree entry is opened instead
+func lsTreeMatch(name string, isTree bool, options LsTreeOptions) (bool, bool) {
+	if len(options.Paths) == 0 {
+		return true, isTree && options.Recursive
+	}
+	for _, path := range options.Paths {
+		dir, isDir := strings.CutSuffix(path, "/")
+		switch {
+		case name == dir && isDir:
+			return false, true
+		case name == dir || strings.HasPrefix(name, dir+"/"):
+			return true, isTree && options.Recursive
+		case strings.HasPrefix(dir, name+"/"):
+			// a tree leading to a path is always opened
+			return false, true
+		}
+	}
+	return false, false
 }
 
-func (r *LocalRepository) ReadTreeObject(hashHex string, nameonly bool) ([]string, error) {
-	content, err := r.ReadObject(hashHex)
+// peelToTree follows a revision, a tag or a commit to its tree
+func (r *LocalRepository) peelToTree(revision string) (string, error) {
+	sha, err := r.ResolveRevision(revision)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read object %v", err)
+		return "", err
 	}
-	split := strings.Split(content, "\x00")
-	data := split[1 : len(split)-1]
-
-	if nameonly {
-		names := []string{}
-		for _, dByte := range data {
-			splitByte := strings.Split(dByte, " ")[1]
-			names = append(names, splitByte)
+	for {
+		object, err := r.ReadTypedObject(sha)
+		if err != nil {
+			return "", err
+		}
+		switch object := object.(type) {
+		case *Tree:
+			return sha, nil
+		case *Commit:
+			sha = object.Tree
+		case *Tag:
+			sha = object.Object
+		default:
+			return "", fmt.Errorf("%v is not a tree-ish", revision)
 		}
-		return names, nil
 	}
-	return nil, errors.New("read tree all not implemented")
 }
 
-func (r *LocalRepository) WriteCommitObject(treeSha string, parentSha string, message string) (string, error) {
-	currentTime := time.Now()
-	commitContent := fmt.Sprintf("tree %s\n", treeSha)
-	if parentSha != "" {
-		commitContent += fmt.Sprintf("parent %s\n", parentSha)
-	}
-	commitContent += fmt.Sprintf(
-		"author author_name <author_email> %d %s\n\n%s\n",
-		currentTime.Unix(),
-		"+0000",
-		message)
-	commitHeader := fmt.Sprintf("commit %v\x00", len(commitContent))
-	commitObject := commitHeader + commitContent
-
-	hasher := sha1.New()
-	_, err := hasher.Write([]byte(commitObject))
+// WriteCommitObject writes a commit of a tree, the committer and the author when nil come from Ident
+func (r *LocalRepository) WriteCommitObject(treeSha string, parentShas []string, author *Signature, message string) (string, error) {
+	if objType, _, err := r.ReadObjectWithType(treeSha); err != nil || objType != "tree" {
+		return "", fmt.Errorf("%v is not a valid tree object", treeSha)
+	}
+	for _, parentSha := range parentShas {
+		if objType, _, err := r.ReadObjectWithType(parentSha); err != nil || objType != "commit" {
+			return "", fmt.Errorf("%v is not a valid commit object", parentSha)
+		}
+	}
+	var err error
+	if author == nil {
+		author, err = r.Ident(IDENT_AUTHOR)
+		if err != nil {
+			return "", err
+		}
+	}
+	committer, err := r.Ident(IDENT_COMMITTER)
 	if err != nil {
-		return "", fmt.Errorf("failed to hash tree object %v", err)
+		return "", err
 	}
-	hash := hasher.Sum(nil)
-	hashHex := hex.EncodeToString(hash)
-
-	r.WriteObject(hashHex, []byte(commitObject))
-	return hashHex, nil
+	commit := &Commit{
+		Tree:      treeSha,
+		Parents:   parentShas,
+		Author:    author,
+		Committer: committer,
+		Message:   message,
+	}
+	return r.WriteTypedObject(commit)
 }
@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// writeLockedFile writes a file through a <name>.lock file renamed over it, the lock file being
+// created exclusively, two processes can not write the same file at the same time
+func writeLockedFile(filename string, content []byte) error {
+	lockName := filename + ".lock"
+	lock, err := os.OpenFile(lockName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("unable to create %v, another git process seems to be running", lockName)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create %v, %v", lockName, err)
+	}
+	_, err = lock.Write(content)
+	closeErr := lock.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(lockName, filename)
+	}
+	if err != nil {
+		os.Remove(lockName)
+		return err
+	}
+	return nil
+}
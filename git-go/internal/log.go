@@ -0,0 +1,276 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// newest committer date first, children are not forced before their parents
+	LOG_ORDER_DEFAULT = "default"
+	// children before their parents, then newest committer date first
+	LOG_ORDER_DATE = "date"
+	// children before their parents, lines of history are not intermixed
+	LOG_ORDER_TOPO = "topo"
+)
+
+var relativeDateRegexp = regexp.MustCompile(`^(\d+)[ .]*(second|minute|hour|day|week|month|year)s?[ .]+ago$`)
+
+// LogOptions filters and orders the commits of Log
+type LogOptions struct {
+	// -1 for no limit
+	MaxCount int
+	// regular expressions matched against "name <email>", a commit matches any of them
+	Authors []string
+	// committer dates in seconds since the epoch, 0 for no bound
+	Since int64
+	Until int64
+	Order string
+}
+
+type LogEntry struct {
+	Sha    string
+	Commit *Commit
+	// the parents passing the filters, the graph only draws edges to them
+	ShownParents []string
+}
+
+// Log walks the commits reachable from revisions, HEAD when there is none
+// https://git-scm.com/docs/git-log#_commit_limiting
+func (r *LocalRepository) Log(revisions []string, options LogOptions) ([]LogEntry, error) {
+	authors := make([]*regexp.Regexp, 0, len(options.Authors))
+	for _, author := range options.Authors {
+		pattern, err := regexp.Compile(author)
+		if err != nil {
+			return nil, fmt.Errorf("invalid author pattern %v, %v", author, err)
+		}
+		authors = append(authors, pattern)
+	}
+	if len(revisions) == 0 {
+		head, err := r.ResolveRef("HEAD")
+		if err != nil {
+			return nil, err
+		}
+		if head == "" {
+			branch, err := r.CurrentBranch()
+			if err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("your current branch '%v' does not have any commits yet", branch)
+		}
+		revisions = []string{"HEAD"}
+	}
+
+	commits := map[string]*Commit{}
+	// pending commits sorted by committer date, newest first, like git the ones with the same
+	// date are walked in the order they were found
+	pending := []string{}
+	push := func(sha string) error {
+		if _, seen := commits[sha]; seen {
+			return nil
+		}
+		commit, err := r.ReadCommit(sha)
+		if err != nil {
+			return err
+		}
+		commits[sha] = commit
+		i := 0
+		for i < len(pending) && commitDate(commits[pending[i]]) >= commitDate(commit) {
+			i++
+		}
+		pending = append(pending[:i], append([]string{sha}, pending[i:]...)...)
+		return nil
+	}
+	for _, revision := range revisions {
+		sha, err := r.ResolveRevision(revision)
+		if err == nil {
+			sha, err = r.applyRevisionSuffix(sha, "^{commit}")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad revision '%v', %v", revision, err)
+		}
+		err = push(sha)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	shown := func(commit *Commit) bool {
+		date := commitDate(commit)
+		if (options.Since != 0 && date < options.Since) || (options.Until != 0 && date > options.Until) {
+			return false
+		}
+		if len(authors) == 0 {
+			return true
+		}
+		if commit.Author == nil {
+			return false
+		}
+		ident := fmt.Sprintf("%v <%v>", commit.Author.Name, commit.Author.Email)
+		for _, author := range authors {
+			if author.MatchString(ident) {
+				return true
+			}
+		}
+		return false
+	}
+	entry := func(sha string) LogEntry {
+		parents := []string{}
+		for _, parent := range commits[sha].Parents {
+			if commit, walked := commits[parent]; walked && shown(commit) {
+				parents = append(parents, parent)
+			}
+		}
+		return LogEntry{Sha: sha, Commit: commits[sha], ShownParents: parents}
+	}
+
+	// like git, the walk stops at commits older than since
+	walked := []string{}
+	entries := []LogEntry{}
+	for len(pending) > 0 && (options.MaxCount < 0 || len(entries) < options.MaxCount) {
+		sha := pending[0]
+		pending = pending[1:]
+		if options.Since != 0 && commitDate(commits[sha]) < options.Since {
+			continue
+		}
+		for _, parent := range commits[sha].Parents {
+			err := push(parent)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// like git, commits newer than until are left out of the topological sort
+		if options.Until == 0 || commitDate(commits[sha]) <= options.Until {
+			walked = append(walked, sha)
+		}
+		if options.Order == LOG_ORDER_DEFAULT && shown(commits[sha]) {
+			entries = append(entries, entry(sha))
+		}
+	}
+	if options.Order == LOG_ORDER_DEFAULT {
+		return entries, nil
+	}
+
+	for _, sha := range sortTopological(walked, commits, options.Order == LOG_ORDER_DATE) {
+		if options.MaxCount >= 0 && len(entries) >= options.MaxCount {
+			break
+		}
+		if shown(commits[sha]) {
+			entries = append(entries, entry(sha))
+		}
+	}
+	return entries, nil
+}
+
+// sortTopological orders commits so that children come before their parents, starting from
+// the tips in the walk order, byDate emits the newest ready commit first, otherwise the last
+// ready one so that a line of history is emitted until it merges
+func sortTopological(shas []string, commits map[string]*Commit, byDate bool) []string {
+	// like git, an indegree of 1 means no child left, 0 a commit outside of the list
+	indegree := map[string]int{}
+	for _, sha := range shas {
+		indegree[sha] = 1
+	}
+	for _, sha := range shas {
+		for _, parent := range commits[sha].Parents {
+			if indegree[parent] > 0 {
+				indegree[parent]++
+			}
+		}
+	}
+	ready := []string{}
+	for _, sha := range shas {
+		if indegree[sha] == 1 {
+			ready = append(ready, sha)
+		}
+	}
+	if !byDate {
+		for i, j := 0, len(ready)-1; i < j; i, j = i+1, j-1 {
+			ready[i], ready[j] = ready[j], ready[i]
+		}
+	}
+
+	sorted := make([]string, 0, len(shas))
+	for len(ready) > 0 {
+		next := len(ready) - 1
+		if byDate {
+			next = 0
+			for i, sha := range ready {
+				if commitDate(commits[sha]) > commitDate(commits[ready[next]]) {
+					next = i
+				}
+			}
+		}
+		sha := ready[next]
+		ready = append(ready[:next], ready[next+1:]...)
+		for _, parent := range commits[sha].Parents {
+			if indegree[parent] == 0 {
+				continue
+			}
+			indegree[parent]--
+			if indegree[parent] == 1 {
+				ready = append(ready, parent)
+			}
+		}
+		indegree[sha] = 0
+		sorted = append(sorted, sha)
+	}
+	return sorted
+}
+
+func commitDate(commit *Commit) int64 {
+	if commit.Committer == nil {
+		return 0
+	}
+	return commit.Committer.Timestamp
+}
+
+// ParseApproxDate reads the dates of --since and --until, the formats of GIT_COMMITTER_DATE, a
+// day taken at the current time like git, and relative dates like "2 weeks ago" or "yesterday"
+// https://git-scm.com/docs/git-log#Documentation/git-log.txt---sinceltdategt
+func ParseApproxDate(date string, now time.Time) (int64, error) {
+	date = strings.TrimSpace(date)
+	keyword := strings.ToLower(date)
+	switch keyword {
+	case "now", "today":
+		return now.Unix(), nil
+	case "yesterday":
+		return now.AddDate(0, 0, -1).Unix(), nil
+	}
+	if timestamp, err := strconv.ParseInt(strings.TrimPrefix(date, "@"), 10, 64); err == nil {
+		return timestamp, nil
+	}
+	if match := relativeDateRegexp.FindStringSubmatch(keyword); match != nil {
+		count, err := strconv.Atoi(match[1])
+		if err != nil {
+			return 0, fmt.Errorf("invalid date %v, %v", date, err)
+		}
+		switch match[2] {
+		case "second":
+			return now.Add(-time.Duration(count) * time.Second).Unix(), nil
+		case "minute":
+			return now.Add(-time.Duration(count) * time.Minute).Unix(), nil
+		case "hour":
+			return now.Add(-time.Duration(count) * time.Hour).Unix(), nil
+		case "day":
+			return now.AddDate(0, 0, -count).Unix(), nil
+		case "week":
+			return now.AddDate(0, 0, -7*count).Unix(), nil
+		case "month":
+			return now.AddDate(0, -count, 0).Unix(), nil
+		}
+		return now.AddDate(-count, 0, 0).Unix(), nil
+	}
+	if day, err := time.ParseInLocation("2006-01-02", date, now.Location()); err == nil {
+		hour, min, sec := now.Clock()
+		return day.Add(time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec)*time.Second).Unix(), nil
+	}
+	if minutes, err := time.ParseInLocation("2006-01-02 15:04", date, now.Location()); err == nil {
+		return minutes.Unix(), nil
+	}
+	timestamp, _, err := parseIdentDate(date)
+	return timestamp, err
+}
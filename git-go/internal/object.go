@@ -0,0 +1,451 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Object is a parsed git object, Serialize returns the exact content it was parsed from
+// https://git-scm.com/book/en/v2/Git-Internals-Git-Objects
+type Object interface {
+	Type() string
+	Serialize() []byte
+}
+
+type Blob struct {
+	Content []byte
+}
+
+type TreeEntry struct {
+	// octal mode as stored, trees are "40000"
+	Mode string
+	Name string
+	Sha  string
+}
+
+type Tree struct {
+	Entries []TreeEntry
+}
+
+// Signature is an author, committer or tagger line, Name <Email> Timestamp Timezone
+type Signature struct {
+	Name      string
+	Email     string
+	Timestamp int64
+	// offset like +0100
+	Timezone string
+}
+
+// ObjectHeader is a commit or tag header without dedicated field, like gpgsig or encoding
+type ObjectHeader struct {
+	Key string
+	// continuation lines are joined with \n
+	Value string
+}
+
+type Commit struct {
+	Tree    string
+	Parents []string
+	// nil when the line is missing
+	Author       *Signature
+	Committer    *Signature
+	ExtraHeaders []ObjectHeader
+	Message      string
+}
+
+type Tag struct {
+	Object     string
+	ObjectType string
+	Name       string
+	// nil for old tags without tagger
+	Tagger       *Signature
+	ExtraHeaders []ObjectHeader
+	Message      string
+	// tags without message have no blank line after their headers
+	HasMessage bool
+}
+
+var (
+	signatureRegexp = regexp.MustCompile(`^([^<>\n]*) <([^<>\n]*)> ([0-9]+) ([+-][0-9]{4})$`)
+	shaRegexp       = regexp.MustCompile(`^[0-9a-f]{40}$`)
+)
+
+func (b *Blob) Type() string { return "blob" }
+
+func (t *Tree) Type() string { return "tree" }
+
+func (c *Commit) Type() string { return "commit" }
+
+func (t *Tag) Type() string { return "tag" }
+
+func (b *Blob) Serialize() []byte {
+	return b.Content
+}
+
+// ParseObject parses the content of an object, without its header
+func ParseObject(objType string, content []byte) (Object, error) {
+	switch objType {
+	case "blob":
+		return &Blob{Content: content}, nil
+	case "tree":
+		return ParseTree(content)
+	case "commit":
+		return ParseCommit(content)
+	case "tag":
+		return ParseTag(content)
+	}
+	return nil, fmt.Errorf("invalid object type %q", objType)
+}
+
+// ParseTree splits a tree in <mode> SP <name> NUL <20 bytes sha> entries
+func ParseTree(content []byte) (*Tree, error) {
+	tree := &Tree{Entries: []TreeEntry{}}
+	for len(content) > 0 {
+		space := bytes.IndexByte(content, ' ')
+		if space == -1 {
+			return nil, errors.New("truncated tree entry mode")
+		}
+		mode := string(content[:space])
+		content = content[space+1:]
+		null := bytes.IndexByte(content, 0)
+		if null == -1 || len(content) < null+21 {
+			return nil, errors.New("truncated tree entry")
+		}
+		tree.Entries = append(tree.Entries, TreeEntry{Mode: mode, Name: string(content[:null]), Sha: hex.EncodeToString(content[null+1 : null+21])})
+		content = content[null+21:]
+	}
+	return tree, nil
+}
+
+func (t *Tree) Serialize() []byte {
+	content := bytes.Buffer{}
+	for _, entry := range t.Entries {
+		content.WriteString(entry.Mode)
+		content.WriteByte(' ')
+		content.WriteString(entry.Name)
+		content.WriteByte(0)
+		sha, _ := hex.DecodeString(entry.Sha)
+		content.Write(sha)
+	}
+	return content.Bytes()
+}
+
+// Sort orders the entries like git, a tree compares as its name followed by a slash
+func (t *Tree) Sort() {
+	sortName := func(entry TreeEntry) string {
+		if entry.Mode == "40000" {
+			return entry.Name + "/"
+		}
+		return entry.Name
+	}
+	sort.SliceStable(t.Entries, func(i, j int) bool {
+		return sortName(t.Entries[i]) < sortName(t.Entries[j])
+	})
+}
+
+// Type returns the type of the object referenced by the entry
+func (e TreeEntry) Type() (string, error) {
+	return treeEntryType(e.Mode)
+}
+
+func treeEntryType(mode string) (string, error) {
+	switch mode {
+	case "40000":
+		return "tree", nil
+	case "100644", "100755", "100664", "120000":
+		return "blob", nil
+	case "160000":
+		return "commit", nil
+	}
+	return "", fmt.Errorf("invalid mode %q", mode)
+}
+
+func ParseSignature(line string) (*Signature, error) {
+	match := signatureRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return nil, fmt.Errorf("invalid identity %q", line)
+	}
+	timestamp, err := strconv.ParseInt(match[3], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp in %q, %v", line, err)
+	}
+	return &Signature{Name: match[1], Email: match[2], Timestamp: timestamp, Timezone: match[4]}, nil
+}
+
+func (s *Signature) String() string {
+	return fmt.Sprintf("%s <%s> %d %s", s.Name, s.Email, s.Timestamp, s.Timezone)
+}
+
+// parseHeaders splits the header lines of a commit or a tag, a line starting with a space continues
+// the previous header, it returns the message after the blank line and whether there was one
+func parseHeaders(content []byte) ([]ObjectHeader, string, bool, error) {
+	headers := []ObjectHeader{}
+	text := string(content)
+	for len(text) > 0 {
+		line, rest, found := strings.Cut(text, "\n")
+		if !found {
+			return nil, "", false, fmt.Errorf("unterminated header %q", line)
+		}
+		text = rest
+		if line == "" {
+			return headers, text, true, nil
+		}
+		if continuation, isContinuation := strings.CutPrefix(line, " "); isContinuation {
+			if len(headers) == 0 {
+				return nil, "", false, errors.New("continuation line without header")
+			}
+			headers[len(headers)-1].Value += "\n" + continuation
+			continue
+		}
+		key, value, found := strings.Cut(line, " ")
+		if !found {
+			return nil, "", false, fmt.Errorf("invalid header %q", line)
+		}
+		headers = append(headers, ObjectHeader{Key: key, Value: value})
+	}
+	return headers, "", false, nil
+}
+
+func writeHeader(content *bytes.Buffer, key string, value string) {
+	content.WriteString(key)
+	content.WriteByte(' ')
+	content.WriteString(strings.ReplaceAll(value, "\n", "\n "))
+	content.WriteByte('\n')
+}
+
+// ParseCommit reads tree, parent, author and committer headers in this order, other headers
+// must come after them
+func ParseCommit(content []byte) (*Commit, error) {
+	headers, message, found, err := parseHeaders(content)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("missing blank line after headers")
+	}
+	commit := &Commit{Parents: []string{}, ExtraHeaders: []ObjectHeader{}, Message: message}
+	if len(headers) == 0 || headers[0].Key != "tree" || !shaRegexp.MatchString(headers[0].Value) {
+		return nil, errors.New("invalid or missing tree line")
+	}
+	commit.Tree = headers[0].Value
+	headers = headers[1:]
+	for len(headers) > 0 && headers[0].Key == "parent" {
+		if !shaRegexp.MatchString(headers[0].Value) {
+			return nil, fmt.Errorf("invalid parent line %q", headers[0].Value)
+		}
+		commit.Parents = append(commit.Parents, headers[0].Value)
+		headers = headers[1:]
+	}
+	if len(headers) > 0 && headers[0].Key == "author" {
+		commit.Author, err = ParseSignature(headers[0].Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid author line, %v", err)
+		}
+		headers = headers[1:]
+	}
+	if len(headers) > 0 && headers[0].Key == "committer" {
+		commit.Committer, err = ParseSignature(headers[0].Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid committer line, %v", err)
+		}
+		headers = headers[1:]
+	}
+	for _, header := range headers {
+		switch header.Key {
+		case "tree", "parent", "author", "committer":
+			return nil, fmt.Errorf("unexpected %v line", header.Key)
+		}
+		commit.ExtraHeaders = append(commit.ExtraHeaders, header)
+	}
+	return commit, nil
+}
+
+func (c *Commit) Serialize() []byte {
+	content := bytes.Buffer{}
+	writeHeader(&content, "tree", c.Tree)
+	for _, parent := range c.Parents {
+		writeHeader(&content, "parent", parent)
+	}
+	if c.Author != nil {
+		writeHeader(&content, "author", c.Author.String())
+	}
+	if c.Committer != nil {
+		writeHeader(&content, "committer", c.Committer.String())
+	}
+	for _, header := range c.ExtraHeaders {
+		writeHeader(&content, header.Key, header.Value)
+	}
+	content.WriteByte('\n')
+	content.WriteString(c.Message)
+	return content.Bytes()
+}
+
+// ParseTag reads object, type, tag and the optional tagger headers in this order
+func ParseTag(content []byte) (*Tag, error) {
+	headers, message, found, err := parseHeaders(content)
+	if err != nil {
+		return nil, err
+	}
+	tag := &Tag{ExtraHeaders: []ObjectHeader{}, Message: message, HasMessage: found}
+	if len(headers) < 3 {
+		return nil, errors.New("missing tag headers")
+	}
+	if headers[0].Key != "object" || !shaRegexp.MatchString(headers[0].Value) {
+		return nil, errors.New("invalid or missing object line")
+	}
+	tag.Object = headers[0].Value
+	if _, err := parsePackFileObjectType(headers[1].Value); headers[1].Key != "type" || err != nil {
+		return nil, errors.New("invalid or missing type line")
+	}
+	tag.ObjectType = headers[1].Value
+	if headers[2].Key != "tag" || headers[2].Value == "" {
+		return nil, errors.New("invalid or missing tag line")
+	}
+	tag.Name = headers[2].Value
+	headers = headers[3:]
+	if len(headers) > 0 && headers[0].Key == "tagger" {
+		tag.Tagger, err = ParseSignature(headers[0].Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tagger line, %v", err)
+		}
+		headers = headers[1:]
+	}
+	tag.ExtraHeaders = append(tag.ExtraHeaders, headers...)
+	return tag, nil
+}
+
+func (t *Tag) Serialize() []byte {
+	content := bytes.Buffer{}
+	writeHeader(&content, "object", t.Object)
+	writeHeader(&content, "type", t.ObjectType)
+	writeHeader(&content, "tag", t.Name)
+	if t.Tagger != nil {
+		writeHeader(&content, "tagger", t.Tagger.String())
+	}
+	for _, header := range t.ExtraHeaders {
+		writeHeader(&content, header.Key, header.Value)
+	}
+	if t.HasMessage || t.Message != "" {
+		content.WriteByte('\n')
+		content.WriteString(t.Message)
+	}
+	return content.Bytes()
+}
+
+// objectLink is an object referenced by another one, with the type it is expected to have
+type objectLink struct {
+	objType string
+	sha     string
+}
+
+// objectLinks returns the objects referenced by a tree, a commit or a tag, submodule commits
+// live in another repository and are skipped
+func objectLinks(object Object) []objectLink {
+	links := []objectLink{}
+	switch object := object.(type) {
+	case *Tree:
+		for _, entry := range object.Entries {
+			objType, err := entry.Type()
+			if err == nil && objType != "commit" {
+				links = append(links, objectLink{objType: objType, sha: entry.Sha})
+			}
+		}
+	case *Commit:
+		links = append(links, objectLink{objType: "tree", sha: object.Tree})
+		for _, parent := range object.Parents {
+			links = append(links, objectLink{objType: "commit", sha: parent})
+		}
+	case *Tag:
+		links = append(links, objectLink{objType: object.ObjectType, sha: object.Object})
+	}
+	return links
+}
+
+// HashObject returns the sha of an object, computed on its header and content
+func HashObject(object Object) (string, error) {
+	return hashObject(object.Type(), object.Serialize())
+}
+
+// ReadTypedObject reads and parses an object
+func (r *LocalRepository) ReadTypedObject(hashHex string) (Object, error) {
+	objType, content, err := r.ReadObjectWithType(hashHex)
+	if err != nil {
+		return nil, err
+	}
+	object, err := ParseObject(objType, content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v %v, %v", objType, hashHex, err)
+	}
+	return object, nil
+}
+
+func (r *LocalRepository) ReadBlob(hashHex string) (*Blob, error) {
+	object, err := r.ReadTypedObject(hashHex)
+	if err != nil {
+		return nil, err
+	}
+	blob, ok := object.(*Blob)
+	if !ok {
+		return nil, fmt.Errorf("object %v is a %v, not a blob", hashHex, object.Type())
+	}
+	return blob, nil
+}
+
+func (r *LocalRepository) ReadTree(hashHex string) (*Tree, error) {
+	object, err := r.ReadTypedObject(hashHex)
+	if err != nil {
+		return nil, err
+	}
+	tree, ok := object.(*Tree)
+	if !ok {
+		return nil, fmt.Errorf("object %v is a %v, not a tree", hashHex, object.Type())
+	}
+	return tree, nil
+}
+
+func (r *LocalRepository) ReadCommit(hashHex string) (*Commit, error) {
+	object, err := r.ReadTypedObject(hashHex)
+	if err != nil {
+		return nil, err
+	}
+	commit, ok := object.(*Commit)
+	if !ok {
+		return nil, fmt.Errorf("object %v is a %v, not a commit", hashHex, object.Type())
+	}
+	return commit, nil
+}
+
+func (r *LocalRepository) ReadTag(hashHex string) (*Tag, error) {
+	object, err := r.ReadTypedObject(hashHex)
+	if err != nil {
+		return nil, err
+	}
+	tag, ok := object.(*Tag)
+	if !ok {
+		return nil, fmt.Errorf("object %v is a %v, not a tag", hashHex, object.Type())
+	}
+	return tag, nil
+}
+
+// WriteTypedObject stores an object unless it already exists, it returns its sha
+func (r *LocalRepository) WriteTypedObject(object Object) (string, error) {
+	content := object.Serialize()
+	sha, err := hashObject(object.Type(), content)
+	if err != nil {
+		return "", err
+	}
+	if r.ObjectExists(sha) {
+		return sha, nil
+	}
+	err = r.WriteObjectWithType(object.Type(), content)
+	if err != nil {
+		return "", err
+	}
+	return sha, nil
+}
@@ -1,12 +1,16 @@
 package internal
 
 import (
+	"bufio"
 	"bytes"
 	"compress/zlib"
+	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 )
 
@@ -35,74 +39,179 @@ type PackfileObjectHeader struct {
 	ContentSize int64
 }
 
-// https://git-scm.com/docs/pack-format
-// https://stefan.saasen.me/articles/git-clone-in-haskell-from-the-bottom-up/#implementing-pack-file-negotiation
-// https://bitbucket.org/ssaasen/git/src/master/Documentation/technical/pack-format.txt
-func ParsePackFile(packFile []byte) ([]GitObject, []GitObjectDelta, error) {
-	packMagicBytes := string(packFile[:4])
-	packVersion := binary.BigEndian.Uint32(packFile[4:8])
-	packNbObjects := binary.BigEndian.Uint32(packFile[8:12])
+type PackFileHandler struct {
+	// called once the pack header is read, before any object
+	OnHeader func(nbObjects int) error
+	OnObject func(object GitObject) error
+	OnDelta  func(delta GitObjectDelta) error
+}
+
+// packFileStream counts the bytes consumed from the pack and hashes them, it implements
+// io.ByteReader so the zlib reader does not read past the end of a compressed object
+type packFileStream struct {
+	reader *bufio.Reader
+	offset int64
+	crc    hash.Hash32
+	sha    hash.Hash
+	single [1]byte
+}
+
+func (s *packFileStream) Read(p []byte) (int, error) {
+	n, err := s.reader.Read(p)
+	s.offset += int64(n)
+	s.crc.Write(p[:n])
+	s.sha.Write(p[:n])
+	return n, err
+}
+
+func (s *packFileStream) ReadByte() (byte, error) {
+	b, err := s.reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	s.single[0] = b
+	s.offset++
+	s.crc.Write(s.single[:])
+	s.sha.Write(s.single[:])
+	return b, nil
+}
+
+// readVarint returns the bytes of a variable length integer, up to the byte with MSB 0
+func (s *packFileStream) readVarint() ([]byte, error) {
+	buffer := []byte{}
+	for {
+		b, err := s.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		buffer = append(buffer, b)
+		if b&msbMask == 0 {
+			return buffer, nil
+		}
+		if len(buffer) > 10 {
+			return nil, errors.New("variable length integer too long")
+		}
+	}
+}
+
+// ReadPackFile decodes a pack file from a stream, each object is handed to the handler
+// as soon as its bytes are received, it returns the pack checksum read from the trailer
+func ReadPackFile(reader io.Reader, handler PackFileHandler) (string, error) {
+	stream := &packFileStream{reader: bufio.NewReader(reader), crc: crc32.NewIEEE(), sha: sha1.New()}
+
+	header := make([]byte, 12)
+	_, err := io.ReadFull(stream, header)
+	if err != nil {
+		return "", fmt.Errorf("failed to read pack file header, %v", err)
+	}
+	packMagicBytes := string(header[:4])
+	packVersion := binary.BigEndian.Uint32(header[4:8])
+	packNbObjects := binary.BigEndian.Uint32(header[8:12])
 	if packMagicBytes != "PACK" {
-		return nil, nil, errors.New("invalid pack file header, not containing PACK on magic bytes")
+		return "", errors.New("invalid pack file header, not containing PACK on magic bytes")
 	}
 	if packVersion != 2 {
-		return nil, nil, errors.New("invalid pack file header, version != 2")
+		return "", errors.New("invalid pack file header, version != 2")
+	}
+	if handler.OnHeader != nil {
+		err = handler.OnHeader(int(packNbObjects))
+		if err != nil {
+			return "", err
+		}
 	}
-
-	bytesRead := int64(12)
-	objects := []GitObject{}
-	deltas := []GitObjectDelta{}
 
 	for i := 0; i < int(packNbObjects); i++ {
-		headers, err := readObjectHeaders(packFile[bytesRead:])
+		objectOffset := stream.offset
+		stream.crc.Reset()
+
+		sizeBytes, err := stream.readVarint()
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to parse header on %v object, after %v byte read, %v", i, bytesRead, err)
+			return "", fmt.Errorf("failed to read header on %v object, after %v byte read, %v", i, stream.offset, err)
+		}
+		headers, err := readObjectHeaders(sizeBytes)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse header on %v object, after %v byte read, %v", i, stream.offset, err)
 		}
 
-		bytesRead += int64(headers.HeaderSize)
-
-		if headers.ObjectType == OBJ_COMMIT || headers.ObjectType == OBJ_TREE || headers.ObjectType == OBJ_BLOB || headers.ObjectType == OBJ_TAG {
-			read, object, err := readObjectContent(packFile[bytesRead:])
+		switch headers.ObjectType {
+		case OBJ_COMMIT, OBJ_TREE, OBJ_BLOB, OBJ_TAG:
+			object, err := readObjectContent(stream)
 			if err != nil {
-				return nil, nil, fmt.Errorf("failed to parse object content on %v object, after %v byte read, %v", i, bytesRead, err)
+				return "", fmt.Errorf("failed to parse object content on %v object, after %v byte read, %v", i, stream.offset, err)
 			}
 
 			objName, err := parseGitObjectName(headers.ObjectType)
 			if err != nil {
-				return nil, nil, fmt.Errorf("failed to parse git object name on %v object, after %v byte read, %v", i, bytesRead, err)
+				return "", fmt.Errorf("failed to parse git object name on %v object, after %v byte read, %v", i, stream.offset, err)
 			}
 
 			if headers.ContentSize != int64(len(object)) {
-				return nil, nil, fmt.Errorf("object of type %v has bad length, expected %v, has %v", headers.ObjectType, headers.ContentSize, len(object))
+				return "", fmt.Errorf("object of type %v has bad length, expected %v, has %v", headers.ObjectType, headers.ContentSize, len(object))
 			}
 
-			bytesRead += int64(read)
-			objects = append(objects, GitObject{ObjectName: objName, Content: object, ContentSize: headers.ContentSize})
+			if handler.OnObject != nil {
+				err = handler.OnObject(GitObject{ObjectName: objName, Offset: objectOffset, Crc32: stream.crc.Sum32(), Content: object, ContentSize: headers.ContentSize})
+				if err != nil {
+					return "", err
+				}
+			}
 
-		} else if headers.ObjectType == OBJ_REF_DELTA {
-			// 20 first bytes are sha to apply delta
-			hash := packFile[bytesRead : bytesRead+20]
-			bytesRead += 20
+		case OBJ_REF_DELTA, OBJ_OFS_DELTA:
+			delta := GitObjectDelta{Offset: objectOffset, ContentSize: headers.ContentSize}
+			if headers.ObjectType == OBJ_REF_DELTA {
+				// 20 first bytes are sha to apply delta
+				hash := make([]byte, 20)
+				_, err = io.ReadFull(stream, hash)
+				if err != nil {
+					return "", fmt.Errorf("failed to read delta base on %v object, %v", i, err)
+				}
+				delta.ObjectSha = hex.EncodeToString(hash)
+			} else {
+				// base object is located before this one, at a negative offset
+				offsetBytes, err := stream.readVarint()
+				if err != nil {
+					return "", fmt.Errorf("failed to read delta base on %v object, %v", i, err)
+				}
+				negativeOffset, _ := readOffsetDeltaBase(offsetBytes)
+				delta.BaseOffset = objectOffset - negativeOffset
+				if negativeOffset <= 0 || delta.BaseOffset < 12 {
+					return "", fmt.Errorf("invalid ofs delta base offset %v on %v object, after %v byte read", delta.BaseOffset, i, stream.offset)
+				}
+			}
 
-			read, object, err := readObjectContent(packFile[bytesRead:])
+			object, err := readObjectContent(stream)
 			if err != nil {
-				return nil, nil, fmt.Errorf(fmt.Sprintf("failed to read delta, %v", err))
+				return "", fmt.Errorf("failed to read delta, %v", err)
 			}
-			bytesRead += int64(read)
-
 			if headers.ContentSize != int64(len(object)) {
-				return nil, nil, fmt.Errorf("object of type %v has bad length, expected %v, has %v", headers.ObjectType, headers.ContentSize, len(object))
+				return "", fmt.Errorf("object of type %v has bad length, expected %v, has %v", headers.ObjectType, headers.ContentSize, len(object))
 			}
-			deltas = append(deltas, GitObjectDelta{ObjectSha: hex.EncodeToString(hash), Content: object, ContentSize: headers.ContentSize})
+			delta.Content = object
+			delta.Crc32 = stream.crc.Sum32()
 
-		} else if headers.ObjectType == OBJ_OFS_DELTA {
-			return nil, nil, errors.New("OBJ_OFS_DELTA not implemented")
-		} else {
-			return nil, nil, fmt.Errorf("invalid object type %v on %v object, after %v byte read", headers.ObjectType, i, bytesRead)
+			if handler.OnDelta != nil {
+				err = handler.OnDelta(delta)
+				if err != nil {
+					return "", err
+				}
+			}
+
+		default:
+			return "", fmt.Errorf("invalid object type %v on %v object, after %v byte read", headers.ObjectType, i, stream.offset)
 		}
+	}
 
+	// the trailer is the sha1 of every byte of the pack before it
+	checksum := stream.sha.Sum(nil)
+	trailer := make([]byte, 20)
+	_, err = io.ReadFull(stream.reader, trailer)
+	if err != nil {
+		return "", fmt.Errorf("failed to read pack file trailer, %v", err)
+	}
+	if !bytes.Equal(checksum, trailer) {
+		return "", fmt.Errorf("pack file checksum mismatch, expected %x, computed %x", trailer, checksum)
 	}
-	return objects, deltas, nil
+	return hex.EncodeToString(trailer), nil
 }
 
 func readObjectHeaders(packFile []byte) (*PackfileObjectHeader, error) {
@@ -138,45 +247,65 @@ func readVariableObjectSize(packFile []byte, initialShift int, initialSize int64
 	return size, read
 }
 
-func ApplyObjectDelta(r LocalRepository, delta GitObjectDelta) error {
-	if !r.ObjectExists(delta.ObjectSha) {
-		return fmt.Errorf("applyObjectDelta: object %s does not exists", delta.ObjectSha)
+/*
+The offset of an OBJ_OFS_DELTA base is encoded with a variable length
+where each continuation adds one before shifting, so that no two
+encodings map to the same offset.
+*/
+func readOffsetDeltaBase(packFile []byte) (int64, int) {
+	read := 0
+	c := packFile[read]
+	read++
+	offset := int64(c & sizeMask)
+	for c&msbMask != 0 {
+		offset++
+		c = packFile[read]
+		read++
+		offset = (offset << 7) + int64(c&sizeMask)
 	}
+	return offset, read
+}
 
-	baseObjectStr, err := r.ReadObject(delta.ObjectSha)
-	idx := FindNull(baseObjectStr)
-	var (
-		objectType string
-		size       int
-	)
-	fmt.Sscanf(string(baseObjectStr[:idx]), "%s %d", &objectType, &size)
-	baseObject := []byte(baseObjectStr[idx+1:])
-	if err != nil {
-		return fmt.Errorf("applyObjectDelta: error reading %s, %s", delta.ObjectSha, err)
-	}
+func hashObject(objType string, content []byte) (string, error) {
+	object := bytes.Buffer{}
+	object.WriteString(fmt.Sprintf("%s %d", objType, len(content)))
+	object.WriteByte(0)
+	object.Write(content)
+	return CreateSha1Hex(object.Bytes())
+}
 
+// applyDelta rebuilds an object from its base and a copy/insert delta,
+// instructions reaching outside of the base or the delta are rejected
+func applyDelta(baseObject []byte, delta []byte) ([]byte, error) {
 	bytesRead := 0
-	expectedBaseSize, read := readVariableObjectSize(delta.Content[bytesRead:], 7, int64(delta.Content[bytesRead]&sizeMask))
+	expectedBaseSize, read, err := readDeltaSize(delta[bytesRead:])
+	if err != nil {
+		return nil, err
+	}
 	bytesRead += read
-	bytesRead += 1
 
-	if len(baseObject) != int(expectedBaseSize) {
-		return fmt.Errorf("applyObjectDelta: bad delta header, wrong size expected %v, is %v", len(baseObject), int(expectedBaseSize))
+	if int64(len(baseObject)) != expectedBaseSize {
+		return nil, fmt.Errorf("bad delta header, wrong size expected %v, is %v", expectedBaseSize, len(baseObject))
 	}
 
-	expectedSize, read := readVariableObjectSize(delta.Content[bytesRead:], 7, int64(delta.Content[bytesRead]&sizeMask))
+	expectedSize, read, err := readDeltaSize(delta[bytesRead:])
+	if err != nil {
+		return nil, err
+	}
 	bytesRead += read
-	bytesRead += 1
 
 	buffer := bytes.Buffer{}
-	for bytesRead < len(delta.Content) {
-		opcode := delta.Content[bytesRead]
+	for bytesRead < len(delta) {
+		opcode := delta[bytesRead]
 		bytesRead++
 		if opcode&0x80 != 0 {
 			var argument uint64
 			for bit := 0; bit < 7; bit++ {
 				if opcode&(1<<bit) != 0 {
-					argument += uint64(delta.Content[bytesRead]) << (bit * 8)
+					if bytesRead >= len(delta) {
+						return nil, errors.New("truncated copy instruction")
+					}
+					argument += uint64(delta[bytesRead]) << (bit * 8)
 					bytesRead++
 				}
 			}
@@ -185,40 +314,91 @@ func ApplyObjectDelta(r LocalRepository, delta GitObjectDelta) error {
 			if size == 0 {
 				size = 0x10000
 			}
+			if offset+size > uint64(len(baseObject)) {
+				return nil, fmt.Errorf("copy instruction out of base bounds, offset %v size %v base %v", offset, size, len(baseObject))
+			}
 			buffer.Write(baseObject[offset : offset+size])
-		} else {
+		} else if opcode != 0 {
 			size := int(opcode & 0x7F)
-			buffer.Write(delta.Content[bytesRead : bytesRead+size])
+			if bytesRead+size > len(delta) {
+				return nil, fmt.Errorf("insert instruction out of delta bounds, size %v remaining %v", size, len(delta)-bytesRead)
+			}
+			buffer.Write(delta[bytesRead : bytesRead+size])
 			bytesRead += size
+		} else {
+			return nil, errors.New("reserved delta opcode 0")
+		}
+		if int64(buffer.Len()) > expectedSize {
+			return nil, fmt.Errorf("delta result larger than expected size %v", expectedSize)
 		}
 	}
 	undeltifiedObject := buffer.Bytes()
-	if int(expectedSize) != len(undeltifiedObject) {
-		return fmt.Errorf("applyObjectDelta: bad delta header, wrong size expected %v, is %v", int(expectedSize), len(undeltifiedObject))
+	if expectedSize != int64(len(undeltifiedObject)) {
+		return nil, fmt.Errorf("bad delta header, wrong size expected %v, is %v", expectedSize, len(undeltifiedObject))
 	}
-	err = r.WriteObjectWithType(objectType, undeltifiedObject)
-	if err != nil {
-		return err
+	return undeltifiedObject, nil
+}
+
+// readDeltaSize reads the little-endian base 128 sizes starting a delta
+func readDeltaSize(delta []byte) (int64, int, error) {
+	size := int64(0)
+	shift := 0
+	for i, b := range delta {
+		size |= int64(b&sizeMask) << shift
+		if b&msbMask == 0 {
+			return size, i + 1, nil
+		}
+		shift += 7
+		if shift > 56 {
+			return 0, 0, errors.New("delta size too large")
+		}
 	}
-	return nil
+	return 0, 0, errors.New("truncated delta header")
+}
 
+// encodePackEntry returns a non delta pack entry, its type and size header followed by the compressed content
+func encodePackEntry(objType string, content []byte) ([]byte, error) {
+	packType, err := parsePackFileObjectType(objType)
+	if err != nil {
+		return nil, err
+	}
+	entry := bytes.Buffer{}
+	entry.Write(encodeObjectHeader(packType, int64(len(content))))
+	writer := zlib.NewWriter(&entry)
+	_, err = writer.Write(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write to zlib writer, %v", err)
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to close zlib writer, %v", err)
+	}
+	return entry.Bytes(), nil
 }
 
-func readObjectContent(packfile []byte) (int, []byte, error) {
-	b := bytes.NewReader(packfile)
+// encodeObjectHeader is the reverse of readObjectHeaders, 4 bits of size in the first byte then 7 bits per byte
+func encodeObjectHeader(objType PackFileObjectType, size int64) []byte {
+	header := []byte{byte(objType)<<4 | byte(size)&initSizeMask}
+	size >>= 4
+	for size > 0 {
+		header[len(header)-1] |= msbMask
+		header = append(header, byte(size)&sizeMask)
+		size >>= 7
+	}
+	return header
+}
 
-	r, err := zlib.NewReader(b)
+func readObjectContent(stream io.Reader) ([]byte, error) {
+	r, err := zlib.NewReader(stream)
 	if err != nil {
-		return 0, nil, fmt.Errorf("readPackFileObject failed to init zlib reader, %v", err)
+		return nil, fmt.Errorf("readPackFileObject failed to init zlib reader, %v", err)
 	}
 	defer r.Close()
 	content, err := io.ReadAll(r)
 	if err != nil {
-		return 0, nil, fmt.Errorf("readPackFileObject failed to read zlib stream, %v", err)
+		return nil, fmt.Errorf("readPackFileObject failed to read zlib stream, %v", err)
 	}
-	bytesRead := int(b.Size()) - b.Len()
-	return bytesRead, content, nil
-
+	return content, nil
 }
 
 func parseGitObjectName(objType PackFileObjectType) (string, error) {
@@ -234,3 +414,12 @@ func parseGitObjectName(objType PackFileObjectType) (string, error) {
 	}
 	return "", errors.New("invalid PackFileObjectType code")
 }
+
+func parsePackFileObjectType(objName string) (PackFileObjectType, error) {
+	for _, objType := range []PackFileObjectType{OBJ_COMMIT, OBJ_TREE, OBJ_BLOB, OBJ_TAG} {
+		if name, _ := parseGitObjectName(objType); name == objName {
+			return objType, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid git object name %v", objName)
+}
@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// https://git-scm.com/docs/pack-format#_version_2_pack_idx_files_support_packs_larger_than_4_gib_and
+const (
+	packIndexMagic      = "\377tOc"
+	packIndexVersion    = 2
+	packIndexHeaderSize = 8
+	packIndexFanoutSize = 256 * 4
+	largeOffsetFlag     = uint32(0x80000000)
+)
+
+type PackIndex struct {
+	Shas    []string
+	Crcs    []uint32
+	Offsets []int64
+	PackSha string
+}
+
+func ReadPackIndex(filename string) (*PackIndex, error) {
+	file, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pack index %v, %v", filename, err)
+	}
+	if len(file) < packIndexHeaderSize+packIndexFanoutSize+40 {
+		return nil, fmt.Errorf("invalid pack index %v, file too small", filename)
+	}
+	if string(file[:4]) != packIndexMagic || binary.BigEndian.Uint32(file[4:8]) != packIndexVersion {
+		return nil, fmt.Errorf("invalid pack index %v, only version 2 is supported", filename)
+	}
+	nbObjects := int(binary.BigEndian.Uint32(file[packIndexHeaderSize+packIndexFanoutSize-4:]))
+
+	shasStart := packIndexHeaderSize + packIndexFanoutSize
+	crcsStart := shasStart + nbObjects*20
+	offsetsStart := crcsStart + nbObjects*4
+	largeOffsetsStart := offsetsStart + nbObjects*4
+	if len(file) < largeOffsetsStart+40 {
+		return nil, fmt.Errorf("invalid pack index %v, truncated tables", filename)
+	}
+
+	index := &PackIndex{
+		Shas:    make([]string, nbObjects),
+		Crcs:    make([]uint32, nbObjects),
+		Offsets: make([]int64, nbObjects),
+		PackSha: hex.EncodeToString(file[len(file)-40 : len(file)-20]),
+	}
+	for i := 0; i < nbObjects; i++ {
+		index.Shas[i] = hex.EncodeToString(file[shasStart+i*20 : shasStart+(i+1)*20])
+		index.Crcs[i] = binary.BigEndian.Uint32(file[crcsStart+i*4:])
+		offset := binary.BigEndian.Uint32(file[offsetsStart+i*4:])
+		if offset&largeOffsetFlag == 0 {
+			index.Offsets[i] = int64(offset)
+			continue
+		}
+		largeOffset := largeOffsetsStart + int(offset&^largeOffsetFlag)*8
+		if len(file) < largeOffset+8+40 {
+			return nil, fmt.Errorf("invalid pack index %v, large offset out of range", filename)
+		}
+		index.Offsets[i] = int64(binary.BigEndian.Uint64(file[largeOffset:]))
+	}
+	return index, nil
+}
+
+type PackIndexEntry struct {
+	Sha    string
+	Crc32  uint32
+	Offset int64
+}
+
+// NewPackIndex sorts the entries of a pack by sha, as expected by the .idx format
+func NewPackIndex(packSha string, entries []PackIndexEntry) *PackIndex {
+	sorted := append([]PackIndexEntry{}, entries...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Sha < sorted[j].Sha
+	})
+	index := &PackIndex{
+		Shas:    make([]string, len(sorted)),
+		Crcs:    make([]uint32, len(sorted)),
+		Offsets: make([]int64, len(sorted)),
+		PackSha: packSha,
+	}
+	for i, entry := range sorted {
+		index.Shas[i] = entry.Sha
+		index.Crcs[i] = entry.Crc32
+		index.Offsets[i] = entry.Offset
+	}
+	return index
+}
+
+func (index *PackIndex) Contains(hashHex string) bool {
+	_, found := index.Find(hashHex)
+	return found
+}
+
+// Find returns the pack offset of an object with a binary search on the sorted shas
+func (index *PackIndex) Find(hashHex string) (int64, bool) {
+	i := sort.SearchStrings(index.Shas, hashHex)
+	if i < len(index.Shas) && index.Shas[i] == hashHex {
+		return index.Offsets[i], true
+	}
+	return 0, false
+}
+
+func WritePackIndex(filename string, index *PackIndex) error {
+	buffer := bytes.Buffer{}
+	buffer.WriteString(packIndexMagic)
+	binary.Write(&buffer, binary.BigEndian, uint32(packIndexVersion))
+
+	shas := make([][]byte, len(index.Shas))
+	var fanout [256]uint32
+	for i, hashHex := range index.Shas {
+		sha, err := hex.DecodeString(hashHex)
+		if err != nil || len(sha) != 20 {
+			return fmt.Errorf("invalid object sha %v", hashHex)
+		}
+		if i > 0 && index.Shas[i-1] >= hashHex {
+			return fmt.Errorf("pack index shas are not sorted at %v", hashHex)
+		}
+		shas[i] = sha
+		fanout[sha[0]]++
+	}
+	count := uint32(0)
+	for i := range fanout {
+		count += fanout[i]
+		fanout[i] = count
+	}
+	binary.Write(&buffer, binary.BigEndian, fanout)
+
+	for _, sha := range shas {
+		buffer.Write(sha)
+	}
+	binary.Write(&buffer, binary.BigEndian, index.Crcs)
+
+	// offsets not fitting in 31 bits are stored in a trailing 64-bit table
+	largeOffsets := []uint64{}
+	for _, offset := range index.Offsets {
+		if offset < int64(largeOffsetFlag) {
+			binary.Write(&buffer, binary.BigEndian, uint32(offset))
+			continue
+		}
+		binary.Write(&buffer, binary.BigEndian, largeOffsetFlag|uint32(len(largeOffsets)))
+		largeOffsets = append(largeOffsets, uint64(offset))
+	}
+	binary.Write(&buffer, binary.BigEndian, largeOffsets)
+
+	packSha, err := hex.DecodeString(index.PackSha)
+	if err != nil || len(packSha) != 20 {
+		return fmt.Errorf("invalid pack sha %v", index.PackSha)
+	}
+	buffer.Write(packSha)
+	checksum := sha1.Sum(buffer.Bytes())
+	buffer.Write(checksum[:])
+
+	err = os.WriteFile(filename, buffer.Bytes(), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write pack index %v, %v", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,476 @@
+package internal
+
+import (
+	"bufio"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// largest header is a 10 bytes size, a 10 bytes ofs delta offset or a 20 bytes ref delta sha
+const maxPackEntryHeaderSize = 32
+
+type packEntry struct {
+	ObjectType  PackFileObjectType
+	ContentSize int64
+	DataOffset  int64
+	BaseSha     string
+	BaseOffset  int64
+}
+
+func (r *LocalRepository) PacksName() string {
+	return r.ObjectsName() + "/pack"
+}
+
+// PackFiles returns the .pack files having a matching .idx file
+func (r *LocalRepository) PackFiles() ([]string, error) {
+	indexes, err := filepath.Glob(filepath.Join(r.PacksName(), "*.idx"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pack indexes, %v", err)
+	}
+	packs := []string{}
+	for _, index := range indexes {
+		pack := strings.TrimSuffix(index, ".idx") + ".pack"
+		if _, err := os.Stat(pack); err == nil {
+			packs = append(packs, pack)
+		}
+	}
+	return packs, nil
+}
+
+// WritePackFile streams a pack to objects/pack while decoding it, then resolves its
+// deltas from the stored file to generate the .idx
+func (r *LocalRepository) WritePackFile(reader io.Reader, handler PackFileHandler) (*PackIndex, error) {
+	err := os.MkdirAll(r.PacksName(), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dir %v, %v", r.PacksName(), err)
+	}
+	tmpFile, err := os.CreateTemp(r.PacksName(), "tmp_pack_")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary pack, %v", err)
+	}
+	defer func() {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+	}()
+
+	entries := []PackIndexEntry{}
+	deltas := []GitObjectDelta{}
+	packSha, err := ReadPackFile(io.TeeReader(reader, tmpFile), PackFileHandler{
+		OnHeader: handler.OnHeader,
+		OnObject: func(object GitObject) error {
+			sha, err := hashObject(object.ObjectName, object.Content)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, PackIndexEntry{Sha: sha, Crc32: object.Crc32, Offset: object.Offset})
+			if handler.OnObject != nil {
+				return handler.OnObject(object)
+			}
+			return nil
+		},
+		OnDelta: func(delta GitObjectDelta) error {
+			if handler.OnDelta != nil {
+				err := handler.OnDelta(delta)
+				if err != nil {
+					return err
+				}
+			}
+			// content is read back from the stored pack once every base is received
+			delta.Content = nil
+			deltas = append(deltas, delta)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pack, %v", err)
+	}
+
+	objects := &packObjectReader{repo: r, file: tmpFile, offsets: map[string]int64{}, external: map[string]bool{}}
+	for _, entry := range entries {
+		objects.offsets[entry.Sha] = entry.Offset
+	}
+	// a ref delta base can be another delta placed later in the pack, so resolve
+	// the deltas whose base is known until nothing changes
+	pending := deltas
+	for len(pending) > 0 {
+		remaining := []GitObjectDelta{}
+		for _, delta := range pending {
+			objType, content, err := objects.readAt(delta.Offset)
+			if errors.Is(err, errMissingDeltaBase) {
+				remaining = append(remaining, delta)
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve delta at offset %v, %v", delta.Offset, err)
+			}
+			sha, err := hashObject(objType, content)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, PackIndexEntry{Sha: sha, Crc32: delta.Crc32, Offset: delta.Offset})
+			objects.offsets[sha] = delta.Offset
+		}
+		if len(remaining) == len(pending) {
+			_, _, err := objects.readAt(remaining[0].Offset)
+			return nil, fmt.Errorf("failed to resolve %v deltas, %v", len(remaining), err)
+		}
+		pending = remaining
+	}
+
+	// thin packs reference bases from the local store, they are appended so the pack is self contained
+	if len(objects.external) > 0 {
+		packSha, err = completeThinPack(r, tmpFile, len(entries), objects.external, &entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+	index := NewPackIndex(packSha, entries)
+	err = r.installPack(tmpFile.Name(), index)
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// installPack moves a complete temporary pack to its final name and writes its .idx
+func (r *LocalRepository) installPack(tmpName string, index *PackIndex) error {
+	// the directory modification time can miss a pack written in the same tick as the last load
+	defer r.invalidatePacks()
+	packName := filepath.Join(r.PacksName(), "pack-"+index.PackSha)
+	err := os.Rename(tmpName, packName+".pack")
+	if err != nil {
+		return fmt.Errorf("failed to write pack %v, %v", packName, err)
+	}
+	// the index is written last, a pack is only visible once its .idx exists
+	return WritePackIndex(packName+".idx", index)
+}
+
+// loadedPack is a pack file with its index read in memory
+type loadedPack struct {
+	name  string
+	index *PackIndex
+}
+
+// loadPacks reads the pack indexes once, they are read again only when objects/pack is
+// modified by a new pack or a removed one
+func (r *LocalRepository) loadPacks() ([]loadedPack, error) {
+	info, err := os.Stat(r.PacksName())
+	if os.IsNotExist(err) {
+		r.invalidatePacks()
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %v, %v", r.PacksName(), err)
+	}
+	if !r.packsModTime.IsZero() && info.ModTime().Equal(r.packsModTime) {
+		return r.packs, nil
+	}
+	files, err := r.PackFiles()
+	if err != nil {
+		return nil, err
+	}
+	packs := make([]loadedPack, 0, len(files))
+	for _, pack := range files {
+		index, err := ReadPackIndex(strings.TrimSuffix(pack, ".pack") + ".idx")
+		if err != nil {
+			return nil, err
+		}
+		packs = append(packs, loadedPack{name: pack, index: index})
+	}
+	r.packs, r.packsModTime = packs, info.ModTime()
+	return packs, nil
+}
+
+// invalidatePacks makes the next lookup read the pack indexes again, it is called whenever a pack
+// is added or removed by this repository
+func (r *LocalRepository) invalidatePacks() {
+	r.packs, r.packsModTime = nil, time.Time{}
+}
+
+func (r *LocalRepository) findPackedObject(hashHex string) (loadedPack, int64, bool, error) {
+	packs, err := r.loadPacks()
+	if err != nil {
+		return loadedPack{}, 0, false, err
+	}
+	for _, pack := range packs {
+		if offset, found := pack.index.Find(hashHex); found {
+			return pack, offset, true, nil
+		}
+	}
+	return loadedPack{}, 0, false, nil
+}
+
+func (r *LocalRepository) packedObjectExists(hashHex string) bool {
+	_, _, found, err := r.findPackedObject(hashHex)
+	return err == nil && found
+}
+
+// readPackedObject reads an object from the packs, depth is the length of the delta chain
+// already followed when it is the base of a delta from another pack
+func (r *LocalRepository) readPackedObject(hashHex string, depth int) (string, []byte, error) {
+	pack, offset, found, err := r.findPackedObject(hashHex)
+	if err != nil {
+		return "", nil, err
+	}
+	if !found {
+		return "", nil, fmt.Errorf("object does not exists %s", hashHex)
+	}
+	file, err := os.Open(pack.name)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to open pack %v, %v", pack.name, err)
+	}
+	defer file.Close()
+
+	objects := &packObjectReader{repo: r, file: file, index: pack.index, depth: depth}
+	objType, content, err := objects.readAt(offset)
+	// the error of a delta base is reported once by the object read first
+	if err != nil && depth == 0 {
+		return "", nil, fmt.Errorf("failed to read %v from pack %v, %v", hashHex, pack.name, err)
+	}
+	return objType, content, err
+}
+
+// readDeltaBase reads a ref delta base from the local store, a packed base can be in the same
+// pack or in another one, its delta chain goes on from depth
+func (r *LocalRepository) readDeltaBase(hashHex string, depth int) (string, []byte, error) {
+	if r.looseObjectExists(hashHex) {
+		return r.ReadObjectWithType(hashHex)
+	}
+	return r.readPackedObject(hashHex, depth)
+}
+
+// number of inflated objects kept by a packObjectReader, so delta chains do not inflate their bases again
+const maxCachedPackObjects = 256
+
+// longest delta chain followed, like the --depth limit of git pack-objects, a longer chain is a
+// corrupt pack whose ref delta bases loop back
+const maxDeltaChainLength = 4095
+
+var errMissingDeltaBase = errors.New("missing delta base")
+
+type cachedPackObject struct {
+	objType string
+	content []byte
+}
+
+// packObjectReader reads the objects of a single pack by offset
+type packObjectReader struct {
+	repo *LocalRepository
+	file io.ReaderAt
+	// offsets of the pack objects by sha, to find ref delta bases while the .idx is not written
+	offsets map[string]int64
+	// the .idx of an installed pack, to find ref delta bases in the same pack
+	index *PackIndex
+	// ref delta bases read from the local store when not nil
+	external map[string]bool
+	cache    map[int64]cachedPackObject
+	// length of the delta chain followed before reading from this pack
+	depth int
+}
+
+// readAt inflates the object stored at offset, following ofs and ref delta bases
+func (p *packObjectReader) readAt(offset int64) (string, []byte, error) {
+	return p.readChainAt(offset, p.depth)
+}
+
+func (p *packObjectReader) readChainAt(offset int64, depth int) (string, []byte, error) {
+	if cached, ok := p.cache[offset]; ok {
+		return cached.objType, cached.content, nil
+	}
+	objType, content, err := p.inflateAt(offset, depth)
+	if err != nil {
+		return "", nil, err
+	}
+	if p.cache == nil {
+		p.cache = map[int64]cachedPackObject{}
+	}
+	if len(p.cache) >= maxCachedPackObjects {
+		for cachedOffset := range p.cache {
+			delete(p.cache, cachedOffset)
+			break
+		}
+	}
+	p.cache[offset] = cachedPackObject{objType: objType, content: content}
+	return objType, content, nil
+}
+
+func (p *packObjectReader) inflateAt(offset int64, depth int) (string, []byte, error) {
+	entry, err := readPackEntryHeader(p.file, offset)
+	if err != nil {
+		return "", nil, err
+	}
+	if (entry.ObjectType == OBJ_OFS_DELTA || entry.ObjectType == OBJ_REF_DELTA) && depth >= maxDeltaChainLength {
+		return "", nil, fmt.Errorf("delta chain longer than %v at offset %v, delta bases may loop", maxDeltaChainLength, offset)
+	}
+	content, err := inflatePackEntry(p.file, entry)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch entry.ObjectType {
+	case OBJ_COMMIT, OBJ_TREE, OBJ_BLOB, OBJ_TAG:
+		objName, err := parseGitObjectName(entry.ObjectType)
+		if err != nil {
+			return "", nil, err
+		}
+		return objName, content, nil
+	case OBJ_OFS_DELTA:
+		baseType, base, err := p.readChainAt(entry.BaseOffset, depth+1)
+		if err != nil {
+			return "", nil, err
+		}
+		object, err := applyDelta(base, content)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to apply delta at offset %v, %v", offset, err)
+		}
+		return baseType, object, nil
+	case OBJ_REF_DELTA:
+		var (
+			baseType string
+			base     []byte
+		)
+		if baseOffset, ok := p.baseOffset(entry.BaseSha); ok {
+			baseType, base, err = p.readChainAt(baseOffset, depth+1)
+		} else if p.repo.ObjectExists(entry.BaseSha) {
+			baseType, base, err = p.repo.readDeltaBase(entry.BaseSha, depth+1)
+			if p.external != nil {
+				p.external[entry.BaseSha] = true
+			}
+		} else {
+			return "", nil, fmt.Errorf("%w %v for delta at offset %v", errMissingDeltaBase, entry.BaseSha, offset)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		object, err := applyDelta(base, content)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to apply delta at offset %v, %v", offset, err)
+		}
+		return baseType, object, nil
+	}
+	return "", nil, fmt.Errorf("invalid object type %v at offset %v", entry.ObjectType, offset)
+}
+
+func (p *packObjectReader) baseOffset(sha string) (int64, bool) {
+	if p.index != nil {
+		return p.index.Find(sha)
+	}
+	offset, ok := p.offsets[sha]
+	return offset, ok
+}
+
+func readPackEntryHeader(file io.ReaderAt, offset int64) (*packEntry, error) {
+	buffer := make([]byte, maxPackEntryHeaderSize)
+	n, err := file.ReadAt(buffer, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read entry header at offset %v, %v", offset, err)
+	}
+	buffer = buffer[:n]
+	if len(buffer) < 2 {
+		return nil, fmt.Errorf("truncated entry header at offset %v", offset)
+	}
+
+	headers, err := readObjectHeaders(buffer)
+	if err != nil {
+		return nil, err
+	}
+	entry := &packEntry{
+		ObjectType:  headers.ObjectType,
+		ContentSize: headers.ContentSize,
+		DataOffset:  offset + int64(headers.HeaderSize),
+	}
+	switch headers.ObjectType {
+	case OBJ_OFS_DELTA:
+		negativeOffset, read := readOffsetDeltaBase(buffer[headers.HeaderSize:])
+		entry.BaseOffset = offset - negativeOffset
+		entry.DataOffset += int64(read)
+		if negativeOffset <= 0 || entry.BaseOffset < 12 {
+			return nil, fmt.Errorf("invalid ofs delta base offset %v at offset %v", entry.BaseOffset, offset)
+		}
+	case OBJ_REF_DELTA:
+		if len(buffer) < headers.HeaderSize+20 {
+			return nil, fmt.Errorf("truncated ref delta header at offset %v", offset)
+		}
+		entry.BaseSha = hex.EncodeToString(buffer[headers.HeaderSize : headers.HeaderSize+20])
+		entry.DataOffset += 20
+	}
+	return entry, nil
+}
+
+func inflatePackEntry(file io.ReaderAt, entry *packEntry) ([]byte, error) {
+	section := io.NewSectionReader(file, entry.DataOffset, math.MaxInt64-entry.DataOffset)
+	reader, err := zlib.NewReader(bufio.NewReader(section))
+	if err != nil {
+		return nil, fmt.Errorf("failed to init zlib reader at offset %v, %v", entry.DataOffset, err)
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read zlib stream at offset %v, %v", entry.DataOffset, err)
+	}
+	if int64(len(content)) != entry.ContentSize {
+		return nil, fmt.Errorf("object at offset %v has bad length, expected %v, has %v", entry.DataOffset, entry.ContentSize, len(content))
+	}
+	return content, nil
+}
+
+// completeThinPack appends the external delta bases to a pack received as thin, then
+// rewrites its object count and trailer, it returns the new pack checksum
+func completeThinPack(r *LocalRepository, file *os.File, nbObjects int, external map[string]bool, entries *[]PackIndexEntry) (string, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to stat pack, %v", err)
+	}
+	// the previous trailer is overwritten by the appended objects
+	offset := info.Size() - 20
+	for sha := range external {
+		objType, content, err := r.ReadObjectWithType(sha)
+		if err != nil {
+			return "", err
+		}
+		entry, err := encodePackEntry(objType, content)
+		if err != nil {
+			return "", err
+		}
+		_, err = file.WriteAt(entry, offset)
+		if err != nil {
+			return "", fmt.Errorf("failed to append base %v to pack, %v", sha, err)
+		}
+		*entries = append(*entries, PackIndexEntry{Sha: sha, Crc32: crc32.ChecksumIEEE(entry), Offset: offset})
+		offset += int64(len(entry))
+		nbObjects++
+	}
+	err = file.Truncate(offset)
+	if err != nil {
+		return "", fmt.Errorf("failed to truncate pack, %v", err)
+	}
+
+	count := make([]byte, 4)
+	binary.BigEndian.PutUint32(count, uint32(nbObjects))
+	_, err = file.WriteAt(count, 8)
+	if err != nil {
+		return "", fmt.Errorf("failed to update pack header, %v", err)
+	}
+	hasher := sha1.New()
+	_, err = io.Copy(hasher, io.NewSectionReader(file, 0, offset))
+	if err != nil {
+		return "", fmt.Errorf("failed to hash pack, %v", err)
+	}
+	checksum := hasher.Sum(nil)
+	_, err = file.WriteAt(checksum, offset)
+	if err != nil {
+		return "", fmt.Errorf("failed to write pack trailer, %v", err)
+	}
+	return hex.EncodeToString(checksum), nil
+}
@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"unicode"
+)
+
+type PackObjectsOptions struct {
+	// number of previous similar objects tried as delta base
+	Window int
+	// longest delta chain
+	Depth int
+	// bases are referenced by their offset in the pack instead of their sha
+	OfsDelta bool
+}
+
+var DefaultPackObjectsOptions = PackObjectsOptions{Window: 10, Depth: 50, OfsDelta: true}
+
+// PackObject is an object to pack, its name is the path used to find similar objects
+type PackObject struct {
+	Sha  string
+	Name string
+}
+
+type packCandidate struct {
+	PackObject
+	objType  string
+	content  []byte
+	nameHash uint32
+	base     *packCandidate
+	delta    []byte
+	depth    int
+	offset   int64
+	written  bool
+}
+
+// https://github.com/git/git/blob/795ea8776befc95ea2becd8020c7a284677b4161/pack-objects.h#L210
+// the last characters of a path weigh the most, so files with the same extension get close hashes
+func packNameHash(name string) uint32 {
+	hash := uint32(0)
+	for _, c := range []byte(name) {
+		if unicode.IsSpace(rune(c)) {
+			continue
+		}
+		hash = (hash >> 2) + (uint32(c) << 24)
+	}
+	return hash
+}
+
+// WritePackObjects writes the given objects of the repository in a new version 2 pack
+// under objects/pack, along with its .idx
+func (r *LocalRepository) WritePackObjects(objects []PackObject, options PackObjectsOptions) (*PackIndex, error) {
+	err := os.MkdirAll(r.PacksName(), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dir %v, %v", r.PacksName(), err)
+	}
+	tmpFile, err := os.CreateTemp(r.PacksName(), "tmp_pack_")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary pack, %v", err)
+	}
+	defer func() {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+	}()
+
+	writer := bufio.NewWriter(tmpFile)
+	packSha, entries, err := r.WritePack(writer, objects, options)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Flush()
+	if err != nil {
+		return nil, fmt.Errorf("failed to write pack, %v", err)
+	}
+
+	index := NewPackIndex(packSha, entries)
+	err = r.installPack(tmpFile.Name(), index)
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// WritePack writes a version 2 pack of objects, each one is deltified against the best of the
+// previous objects of the same type in a window sorted by name hash and size, it returns the
+// pack checksum and the entries of its index
+func (r *LocalRepository) WritePack(writer io.Writer, objects []PackObject, options PackObjectsOptions) (string, []PackIndexEntry, error) {
+	candidates := []*packCandidate{}
+	seen := map[string]bool{}
+	for _, object := range objects {
+		if seen[object.Sha] {
+			continue
+		}
+		seen[object.Sha] = true
+		objType, content, err := r.ReadObjectWithType(object.Sha)
+		if err != nil {
+			return "", nil, err
+		}
+		candidates = append(candidates, &packCandidate{PackObject: object, objType: objType, content: content, nameHash: packNameHash(object.Name)})
+	}
+	findDeltas(candidates, options)
+
+	hasher := sha1.New()
+	output := &countingWriter{writer: io.MultiWriter(writer, hasher)}
+	header := make([]byte, 12)
+	copy(header, "PACK")
+	binary.BigEndian.PutUint32(header[4:], 2)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(candidates)))
+	_, err := output.Write(header)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to write pack header, %v", err)
+	}
+
+	entries := make([]PackIndexEntry, 0, len(candidates))
+	var write func(candidate *packCandidate) error
+	write = func(candidate *packCandidate) error {
+		if candidate.written {
+			return nil
+		}
+		// a base is always written before its deltas
+		if candidate.base != nil {
+			err := write(candidate.base)
+			if err != nil {
+				return err
+			}
+		}
+		candidate.written = true
+		candidate.offset = output.count
+		entry, err := encodeCandidate(candidate, options)
+		if err != nil {
+			return err
+		}
+		_, err = output.Write(entry)
+		if err != nil {
+			return fmt.Errorf("failed to write %v to pack, %v", candidate.Sha, err)
+		}
+		entries = append(entries, PackIndexEntry{Sha: candidate.Sha, Crc32: crc32.ChecksumIEEE(entry), Offset: candidate.offset})
+		return nil
+	}
+	for _, candidate := range candidates {
+		err := write(candidate)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	checksum := hasher.Sum(nil)
+	_, err = writer.Write(checksum)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to write pack trailer, %v", err)
+	}
+	return hex.EncodeToString(checksum), entries, nil
+}
+
+// findDeltas keeps for each object the smallest delta found against the objects before it in the window
+func findDeltas(candidates []*packCandidate, options PackObjectsOptions) {
+	sorted := append([]*packCandidate{}, candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].objType != sorted[j].objType {
+			return sorted[i].objType < sorted[j].objType
+		}
+		if sorted[i].nameHash != sorted[j].nameHash {
+			return sorted[i].nameHash < sorted[j].nameHash
+		}
+		// bigger objects first, deltas removing data are smaller than deltas adding it
+		return len(sorted[i].content) > len(sorted[j].content)
+	})
+
+	for i, target := range sorted {
+		// a delta must at least save half of the object to be worth it
+		maxSize := len(target.content)/2 - 20
+		for j := i - 1; j >= 0 && j >= i-options.Window; j-- {
+			base := sorted[j]
+			if base.objType != target.objType {
+				break
+			}
+			if base.depth >= options.Depth || maxSize <= 0 {
+				continue
+			}
+			if len(base.content) > len(target.content)*32 || len(target.content) > len(base.content)*32 {
+				continue
+			}
+			delta := createDelta(base.content, target.content)
+			if len(delta) < maxSize {
+				maxSize = len(delta)
+				target.base = base
+				target.delta = delta
+				target.depth = base.depth + 1
+			}
+		}
+	}
+}
+
+func encodeCandidate(candidate *packCandidate, options PackObjectsOptions) ([]byte, error) {
+	if candidate.base == nil {
+		return encodePackEntry(candidate.objType, candidate.content)
+	}
+	entry := bytes.Buffer{}
+	if options.OfsDelta {
+		entry.Write(encodeObjectHeader(OBJ_OFS_DELTA, int64(len(candidate.delta))))
+		entry.Write(encodeOffsetDeltaBase(candidate.offset - candidate.base.offset))
+	} else {
+		entry.Write(encodeObjectHeader(OBJ_REF_DELTA, int64(len(candidate.delta))))
+		sha, err := hex.DecodeString(candidate.base.Sha)
+		if err != nil {
+			return nil, fmt.Errorf("invalid object sha %v", candidate.base.Sha)
+		}
+		entry.Write(sha)
+	}
+	writer := zlib.NewWriter(&entry)
+	_, err := writer.Write(candidate.delta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write to zlib writer, %v", err)
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to close zlib writer, %v", err)
+	}
+	return entry.Bytes(), nil
+}
+
+// encodeOffsetDeltaBase is the reverse of readOffsetDeltaBase
+func encodeOffsetDeltaBase(offset int64) []byte {
+	encoded := []byte{byte(offset) & sizeMask}
+	for offset >>= 7; offset > 0; offset >>= 7 {
+		offset--
+		encoded = append([]byte{msbMask | byte(offset)&sizeMask}, encoded...)
+	}
+	return encoded
+}
+
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.count += int64(n)
+	return n, err
+}
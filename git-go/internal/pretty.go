@@ -0,0 +1,293 @@
+package internal
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	PRETTY_ONELINE = "oneline"
+	PRETTY_SHORT   = "short"
+	PRETTY_MEDIUM  = "medium"
+	PRETTY_FULL    = "full"
+	PRETTY_FULLER  = "fuller"
+)
+
+// the length of abbreviated shas
+const abbrevLength = 7
+
+// PrettyCommit formats the message of a commit like git's builtin formats, without the commit
+// line, the message is indented and the result ends with a line feed except for oneline
+// https://git-scm.com/docs/pretty-formats
+func PrettyCommit(format string, commit *Commit) string {
+	if format == PRETTY_ONELINE {
+		return CommitSubject(commit.Message)
+	}
+
+	text := &strings.Builder{}
+	if len(commit.Parents) > 1 {
+		text.WriteString("Merge:")
+		for _, parent := range commit.Parents {
+			text.WriteString(" " + parent[:abbrevLength])
+		}
+		text.WriteString("\n")
+	}
+	writeIdent := func(what string, signature *Signature) {
+		if signature == nil {
+			return
+		}
+		padding := ""
+		if format == PRETTY_FULLER {
+			padding = "    "
+		}
+		fmt.Fprintf(text, "%v: %v%v <%v>\n", what, padding, signature.Name, signature.Email)
+		switch format {
+		case PRETTY_MEDIUM:
+			fmt.Fprintf(text, "Date:   %v\n", FormatDate(signature, ""))
+		case PRETTY_FULLER:
+			fmt.Fprintf(text, "%vDate: %v\n", what, FormatDate(signature, ""))
+		}
+	}
+	writeIdent("Author", commit.Author)
+	if format == PRETTY_FULL || format == PRETTY_FULLER {
+		writeIdent("Commit", commit.Committer)
+	}
+	text.WriteString("\n")
+
+	// like git, each line is right trimmed and indented, leading blank lines are skipped and
+	// short stops at the end of the first paragraph
+	first := true
+	for _, line := range strings.SplitAfter(commit.Message, "\n") {
+		if line == "" {
+			break
+		}
+		line = strings.TrimRight(line, " \t\n\r\v\f")
+		if line == "" {
+			if first {
+				continue
+			}
+			if format == PRETTY_SHORT {
+				break
+			}
+		}
+		first = false
+		if format != PRETTY_SHORT {
+			line = expandTabs(line)
+		}
+		text.WriteString("    " + line + "\n")
+	}
+	return strings.TrimRight(text.String(), " \t\n\r\v\f") + "\n"
+}
+
+// expandTabs replaces tabs with spaces up to the next multiple of 8 characters
+func expandTabs(line string) string {
+	if !strings.Contains(line, "\t") {
+		return line
+	}
+	expanded := &strings.Builder{}
+	for _, char := range line {
+		if char != '\t' {
+			expanded.WriteRune(char)
+			continue
+		}
+		width := utf8.RuneCountInString(expanded.String())
+		expanded.WriteString(strings.Repeat(" ", 8-width%8))
+	}
+	return expanded.String()
+}
+
+// splitMessage returns the subject lines of a message and the body after them, leading blank
+// lines are skipped
+func splitMessage(message string) ([]string, string) {
+	lines := strings.SplitAfter(message, "\n")
+	i := 0
+	for i < len(lines) && lines[i] != "" && strings.TrimSpace(lines[i]) == "" {
+		i++
+	}
+	subject := []string{}
+	for ; i < len(lines) && lines[i] != ""; i++ {
+		line := strings.TrimRight(lines[i], " \t\n\r\v\f")
+		if line == "" {
+			i++
+			break
+		}
+		subject = append(subject, line)
+	}
+	for i < len(lines) && lines[i] != "" && strings.TrimSpace(lines[i]) == "" {
+		i++
+	}
+	return subject, strings.Join(lines[i:], "")
+}
+
+// CommitSubject returns the first paragraph of a commit message on one line
+func CommitSubject(message string) string {
+	subject, _ := splitMessage(message)
+	return strings.Join(subject, " ")
+}
+
+// FormatCommit expands the placeholders of a --format string, unknown placeholders are kept
+// https://git-scm.com/docs/pretty-formats#_pretty_formats
+func FormatCommit(format string, sha string, commit *Commit) string {
+	text := &strings.Builder{}
+	for {
+		i := strings.IndexByte(format, '%')
+		if i < 0 || i == len(format)-1 {
+			text.WriteString(format)
+			return text.String()
+		}
+		text.WriteString(format[:i])
+		format = format[i+1:]
+		expanded, length := formatPlaceholder(format, sha, commit)
+		if length == 0 {
+			text.WriteByte('%')
+			continue
+		}
+		text.WriteString(expanded)
+		format = format[length:]
+	}
+}
+
+// formatPlaceholder expands the placeholder at the start of format, it returns the length of the
+// placeholder, 0 when unknown
+func formatPlaceholder(format string, sha string, commit *Commit) (string, int) {
+	switch format[0] {
+	case 'n':
+		return "\n", 1
+	case '%':
+		return "%", 1
+	case 'H':
+		return sha, 1
+	case 'h':
+		return sha[:abbrevLength], 1
+	case 'T':
+		return commit.Tree, 1
+	case 't':
+		return commit.Tree[:abbrevLength], 1
+	case 'P':
+		return strings.Join(commit.Parents, " "), 1
+	case 'p':
+		parents := make([]string, len(commit.Parents))
+		for i, parent := range commit.Parents {
+			parents[i] = parent[:abbrevLength]
+		}
+		return strings.Join(parents, " "), 1
+	case 's':
+		return CommitSubject(commit.Message), 1
+	case 'b':
+		_, body := splitMessage(commit.Message)
+		return body, 1
+	case 'B':
+		return commit.Message, 1
+	case 'x':
+		if len(format) >= 3 {
+			if value, err := hex.DecodeString(format[1:3]); err == nil {
+				return string(value), 3
+			}
+		}
+	case 'a', 'c':
+		if len(format) < 2 {
+			return "", 0
+		}
+		signature := commit.Author
+		if format[0] == 'c' {
+			signature = commit.Committer
+		}
+		if signature == nil {
+			signature = &Signature{}
+		}
+		switch format[1] {
+		case 'n':
+			return signature.Name, 2
+		case 'e':
+			return signature.Email, 2
+		case 'l':
+			local, _, _ := strings.Cut(signature.Email, "@")
+			return local, 2
+		case 'd':
+			return FormatDate(signature, ""), 2
+		case 'D':
+			return FormatDate(signature, "rfc"), 2
+		case 'r':
+			return FormatDate(signature, "relative"), 2
+		case 't':
+			return FormatDate(signature, "unix"), 2
+		case 'i':
+			return FormatDate(signature, "iso"), 2
+		case 'I':
+			return FormatDate(signature, "iso-strict"), 2
+		case 's':
+			return FormatDate(signature, "short"), 2
+		}
+	}
+	return "", 0
+}
+
+// FormatDate formats the date of a signature in its timezone like git's --date modes: default,
+// rfc, iso, iso-strict, short, unix or relative
+// https://git-scm.com/docs/git-log#Documentation/git-log.txt---dateltformatgt
+func FormatDate(signature *Signature, mode string) string {
+	offset := 0
+	if timezone, err := strconv.Atoi(signature.Timezone); err == nil {
+		offset = (timezone/100*60 + timezone%100) * 60
+	}
+	date := time.Unix(signature.Timestamp, 0).In(time.FixedZone("", offset))
+	switch mode {
+	case "rfc":
+		return date.Format("Mon, 2 Jan 2006 15:04:05 -0700")
+	case "iso":
+		return date.Format("2006-01-02 15:04:05 -0700")
+	case "iso-strict":
+		return date.Format("2006-01-02T15:04:05-07:00")
+	case "short":
+		return date.Format("2006-01-02")
+	case "unix":
+		return strconv.FormatInt(signature.Timestamp, 10)
+	case "relative":
+		return relativeDate(time.Now().Unix() - signature.Timestamp)
+	}
+	return date.Format("Mon Jan 2 15:04:05 2006 -0700")
+}
+
+// relativeDate rounds an age in seconds like git
+func relativeDate(age int64) string {
+	plural := func(count int64, unit string) string {
+		if count == 1 {
+			return fmt.Sprintf("%v %v", count, unit)
+		}
+		return fmt.Sprintf("%v %vs", count, unit)
+	}
+	if age < 0 {
+		return "in the future"
+	}
+	if age < 90 {
+		return plural(age, "second") + " ago"
+	}
+	minutes := (age + 30) / 60
+	if minutes < 90 {
+		return plural(minutes, "minute") + " ago"
+	}
+	hours := (minutes + 30) / 60
+	if hours < 36 {
+		return plural(hours, "hour") + " ago"
+	}
+	days := (hours + 12) / 24
+	switch {
+	case days < 14:
+		return plural(days, "day") + " ago"
+	case days < 70:
+		return plural((days+3)/7, "week") + " ago"
+	case days < 365:
+		return plural((days+15)/30, "month") + " ago"
+	case days < 1825:
+		totalMonths := (days*12*2 + 365) / (365 * 2)
+		if totalMonths%12 == 0 {
+			return plural(totalMonths/12, "year") + " ago"
+		}
+		return plural(totalMonths/12, "year") + ", " + plural(totalMonths%12, "month") + " ago"
+	}
+	return plural((days+183)/365, "year") + " ago"
+}
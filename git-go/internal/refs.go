@@ -0,0 +1,594 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the old value of a ref that must not exist yet
+const ZERO_SHA = "0000000000000000000000000000000000000000"
+
+// the last ~<n>, ^<n> or ^{<type>} suffix of a revision
+var revisionSuffixRegexp = regexp.MustCompile(`(\^\{[a-z]*\}|[~^][0-9]*)$`)
+
+const packedRefsHeader = "# pack-refs with: peeled fully-peeled sorted \n"
+
+func (r *LocalRepository) PackedRefsName() string {
+	return r.GitDir() + "/packed-refs"
+}
+
+// ListRefs returns the sha of every loose and packed ref by full name, loose refs win over packed
+// ones, symbolic refs are resolved
+func (r *LocalRepository) ListRefs() (map[string]string, error) {
+	refs, err := r.readPackedRefs()
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.WalkDir(r.RefsName(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+		name, err := filepath.Rel(r.GitDir(), path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		sha, err := r.ResolveRef(name)
+		if err != nil {
+			return err
+		}
+		if sha != "" {
+			refs[name] = sha
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to list refs, %v", err)
+	}
+	return refs, nil
+}
+
+// https://git-scm.com/docs/git-pack-refs
+func (r *LocalRepository) readPackedRefs() (map[string]string, error) {
+	refs := map[string]string{}
+	file, err := os.Open(r.PackedRefsName())
+	if errors.Is(err, fs.ErrNotExist) {
+		return refs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open packed-refs, %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// comments hold the file traits, lines starting with ^ are the peeled value of the previous tag
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "^") {
+			continue
+		}
+		sha, name, found := strings.Cut(line, " ")
+		if !found {
+			return nil, fmt.Errorf("invalid packed-refs line %q", line)
+		}
+		refs[name] = sha
+	}
+	return refs, scanner.Err()
+}
+
+// ResolveRef follows symbolic refs until a sha, it returns an empty sha for an unborn branch
+func (r *LocalRepository) ResolveRef(name string) (string, error) {
+	for depth := 0; depth < 5; depth++ {
+		content, found, err := r.readLooseRef(name)
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			refs, err := r.readPackedRefs()
+			if err != nil {
+				return "", err
+			}
+			return refs[name], nil
+		}
+		value := strings.TrimSpace(string(content))
+		target, isSymbolic := strings.CutPrefix(value, "ref: ")
+		if !isSymbolic {
+			return value, nil
+		}
+		name = target
+	}
+	return "", fmt.Errorf("too many levels of symbolic refs for %v", name)
+}
+
+// ResolveRevision returns the sha of a full sha, HEAD-like name or ref name, short ref names are
+// searched under refs/, refs/tags/, refs/heads/ and refs/remotes/, followed by any number of
+// ~<n>, ^<n> and ^{<type>} suffixes
+// https://git-scm.com/docs/gitrevisions
+func (r *LocalRepository) ResolveRevision(revision string) (string, error) {
+	if match := revisionSuffixRegexp.FindStringIndex(revision); match != nil && match[0] > 0 {
+		sha, err := r.ResolveRevision(revision[:match[0]])
+		if err != nil {
+			return "", err
+		}
+		sha, err = r.applyRevisionSuffix(sha, revision[match[0]:])
+		if err != nil {
+			return "", fmt.Errorf("unknown revision %v, %v", revision, err)
+		}
+		return sha, nil
+	}
+	if len(revision) == 40 && isHex(revision) {
+		return revision, nil
+	}
+	candidates := []string{}
+	if strings.HasPrefix(revision, "refs/") || (revision != "" && strings.ToUpper(revision) == revision) {
+		candidates = append(candidates, revision)
+	}
+	for _, prefix := range []string{"refs/", "refs/tags/", "refs/heads/", "refs/remotes/"} {
+		candidates = append(candidates, prefix+revision)
+	}
+	candidates = append(candidates, "refs/remotes/"+revision+"/HEAD")
+	for _, name := range candidates {
+		// a short name can also be a directory of refs
+		if info, err := os.Stat(filepath.Join(r.GitDir(), name)); err == nil && info.IsDir() {
+			continue
+		}
+		sha, err := r.ResolveRef(name)
+		if err != nil {
+			return "", err
+		}
+		if sha != "" {
+			return sha, nil
+		}
+	}
+	// like git, a ref wins over an object whose sha starts with the same characters
+	if len(revision) >= minAbbrevLength && len(revision) < 40 && isHex(revision) {
+		return r.expandShortSha(revision)
+	}
+	return "", fmt.Errorf("unknown revision %v", revision)
+}
+
+// readLooseRef returns the content of a loose ref, found is false when the file does not exist
+// or is a directory of refs
+func (r *LocalRepository) readLooseRef(name string) ([]byte, bool, error) {
+	filename := filepath.Join(r.GitDir(), name)
+	content, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		if info, statErr := os.Stat(filename); statErr == nil && info.IsDir() {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("failed to read ref %v, %v", name, err)
+	}
+	return content, true, nil
+}
+
+// ReadSymbolicRef returns the target of a loose symbolic ref, isSymbolic is false for a ref
+// holding a sha or a missing ref
+func (r *LocalRepository) ReadSymbolicRef(name string) (string, bool, error) {
+	content, found, err := r.readLooseRef(name)
+	if err != nil || !found {
+		return "", false, err
+	}
+	target, isSymbolic := strings.CutPrefix(strings.TrimSpace(string(content)), "ref: ")
+	return target, isSymbolic, nil
+}
+
+// WriteSymbolicRef points a symbolic ref like HEAD to a ref under refs/
+// https://git-scm.com/docs/git-symbolic-ref
+func (r *LocalRepository) WriteSymbolicRef(name string, target string) error {
+	if !strings.HasPrefix(target, "refs/") {
+		return fmt.Errorf("refusing to point %v outside of refs/", name)
+	}
+	err := checkRefName(name)
+	if err == nil {
+		err = CheckRefFormat(target, false)
+	}
+	if err != nil {
+		return err
+	}
+	return r.writeLooseRef(name, "ref: "+target+"\n")
+}
+
+// DeleteSymbolicRef removes a symbolic ref, not the ref it points to
+func (r *LocalRepository) DeleteSymbolicRef(name string) error {
+	_, isSymbolic, err := r.ReadSymbolicRef(name)
+	if err != nil {
+		return err
+	}
+	if !isSymbolic {
+		return fmt.Errorf("ref %v is not a symbolic ref", name)
+	}
+	err = os.Remove(filepath.Join(r.GitDir(), name))
+	if err != nil {
+		return fmt.Errorf("failed to delete ref %v, %v", name, err)
+	}
+	return nil
+}
+
+// CheckRefFormat validates a ref name, one level names like HEAD need allowOneLevel
+// https://git-scm.com/docs/git-check-ref-format
+func CheckRefFormat(name string, allowOneLevel bool) error {
+	invalid := func(reason string) error {
+		return fmt.Errorf("'%v' is not a valid ref name, %v", name, reason)
+	}
+	switch {
+	case name == "" || name == "@":
+		return invalid("it is empty or @")
+	case strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") || strings.Contains(name, "//"):
+		return invalid("it has an empty component")
+	case strings.HasSuffix(name, "."):
+		return invalid("it ends with a dot")
+	case strings.Contains(name, ".."):
+		return invalid("it contains ..")
+	case strings.Contains(name, "@{"):
+		return invalid("it contains @{")
+	case !allowOneLevel && !strings.Contains(name, "/"):
+		return invalid("it has a single component")
+	}
+	if strings.ContainsFunc(name, func(c rune) bool {
+		return c < 0x20 || c == 0x7f || strings.ContainsRune(" ~^:?*[\\", c)
+	}) {
+		return invalid("it contains a forbidden character")
+	}
+	for _, component := range strings.Split(name, "/") {
+		if strings.HasPrefix(component, ".") || strings.HasSuffix(component, ".lock") {
+			return invalid("a component starts with a dot or ends with .lock")
+		}
+	}
+	return nil
+}
+
+// checkRefName accepts full names under refs/ and all caps names like HEAD or ORIG_HEAD
+func checkRefName(name string) error {
+	if strings.HasPrefix(name, "refs/") {
+		return CheckRefFormat(name, false)
+	}
+	if name == "" || strings.ContainsFunc(name, func(c rune) bool { return (c < 'A' || c > 'Z') && c != '_' }) {
+		return fmt.Errorf("'%v' is not a valid ref name, it is neither under refs/ nor all caps", name)
+	}
+	return nil
+}
+
+// derefName follows the symbolic refs of a name to the ref holding the sha
+func (r *LocalRepository) derefName(name string) (string, error) {
+	for depth := 0; depth < 5; depth++ {
+		target, isSymbolic, err := r.ReadSymbolicRef(name)
+		if err != nil || !isSymbolic {
+			return name, err
+		}
+		name = target
+	}
+	return "", fmt.Errorf("too many levels of symbolic refs for %v", name)
+}
+
+// UpdateRef points a ref to a sha, through its symbolic refs with deref, oldSha is the
+// expected current value when not empty, ZERO_SHA when the ref must not exist
+// https://git-scm.com/docs/git-update-ref
+func (r *LocalRepository) UpdateRef(name string, newSha string, oldSha string, deref bool) error {
+	var err error
+	if deref {
+		name, err = r.derefName(name)
+		if err != nil {
+			return err
+		}
+	}
+	err = checkRefName(name)
+	if err != nil {
+		return err
+	}
+	if len(newSha) != 40 || !isHex(newSha) || newSha == ZERO_SHA {
+		return fmt.Errorf("invalid sha %v for ref %v", newSha, name)
+	}
+	if !r.ObjectExists(newSha) {
+		return fmt.Errorf("trying to write ref %v with nonexistent object %v", name, newSha)
+	}
+	err = r.checkOldSha(name, oldSha)
+	if err != nil {
+		return err
+	}
+
+	err = r.checkRefConflict(name)
+	if err != nil {
+		return err
+	}
+	return r.writeLooseRef(name, newSha+"\n")
+}
+
+// checkRefConflict fails when a ref to create is inside an existing ref or holds existing refs,
+// a ref can not be both a file and a directory of refs, only the paths of the ref are looked up
+func (r *LocalRepository) checkRefConflict(name string) error {
+	conflict := func(other string) error {
+		return fmt.Errorf("cannot lock ref '%v', '%v' exists, cannot create '%v'", name, other, name)
+	}
+	packed, err := r.readPackedRefs()
+	if err != nil {
+		return err
+	}
+	for i := range name {
+		if name[i] != '/' {
+			continue
+		}
+		prefix := name[:i]
+		if info, err := os.Stat(filepath.Join(r.GitDir(), prefix)); err == nil && !info.IsDir() {
+			return conflict(prefix)
+		}
+		if _, isPacked := packed[prefix]; isPacked {
+			return conflict(prefix)
+		}
+	}
+
+	other := ""
+	dir := filepath.Join(r.GitDir(), name)
+	if info, err := os.Stat(dir); err == nil && info.IsDir() {
+		err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || strings.HasSuffix(path, ".lock") {
+				return err
+			}
+			rel, err := filepath.Rel(r.GitDir(), path)
+			other = filepath.ToSlash(rel)
+			if err != nil {
+				return err
+			}
+			return fs.SkipAll
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list refs in %v, %v", name, err)
+		}
+	}
+	for packedName := range packed {
+		if strings.HasPrefix(packedName, name+"/") && (other == "" || packedName < other) {
+			other = packedName
+		}
+	}
+	if other != "" {
+		return conflict(other)
+	}
+	return nil
+}
+
+func (r *LocalRepository) checkOldSha(name string, oldSha string) error {
+	if oldSha == "" {
+		return nil
+	}
+	current, err := r.ResolveRef(name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case oldSha == ZERO_SHA && current != "":
+		return fmt.Errorf("cannot lock ref '%v', reference already exists", name)
+	case oldSha != ZERO_SHA && current == "":
+		return fmt.Errorf("cannot lock ref '%v', unable to resolve reference", name)
+	case oldSha != ZERO_SHA && current != oldSha:
+		return fmt.Errorf("cannot lock ref '%v', is at %v but expected %v", name, current, oldSha)
+	}
+	return nil
+}
+
+func (r *LocalRepository) writeLooseRef(name string, content string) error {
+	filename := filepath.Join(r.GitDir(), name)
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err == nil {
+		err = writeLockedFile(filename, []byte(content))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write ref %v, %v", name, err)
+	}
+	return nil
+}
+
+// DeleteRef removes a loose and packed ref, through its symbolic refs with deref, oldSha is the
+// expected current value when not empty
+func (r *LocalRepository) DeleteRef(name string, oldSha string, deref bool) error {
+	var err error
+	if deref {
+		name, err = r.derefName(name)
+		if err != nil {
+			return err
+		}
+	}
+	err = checkRefName(name)
+	if err != nil {
+		return err
+	}
+	err = r.checkOldSha(name, oldSha)
+	if err != nil {
+		return err
+	}
+
+	packed, err := r.readPackedRefs()
+	if err != nil {
+		return err
+	}
+	if _, isPacked := packed[name]; isPacked {
+		delete(packed, name)
+		err = r.writePackedRefs(packed)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Remove(filepath.Join(r.GitDir(), name))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete ref %v, %v", name, err)
+	}
+	r.removeEmptyRefDirs(name)
+	return nil
+}
+
+// writePackedRefs writes sorted refs with the peeled object of annotated tags
+func (r *LocalRepository) writePackedRefs(refs map[string]string) error {
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	content := strings.Builder{}
+	content.WriteString(packedRefsHeader)
+	for _, name := range names {
+		fmt.Fprintf(&content, "%v %v\n", refs[name], name)
+		peeled := refs[name]
+		for {
+			object, err := r.ReadTypedObject(peeled)
+			if err != nil {
+				return err
+			}
+			tag, isTag := object.(*Tag)
+			if !isTag {
+				break
+			}
+			peeled = tag.Object
+		}
+		if peeled != refs[name] {
+			fmt.Fprintf(&content, "^%v\n", peeled)
+		}
+	}
+	err := writeLockedFile(r.PackedRefsName(), []byte(content.String()))
+	if err != nil {
+		return fmt.Errorf("failed to write packed-refs, %v", err)
+	}
+	return nil
+}
+
+// PackRefs moves the tags and the refs already packed, or every ref with all, to packed-refs,
+// their loose files are removed with prune
+// https://git-scm.com/docs/git-pack-refs
+func (r *LocalRepository) PackRefs(all bool, prune bool) error {
+	packed, err := r.readPackedRefs()
+	if err != nil {
+		return err
+	}
+	loose := []string{}
+	err = filepath.WalkDir(r.RefsName(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+		name, err := filepath.Rel(r.GitDir(), path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		_, isPacked := packed[name]
+		if !all && !isPacked && !strings.HasPrefix(name, "refs/tags/") {
+			return nil
+		}
+		_, isSymbolic, err := r.ReadSymbolicRef(name)
+		if err != nil || isSymbolic {
+			return err
+		}
+		loose = append(loose, name)
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to list refs, %v", err)
+	}
+	for _, name := range loose {
+		packed[name], err = r.ResolveRef(name)
+		if err != nil {
+			return err
+		}
+	}
+	err = r.writePackedRefs(packed)
+	if err != nil || !prune {
+		return err
+	}
+	for _, name := range loose {
+		err = os.Remove(filepath.Join(r.GitDir(), name))
+		if err != nil {
+			return fmt.Errorf("failed to prune ref %v, %v", name, err)
+		}
+		r.removeEmptyRefDirs(name)
+	}
+	return nil
+}
+
+// removeEmptyRefDirs removes the directories left empty by a deleted ref, like git refs/heads
+// and refs/tags are kept
+func (r *LocalRepository) removeEmptyRefDirs(name string) {
+	for dir := path.Dir(name); strings.Count(dir, "/") > 1; dir = path.Dir(dir) {
+		if os.Remove(filepath.Join(r.GitDir(), dir)) != nil {
+			return
+		}
+	}
+}
+
+// applyRevisionSuffix follows first parents with ~<n>, the nth parent with ^<n>, and peels tags
+// with ^{<type>}, ^{} peels to the first non tag object
+func (r *LocalRepository) applyRevisionSuffix(sha string, suffix string) (string, error) {
+	if objType, found := strings.CutPrefix(suffix, "^{"); found {
+		objType = strings.TrimSuffix(objType, "}")
+		for {
+			object, err := r.ReadTypedObject(sha)
+			if err != nil {
+				return "", err
+			}
+			if object.Type() == objType || (objType == "" && object.Type() != "tag") {
+				return sha, nil
+			}
+			switch object := object.(type) {
+			case *Tag:
+				sha = object.Object
+			case *Commit:
+				if objType != "tree" {
+					return "", fmt.Errorf("%v is a commit, not a %v", sha, objType)
+				}
+				sha = object.Tree
+			default:
+				return "", fmt.Errorf("%v is a %v, not a %v", sha, object.Type(), objType)
+			}
+		}
+	}
+
+	count := 1
+	if len(suffix) > 1 {
+		var err error
+		count, err = strconv.Atoi(suffix[1:])
+		if err != nil {
+			return "", err
+		}
+	}
+	sha, err := r.applyRevisionSuffix(sha, "^{commit}")
+	if err != nil {
+		return "", err
+	}
+	if suffix[0] == '^' {
+		if count == 0 {
+			return sha, nil
+		}
+		commit, err := r.ReadCommit(sha)
+		if err != nil {
+			return "", err
+		}
+		if count > len(commit.Parents) {
+			return "", fmt.Errorf("%v has no parent %v", sha, count)
+		}
+		return commit.Parents[count-1], nil
+	}
+	for i := 0; i < count; i++ {
+		commit, err := r.ReadCommit(sha)
+		if err != nil {
+			return "", err
+		}
+		if len(commit.Parents) == 0 {
+			return "", fmt.Errorf("%v has no parent", sha)
+		}
+		sha = commit.Parents[0]
+	}
+	return sha, nil
+}
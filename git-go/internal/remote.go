@@ -1,33 +1,51 @@
 package internal
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
+// GitReference is a ref advertised by a remote repository
 type GitReference struct {
+	// the name of the ref, like HEAD or refs/heads/main
 	Ref    string
 	RefSha string
+	// the ref pointed to by a symbolic ref, from the symref capability
+	Symref string
+	// the object an annotated tag points to, from its ^{} line
+	Peeled string
 }
 
 type RemoteRepository struct {
-	BaseUrl    string
-	httpClient http.Client
+	BaseUrl string
+	// the capabilities sent with the first advertised ref
+	Capabilities []string
+	httpClient   http.Client
 }
 
 type GitObject struct {
-	ObjectName  string
+	ObjectName string
+	Offset     int64
+	// crc32 of the raw pack entry, header included
+	Crc32       uint32
 	Content     []byte
 	ContentSize int64
 }
 
 type GitObjectDelta struct {
-	ObjectSha   string
+	// sha of the base object of an OBJ_REF_DELTA
+	ObjectSha string
+	// pack offset of the base object, 0 for OBJ_REF_DELTA
+	BaseOffset  int64
+	Offset      int64
+	Crc32       uint32
 	Content     []byte
 	ContentSize int64
 }
@@ -61,38 +79,82 @@ func (r *RemoteRepository) DiscoveringReferences() ([]GitReference, error) {
 	}
 
 	defer res.Body.Close()
-	body, err := io.ReadAll(res.Body)
+	body := bufio.NewReader(res.Body)
+	firstBytes, err := body.Peek(5)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read body, %v", err)
 	}
-
-	lines := strings.Split(string(body), "\n")
-	firstBytes := lines[0][:5]
-
-	matched, err := regexp.MatchString("^[0-9a-f]{4}#", firstBytes)
+	matched, err := regexp.Match("^[0-9a-f]{4}#", firstBytes)
 	if err != nil {
-		return nil, fmt.Errorf("failed to regexp.MatchString, %v", err)
+		return nil, fmt.Errorf("failed to regexp.Match, %v", err)
 	}
 	if !matched {
-		return nil, errors.New("clients MUST validate the status code is either 200 OK or 304 Not Modified")
+		return nil, errors.New("clients MUST validate the first five bytes of the response entity matches the regex ^[0-9a-f]{4}#")
 	}
-	serviceName := strings.Split(strings.Split(lines[0], " ")[1], "=")[1]
-	if serviceName != "git-upload-pack" {
+	line, _, err := readPktLine(body)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(line, "\n") != "# service=git-upload-pack" {
 		return nil, errors.New("clients MUST verify the first pkt-line is # service=$servicename")
 	}
+	// the service line is followed by a flush-pkt
+	_, flush, err := readPktLine(body)
+	if err != nil {
+		return nil, err
+	}
+	if !flush {
+		return nil, errors.New("expected a flush-pkt after the service line")
+	}
 
 	refs := []GitReference{}
-	for _, line := range lines[1:] {
-		if strings.HasPrefix(line, "0000") {
+	for first := true; ; first = false {
+		line, flush, err := readPktLine(body)
+		if err != nil {
+			return nil, err
+		}
+		if flush {
+			break
+		}
+		line = strings.TrimSuffix(line, "\n")
+		// the capabilities follow the first ref after a NUL byte
+		if first {
+			var capabilities string
+			line, capabilities, _ = strings.Cut(line, "\x00")
+			r.Capabilities = strings.Fields(capabilities)
+		}
+		sha, name, found := strings.Cut(line, " ")
+		if !found || len(sha) != 40 {
+			return nil, fmt.Errorf("invalid ref line %v", line)
+		}
+		// an empty repository only advertises its capabilities
+		if name == "capabilities^{}" {
 			continue
 		}
-		ref := strings.Split(line, " ")
-		if len(ref) > 1 {
-			refs = append(refs, GitReference{Ref: ref[0], RefSha: ref[1]})
+		if tag, peeled := strings.CutSuffix(name, "^{}"); peeled {
+			if len(refs) > 0 && refs[len(refs)-1].Ref == tag {
+				refs[len(refs)-1].Peeled = sha
+			}
+			continue
+		}
+		refs = append(refs, GitReference{Ref: name, RefSha: sha})
+	}
+
+	for _, capability := range r.Capabilities {
+		value, isSymref := strings.CutPrefix(capability, "symref=")
+		if !isSymref {
+			continue
+		}
+		name, target, _ := strings.Cut(value, ":")
+		for i := range refs {
+			if refs[i].Ref == name {
+				refs[i].Symref = target
+			}
 		}
 	}
 	return refs, nil
 }
+
 func Map[T any](slice []T, fn func(T) T) []T {
 	result := make([]T, len(slice))
 	for i, v := range slice {
@@ -101,45 +163,96 @@ func Map[T any](slice []T, fn func(T) T) []T {
 	return result
 }
 
-// https://git-scm.com/docs/gitprotocol-http/en#_smart_service_git_upload_pack
-// https://stefan.saasen.me/articles/git-clone-in-haskell-from-the-bottom-up/#implementing-ref-discovery
-func (r *RemoteRepository) UploadPack(wants []string) ([]GitObject, []GitObjectDelta, error) {
-	reqBody := strings.Join(Map(wants, func(want string) string {
-		return fmt.Sprintf("0032want %v", want[4:])
-	}), "\n")
-	reqBody += "\n00000009done\n"
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/git-upload-pack", r.BaseUrl), bytes.NewBufferString(reqBody))
-	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
-	req.Header.Set("Accept", "application/x-git-upload-pack-result")
+// https://git-scm.com/docs/protocol-common#_pkt_line_format
+func pktLine(line string) string {
+	if line == "" {
+		return ""
+	}
+	return fmt.Sprintf("%04x%s", len(line)+4, line)
+}
+
+// readPktLine reads the data of a pkt-line, flush is true for a flush-pkt
+// https://git-scm.com/docs/protocol-common#_pkt_line_format
+func readPktLine(reader io.Reader) (string, bool, error) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(reader, header)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error creating request: %v", err)
+		return "", false, fmt.Errorf("failed to read pkt-line, %v", err)
 	}
+	length, err := strconv.ParseUint(string(header), 16, 16)
+	if err != nil || (length > 0 && length < 4) {
+		return "", false, fmt.Errorf("invalid pkt-line length %v", string(header))
+	}
+	if length == 0 {
+		return "", true, nil
+	}
+	data := make([]byte, length-4)
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read pkt-line, %v", err)
+	}
+	return string(data), false, nil
+}
 
-	res, err := r.httpClient.Do(req)
+// FetchPack returns the body of the upload-pack response, positioned at the start of
+// the pack file sent by the server for the wanted shas, with includeTag the annotated tags
+// pointing to the sent objects are added
+func (r *RemoteRepository) FetchPack(wants []string, includeTag bool) (io.ReadCloser, error) {
+	// ofs-delta lets the server reuse OBJ_OFS_DELTA entries
+	capabilities := "ofs-delta"
+	if includeTag {
+		capabilities += " include-tag"
+	}
+	res, err := r.postUploadPack(wantRequest(wants, capabilities) + pktLine("done\n"))
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to send req %v: %v", req.URL, err)
+		return nil, err
 	}
 
-	defer res.Body.Close()
 	packType := make([]byte, 8)
-	_, err = res.Body.Read(packType)
+	_, err = io.ReadFull(res.Body, packType)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read body, %v", err)
+		res.Body.Close()
+		return nil, fmt.Errorf("failed to read body, %v", err)
 	}
 
 	packTypeExpected := []byte{'0', '0', '0', '8', 'N', 'A', 'K', '\n'}
 	if !bytes.Equal(packType, packTypeExpected) {
-		return nil, nil, fmt.Errorf("failed to parse pack, invalid header %v", string(packType))
+		res.Body.Close()
+		return nil, fmt.Errorf("failed to parse pack, invalid header %v", string(packType))
 	}
-	packFileBytes, err := io.ReadAll(res.Body)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read body, %v", err)
+	return res.Body, nil
+}
+
+// wantRequest returns the want lines of a request followed by a flush-pkt, capabilities are sent
+// on the first one
+func wantRequest(wants []string, capabilities string) string {
+	request := ""
+	for i, want := range wants {
+		if i == 0 {
+			request += pktLine(fmt.Sprintf("want %v %v\n", want, capabilities))
+			continue
+		}
+		request += pktLine(fmt.Sprintf("want %v\n", want))
 	}
+	return request + "0000"
+}
 
-	objects, deltas, err := ParsePackFile(packFileBytes)
+// postUploadPack sends a request to the upload-pack service
+func (r *RemoteRepository) postUploadPack(reqBody string) (*http.Response, error) {
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/git-upload-pack", r.BaseUrl), bytes.NewBufferString(reqBody))
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to ParsePackFile, %v", err)
+		return nil, fmt.Errorf("error creating request: %v", err)
 	}
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Accept", "application/x-git-upload-pack-result")
 
-	return objects, deltas, nil
+	res, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send req %v: %v", req.URL, err)
+	}
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return nil, fmt.Errorf("failed to send req %v: %v", req.URL, res.Status)
+	}
+	return res, nil
 }
@@ -0,0 +1,241 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+)
+
+// https://git-scm.com/docs/git-status#_short_format
+const (
+	STATUS_UNMODIFIED = ' '
+	STATUS_MODIFIED   = 'M'
+	STATUS_TYPECHANGE = 'T'
+	STATUS_ADDED      = 'A'
+	STATUS_DELETED    = 'D'
+	STATUS_UNMERGED   = 'U'
+	STATUS_UNTRACKED  = '?'
+)
+
+// StatusEntry is a changed path, Staged compares HEAD and the index, Unstaged the index and the working tree
+type StatusEntry struct {
+	Name     string
+	Staged   byte
+	Unstaged byte
+}
+
+type Status struct {
+	// empty when HEAD is detached
+	Branch string
+	// empty on an unborn branch
+	Head    string
+	Entries []StatusEntry
+}
+
+// Status compares the tree of HEAD, the index and the working tree, untracked directories
+// are reported once with a trailing slash
+func (r *LocalRepository) Status() (*Status, error) {
+	status := &Status{}
+	var err error
+	status.Branch, err = r.CurrentBranch()
+	if err != nil {
+		return nil, err
+	}
+	status.Head, err = r.ResolveRef("HEAD")
+	if err != nil {
+		return nil, err
+	}
+
+	headFiles := map[string]TreeEntry{}
+	if status.Head != "" {
+		treeSha, err := r.peelToTree(status.Head)
+		if err != nil {
+			return nil, err
+		}
+		headFiles, err = r.readTreeFiles(treeSha)
+		if err != nil {
+			return nil, err
+		}
+	}
+	index, err := r.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+	indexInfo, err := os.Stat(r.IndexName())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to stat index, %v", err)
+	}
+	exclude, err := r.ExcludeIgnored(index)
+	if err != nil {
+		return nil, err
+	}
+	workingFiles, err := r.WorkingFiles(".", exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := map[string]*StatusEntry{}
+	change := func(name string) *StatusEntry {
+		if _, ok := changes[name]; !ok {
+			changes[name] = &StatusEntry{Name: name, Staged: STATUS_UNMODIFIED, Unstaged: STATUS_UNMODIFIED}
+		}
+		return changes[name]
+	}
+	tracked := map[string]bool{}
+	for i := range index.Entries {
+		entry := &index.Entries[i]
+		tracked[entry.Name] = true
+		if entry.Stage() != 0 {
+			change(entry.Name).Staged = STATUS_UNMERGED
+			change(entry.Name).Unstaged = STATUS_UNMERGED
+			continue
+		}
+
+		headEntry, inHead := headFiles[entry.Name]
+		if !inHead {
+			change(entry.Name).Staged = STATUS_ADDED
+		} else if headEntry.Sha != entry.Sha || headEntry.Mode != fmt.Sprintf("%o", entry.Mode) {
+			change(entry.Name).Staged = modeChange(headEntry.Mode, fmt.Sprintf("%o", entry.Mode))
+		}
+
+		info, exists := workingFiles[entry.Name]
+		if !exists {
+			if entry.Mode != MODE_GITLINK {
+				change(entry.Name).Unstaged = STATUS_DELETED
+			}
+			continue
+		}
+		modified, err := r.workingFileModified(entry, info, indexInfo)
+		if err != nil {
+			return nil, err
+		}
+		if modified {
+			change(entry.Name).Unstaged = modeChange(fmt.Sprintf("%o", entry.Mode), fmt.Sprintf("%o", fileMode(info)))
+		}
+	}
+	for name := range headFiles {
+		if !tracked[name] {
+			change(name).Staged = STATUS_DELETED
+		}
+	}
+
+	// a directory without tracked files is untracked as a whole
+	trackedDirs := map[string]bool{}
+	for name := range tracked {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			trackedDirs[dir] = true
+		}
+	}
+	for name := range workingFiles {
+		if tracked[name] {
+			continue
+		}
+		untracked := name
+		if workingFiles[name].IsDir() {
+			untracked += "/"
+		}
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			// files of a submodule belong to its own repository
+			if tracked[dir] {
+				untracked = ""
+				break
+			}
+			if !trackedDirs[dir] {
+				untracked = dir + "/"
+			}
+		}
+		if untracked == "" {
+			continue
+		}
+		change(untracked).Staged = STATUS_UNTRACKED
+		change(untracked).Unstaged = STATUS_UNTRACKED
+	}
+
+	for _, entry := range changes {
+		status.Entries = append(status.Entries, *entry)
+	}
+	// like git, untracked files come after the changes
+	sort.Slice(status.Entries, func(i, j int) bool {
+		iUntracked := status.Entries[i].Staged == STATUS_UNTRACKED
+		jUntracked := status.Entries[j].Staged == STATUS_UNTRACKED
+		if iUntracked != jUntracked {
+			return jUntracked
+		}
+		return status.Entries[i].Name < status.Entries[j].Name
+	})
+	return status, nil
+}
+
+// modeChange is a type change between a file, a symlink and a submodule, or a modification
+func modeChange(from string, to string) byte {
+	kind := func(mode string) string {
+		if mode == "100755" || mode == "100664" {
+			return "100644"
+		}
+		return mode
+	}
+	if kind(from) != kind(to) {
+		return STATUS_TYPECHANGE
+	}
+	return STATUS_MODIFIED
+}
+
+// workingFileModified compares a working tree file with its entry, the file is hashed only when its
+// stat data changed or when it was modified in the same second the index was written
+// https://git-scm.com/docs/racy-git
+func (r *LocalRepository) workingFileModified(entry *IndexEntry, info fs.FileInfo, indexInfo fs.FileInfo) (bool, error) {
+	if entry.Mode == MODE_GITLINK {
+		return false, nil
+	}
+	if fileMode(info) != entry.Mode {
+		return true, nil
+	}
+	if entry.StatMatches(info) && !entry.isRacy(indexInfo) {
+		return false, nil
+	}
+	if int64(entry.Size) != info.Size() && info.Mode().IsRegular() {
+		return true, nil
+	}
+	sha, err := r.HashWorkingFile(entry.Name, info, false)
+	if err != nil {
+		return false, err
+	}
+	return sha != entry.Sha, nil
+}
+
+// readTreeFiles returns the non tree entries of a tree and its sub trees by path, the trees must
+// have names that can be written in a working tree
+func (r *LocalRepository) readTreeFiles(treeSha string) (map[string]TreeEntry, error) {
+	files := map[string]TreeEntry{}
+	var walk func(sha string, prefix string) error
+	walk = func(sha string, prefix string) error {
+		tree, err := r.ReadTree(sha)
+		if err != nil {
+			return err
+		}
+		err = checkTreeEntryNames(tree)
+		if err != nil {
+			return fmt.Errorf("tree %v, %v", sha, err)
+		}
+		for _, entry := range tree.Entries {
+			name := prefix + entry.Name
+			if entry.Mode == "40000" {
+				err = walk(entry.Sha, name+"/")
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			files[name] = entry
+		}
+		return nil
+	}
+	err := walk(treeSha, "")
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
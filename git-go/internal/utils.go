@@ -25,3 +25,12 @@ func FindNull(s string) int {
 	}
 	return -1
 }
+
+func isHex(s string) bool {
+	for _, char := range s {
+		if (char < '0' || char > '9') && (char < 'a' || char > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -2,10 +2,17 @@ package test
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -32,7 +39,10 @@ func CleanTestDir(dirName string) {
 func RunCli(cliPath string, dirName string, args ...string) (string, string, int) {
 	cmd := exec.Command(cliPath, args...)
 	cmd.Dir = dirName
+	return RunCommand(cmd)
+}
 
+func RunCommand(cmd *exec.Cmd) (string, string, int) {
 	// Create buffers to capture stdout and stderr
 	var stdoutBuf, stderrBuf bytes.Buffer
 	cmd.Stdout = &stdoutBuf
@@ -59,10 +69,48 @@ func RunMyGitCli(dirName string, args ...string) (string, string, int) {
 	return RunCli(binDirAbs, dirName, args...)
 }
 
+func RunMyGitCliWithStdin(dirName string, stdin string, args ...string) (string, string, int) {
+	binDirAbs, _ := filepath.Abs("../../bin/gitgo")
+	cmd := exec.Command(binDirAbs, args...)
+	cmd.Dir = dirName
+	cmd.Stdin = strings.NewReader(stdin)
+	return RunCommand(cmd)
+}
+
+func RunGitCliWithStdin(dirName string, stdin string, args ...string) (string, string, int) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dirName
+	cmd.Stdin = strings.NewReader(stdin)
+	return RunCommand(cmd)
+}
+
 func RunGitCli(dirName string, args ...string) (string, string, int) {
 	return RunCli("git", dirName, args...)
 }
 
+// ServeGitRepositories serves the bare repositories of a directory over the smart http protocol
+func ServeGitRepositories(dirName string) *httptest.Server {
+	execPath, _, _ := RunGitCli(dirName, "--exec-path")
+	return httptest.NewServer(&cgi.Handler{
+		Path: filepath.Join(strings.TrimSpace(execPath), "git-http-backend"),
+		Env:  []string{"GIT_PROJECT_ROOT=" + dirName, "GIT_HTTP_EXPORT_ALL=1"},
+	})
+}
+
+// SetupRemoteRepository creates a bare repository with a few commits to clone from
+func SetupRemoteRepository(dirName string) {
+	workDir := dirName + "/work"
+	os.Mkdir(workDir, 0755)
+	RunGitCli(workDir, "init", "-b", "main")
+	for i := 1; i <= 3; i++ {
+		os.WriteFile(workDir+"/test_file_1.txt", []byte(strings.Repeat(fmt.Sprintf("hello world %v\n", i), 100)), 0755)
+		RunGitCli(workDir, "add", ".")
+		RunGitCli(workDir, "-c", "user.name=test", "-c", "user.email=test@test.com", "commit", "-m", fmt.Sprintf("commit %v", i))
+	}
+	RunGitCli(dirName, "clone", "--bare", workDir, dirName+"/remote.git")
+	RunGitCli(dirName+"/remote.git", "repack", "-a", "-d")
+}
+
 func TestGitInit(t *testing.T) {
 	dirName := SetupTestDir()
 	defer CleanTestDir(dirName)
@@ -115,6 +163,182 @@ func TestCatFile(t *testing.T) {
 	assert.Equal(t, fileContent, stdout)
 }
 
+func TestCatFilePackedObject(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	RunGitCli(dirName, "init")
+
+	fileName := dirName + "/" + "hellofile.txt"
+	for i := 1; i <= 3; i++ {
+		os.WriteFile(fileName, []byte(strings.Repeat(fmt.Sprintf("Hello world %v !\n", i), 100)), 0755)
+		RunGitCli(dirName, "add", ".")
+		RunGitCli(dirName, "-c", "user.name=test", "-c", "user.email=test@test.com", "commit", "-m", fmt.Sprintf("commit %v", i))
+	}
+	RunGitCli(dirName, "gc", "-q")
+	hash, _, _ := RunGitCli(dirName, "rev-parse", "HEAD~1:hellofile.txt")
+
+	stdout, stderr, errcode := RunMyGitCli(dirName, "cat-file", "-p", strings.TrimSuffix(hash, "\n"))
+	if errcode != 0 {
+		fmt.Println(stderr)
+	}
+
+	assert.Equal(t, strings.Repeat("Hello world 2 !\n", 100), stdout)
+}
+
+func TestCatFileDeltaLoop(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	RunGitCli(dirName, "init")
+	shas := ""
+	lines := ""
+	for i := 1; i <= 300; i++ {
+		lines += fmt.Sprintf("line %v\n", i)
+	}
+	for i := 1; i <= 2; i++ {
+		os.WriteFile(dirName+"/hellofile.txt", []byte(fmt.Sprintf("%vversion %v\n", lines, i)), 0644)
+		hash, _, _ := RunGitCli(dirName, "hash-object", "-w", "hellofile.txt")
+		shas += hash
+	}
+	// without --delta-base-offset the delta references its base by sha
+	packSha, _, _ := RunGitCliWithStdin(dirName, shas, "pack-objects", ".git/objects/pack/pack")
+	RunGitCli(dirName, "prune-packed")
+	packName := dirName + "/.git/objects/pack/pack-" + strings.TrimSuffix(packSha, "\n")
+	verify, _, _ := RunGitCli(dirName, "verify-pack", "-v", packName+".idx")
+	var deltaSha, baseSha string
+	var offset int
+	for _, line := range strings.Split(verify, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 7 {
+			deltaSha, baseSha = fields[0], fields[6]
+			offset, _ = strconv.Atoi(fields[4])
+		}
+	}
+	assert.NotEmpty(t, deltaSha)
+
+	// the delta becomes its own base
+	pack, _ := os.ReadFile(packName + ".pack")
+	base, _ := hex.DecodeString(baseSha)
+	delta, _ := hex.DecodeString(deltaSha)
+	i := bytes.Index(pack[offset:], base)
+	copy(pack[offset+i:], delta)
+	os.WriteFile(packName+".pack", pack, 0644)
+
+	_, stderr, errcode := RunMyGitCli(dirName, "cat-file", "-p", deltaSha)
+	assert.Equal(t, 1, errcode)
+	assert.Contains(t, stderr, "delta chain longer than 4095")
+	stdout, stderr, errcode := RunMyGitCli(dirName, "cat-file", "-p", baseSha)
+	assert.Equal(t, 0, errcode, stderr)
+	assert.True(t, strings.HasPrefix(stdout, lines), stdout)
+}
+
+func TestCatFileShortSha(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	RunGitCli(dirName, "init")
+	// two blobs whose shas share their first 4 characters
+	seen := map[string]string{}
+	var first, second string
+	for i := 0; second == ""; i++ {
+		content := fmt.Sprintf("blob %v\n", i)
+		sha := fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("blob %v\x00%v", len(content), content))))
+		if other, found := seen[sha[:4]]; found {
+			first, second = other, content
+		}
+		seen[sha[:4]] = content
+	}
+	hashes := []string{}
+	for _, content := range []string{first, second} {
+		hash, _, _ := RunGitCliWithStdin(dirName, content, "hash-object", "-w", "--stdin")
+		hashes = append(hashes, strings.TrimSpace(hash))
+	}
+
+	for _, gc := range []bool{false, true} {
+		if gc {
+			RunGitCliWithStdin(dirName, strings.Join(hashes, "\n")+"\n", "pack-objects", ".git/objects/pack/pack")
+			RunGitCli(dirName, "prune-packed")
+		}
+		stdout, stderr, errcode := RunMyGitCli(dirName, "cat-file", "-p", hashes[1][:7])
+		assert.Equal(t, 0, errcode, stderr)
+		assert.Equal(t, second, stdout)
+		_, stderr, errcode = RunMyGitCli(dirName, "cat-file", "-p", hashes[1][:4])
+		assert.Equal(t, 1, errcode)
+		assert.Contains(t, stderr, "short object ID "+hashes[1][:4]+" is ambiguous")
+	}
+}
+
+func TestCatFileModes(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	RunGitCli(dirName, "init")
+	os.WriteFile(dirName+"/test_file_1.txt", []byte("hello world 1"), 0644)
+	os.Mkdir(dirName+"/test_dir_1", 0755)
+	os.WriteFile(dirName+"/test_dir_1/test_file_2.txt", []byte("hello world 2"), 0644)
+	RunGitCli(dirName, "add", ".")
+	RunGitCli(dirName, "-c", "user.name=test", "-c", "user.email=test@test.com", "commit", "-m", "commit 1")
+	treeHash, _, _ := RunGitCli(dirName, "rev-parse", "HEAD^{tree}")
+	treeHash = strings.TrimSuffix(treeHash, "\n")
+
+	for _, args := range [][]string{{"-t", treeHash}, {"-s", treeHash}, {"-p", treeHash}, {"-t", "HEAD"}, {"-p", "HEAD"}} {
+		stdout, stderr, errcode := RunMyGitCli(dirName, append([]string{"cat-file"}, args...)...)
+		assert.Equal(t, 0, errcode, stderr)
+		gitStdout, _, _ := RunGitCli(dirName, append([]string{"cat-file"}, args...)...)
+		assert.Equal(t, gitStdout, stdout, args)
+	}
+
+	_, _, errcode := RunMyGitCli(dirName, "cat-file", "-e", treeHash)
+	assert.Equal(t, 0, errcode)
+	stdout, _, errcode := RunMyGitCli(dirName, "cat-file", "-e", "0123456789012345678901234567890123456789")
+	assert.Equal(t, 1, errcode)
+	assert.Equal(t, "", stdout)
+
+	objects, _, _ := RunGitCli(dirName, "cat-file", "--batch-all-objects", "--batch-check=%(objectname)")
+	objects += "missing_object\n"
+	for _, mode := range []string{"--batch", "--batch-check", "--batch-check=%(objecttype) %(objectname)"} {
+		stdout, stderr, errcode := RunMyGitCliWithStdin(dirName, objects, "cat-file", mode)
+		assert.Equal(t, 0, errcode, stderr)
+		gitStdout, _, _ := RunGitCliWithStdin(dirName, objects, "cat-file", mode)
+		assert.Equal(t, gitStdout, stdout, mode)
+	}
+}
+
+func TestCatFileBinarySafe(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	RunGitCli(dirName, "init")
+
+	binaryContent := "hello\x00world\x00 \xff"
+	os.WriteFile(dirName+"/binary.bin", []byte(binaryContent), 0644)
+	blobHash, _, _ := RunGitCli(dirName, "hash-object", "-w", "binary.bin")
+	stdout, stderr, errcode := RunMyGitCli(dirName, "cat-file", "-p", strings.TrimSuffix(blobHash, "\n"))
+	assert.Equal(t, 0, errcode, stderr)
+	assert.Equal(t, binaryContent, stdout)
+
+	// a signed commit has a multi-line header after the committer
+	treeHash, _, _ := RunGitCli(dirName, "write-tree")
+	commit := fmt.Sprintf("tree %v\n"+
+		"author test <test@test.com> 1700000000 +0100\n"+
+		"committer test <test@test.com> 1700000000 -0530\n"+
+		"gpgsig -----BEGIN PGP SIGNATURE-----\n \n abcd\n -----END PGP SIGNATURE-----\n"+
+		"\nsigned commit\n", strings.TrimSuffix(treeHash, "\n"))
+	os.WriteFile(dirName+"/commit.txt", []byte(commit), 0644)
+	commitHash, _, _ := RunGitCli(dirName, "hash-object", "-t", "commit", "-w", "commit.txt")
+	tag := fmt.Sprintf("object %v\ntype commit\ntag v1\ntagger test <test@test.com> 1700000000 +0000\n\nannotated\n", strings.TrimSuffix(commitHash, "\n"))
+	os.WriteFile(dirName+"/tag.txt", []byte(tag), 0644)
+	tagHash, _, _ := RunGitCli(dirName, "hash-object", "-t", "tag", "-w", "tag.txt")
+
+	stdout, stderr, errcode = RunMyGitCli(dirName, "cat-file", "-p", strings.TrimSuffix(commitHash, "\n"))
+	assert.Equal(t, 0, errcode, stderr)
+	assert.Equal(t, commit, stdout)
+	stdout, stderr, errcode = RunMyGitCli(dirName, "cat-file", "-p", strings.TrimSuffix(tagHash, "\n"))
+	assert.Equal(t, 0, errcode, stderr)
+	assert.Equal(t, tag, stdout)
+}
+
 func TestHashObject(t *testing.T) {
 	dirName := SetupTestDir()
 	defer CleanTestDir(dirName)
@@ -150,10 +374,13 @@ func TestWriteTree(t *testing.T) {
 	os.WriteFile(dirName+"/test_dir_1/test_file_2.txt", []byte("hello world 2"), 0755)
 	os.WriteFile(dirName+"/test_dir_1/test_file_3.txt", []byte("hello world 3"), 0755)
 
+	RunMyGitCli(dirName, "add", ".")
 	treeHash, stderr, errcode := RunMyGitCli(dirName, "write-tree")
 	if errcode != 0 {
 		fmt.Println(stderr)
 	}
+	gitTreeHash, _, _ := RunGitCli(dirName, "write-tree")
+	assert.Equal(t, gitTreeHash, treeHash)
 
 	lsTreeOut, stderr, errcode := RunGitCli(dirName, "ls-tree", "--name-only", strings.TrimSuffix(treeHash, "\n"))
 	if errcode != 0 {
@@ -163,6 +390,301 @@ func TestWriteTree(t *testing.T) {
 	assert.Equal(t, fmt.Sprintf("%v", "test_dir_1\ntest_file_1.txt\n"), lsTreeOut)
 }
 
+func TestWriteTreeModes(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	RunGitCli(dirName, "init")
+	// "test.txt" sorts before the "test" directory in git trees, "test0" after it
+	os.WriteFile(dirName+"/test.txt", []byte("hello world 1"), 0644)
+	os.Mkdir(dirName+"/test", 0755)
+	os.WriteFile(dirName+"/test/test_file_2.txt", []byte("hello world 2"), 0644)
+	os.WriteFile(dirName+"/test0", []byte("hello world 3"), 0644)
+	os.WriteFile(dirName+"/script.sh", []byte("echo hello world"), 0755)
+	os.Symlink("test/test_file_2.txt", dirName+"/link")
+	nestedDir := dirName + "/nested"
+	os.Mkdir(nestedDir, 0755)
+	RunGitCli(nestedDir, "init")
+	RunGitCli(nestedDir, "-c", "user.name=test", "-c", "user.email=test@test.com", "commit", "--allow-empty", "-m", "nested")
+	// a submodule has a gitdir: file pointing to .git/modules of the superproject
+	_, stderr, errcode := RunGitCli(dirName, "-c", "protocol.file.allow=always", "submodule", "add", nestedDir, "submodule")
+	assert.Equal(t, 0, errcode, stderr)
+	assert.FileExists(t, dirName+"/submodule/.git")
+
+	_, stderr, errcode = RunMyGitCli(dirName, "add", ".")
+	assert.Equal(t, 0, errcode, stderr)
+	treeHash, stderr, errcode := RunMyGitCli(dirName, "write-tree")
+	assert.Equal(t, 0, errcode, stderr)
+
+	os.Remove(dirName + "/.git/index")
+	RunGitCli(dirName, "add", ".")
+	gitTreeHash, _, _ := RunGitCli(dirName, "write-tree")
+	assert.Equal(t, gitTreeHash, treeHash)
+
+	lsTree, _, _ := RunGitCli(dirName, "ls-tree", strings.TrimSuffix(treeHash, "\n"))
+	assert.Contains(t, lsTree, "100755 blob")
+	assert.Contains(t, lsTree, "120000 blob")
+	assert.Contains(t, lsTree, "160000 commit")
+	assert.Contains(t, lsTree, "\tsubmodule\n")
+	assert.Contains(t, lsTree, "\t.gitmodules\n")
+}
+
+func TestAdd(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	RunGitCli(dirName, "init")
+	os.WriteFile(dirName+"/test_file_1.txt", []byte("hello world 1"), 0644)
+	os.WriteFile(dirName+"/test_file_2.sh", []byte("echo hello world 2"), 0755)
+	os.Mkdir(dirName+"/test_dir_1", 0755)
+	os.WriteFile(dirName+"/test_dir_1/test_file_3.txt", []byte("hello world 3"), 0644)
+
+	_, stderr, errcode := RunMyGitCli(dirName, "add", "test_file_1.txt", "test_file_2.sh", "test_dir_1")
+	assert.Equal(t, 0, errcode, stderr)
+
+	lsFiles, _, _ := RunMyGitCli(dirName, "ls-files", "-s")
+	gitLsFiles, _, _ := RunGitCli(dirName, "ls-files", "-s")
+	assert.Equal(t, gitLsFiles, lsFiles)
+	assert.Contains(t, lsFiles, "100755 ")
+	status, _, _ := RunGitCli(dirName, "status", "--porcelain")
+	assert.Equal(t, "A  test_dir_1/test_file_3.txt\nA  test_file_1.txt\nA  test_file_2.sh\n", status)
+
+	stdout, stderr, errcode := RunMyGitCli(dirName, "rm", "--cached", "-r", "test_dir_1")
+	assert.Equal(t, 0, errcode, stderr)
+	assert.Equal(t, "rm 'test_dir_1/test_file_3.txt'\n", stdout)
+	os.Remove(dirName + "/test_file_1.txt")
+	RunMyGitCli(dirName, "add", ".")
+	lsFiles, _, _ = RunMyGitCli(dirName, "ls-files")
+	assert.Equal(t, "test_dir_1/test_file_3.txt\ntest_file_2.sh\n", lsFiles)
+
+	_, stderr, errcode = RunMyGitCli(dirName, "add", "missing.txt")
+	assert.Equal(t, 1, errcode)
+	assert.Equal(t, "pathspec 'missing.txt' did not match any files\n", stderr)
+
+	// an entry with the stat data of its file but a stale sha, written in the same second as
+	// the index, is hashed again
+	stale, _, _ := RunGitCliWithStdin(dirName, "stale", "hash-object", "-w", "--stdin")
+	staleSha, _ := hex.DecodeString(strings.TrimSpace(stale))
+	index, _ := os.ReadFile(dirName + "/.git/index")
+	copy(index[12+40:], staleSha)
+	checksum := sha1.Sum(index[:len(index)-20])
+	copy(index[len(index)-20:], checksum[:])
+	os.WriteFile(dirName+"/.git/index", index, 0644)
+	info, _ := os.Stat(dirName + "/test_dir_1/test_file_3.txt")
+	os.Chtimes(dirName+"/.git/index", info.ModTime(), info.ModTime())
+	_, stderr, errcode = RunMyGitCli(dirName, "add", "test_dir_1")
+	assert.Equal(t, 0, errcode, stderr)
+	lsFiles, _, _ = RunMyGitCli(dirName, "ls-files", "-s", "test_dir_1")
+	fileSha, _, _ := RunGitCli(dirName, "hash-object", "test_dir_1/test_file_3.txt")
+	assert.Equal(t, "100644 "+strings.TrimSpace(fileSha)+" 0\ttest_dir_1/test_file_3.txt\n", lsFiles)
+}
+
+func TestStatus(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	RunGitCli(dirName, "init", "-b", "main")
+	os.WriteFile(dirName+"/test_file_1.txt", []byte("hello world 1"), 0644)
+	os.WriteFile(dirName+"/test_file_2.txt", []byte("hello world 2"), 0644)
+	os.WriteFile(dirName+"/test_file_3.txt", []byte("hello world 3"), 0644)
+	RunGitCli(dirName, "add", ".")
+	RunGitCli(dirName, "-c", "user.name=test", "-c", "user.email=test@test.com", "commit", "-m", "commit 1")
+
+	stdout, stderr, errcode := RunMyGitCli(dirName, "status")
+	assert.Equal(t, 0, errcode, stderr)
+	assert.Equal(t, "On branch main\nnothing to commit, working tree clean\n", stdout)
+
+	os.WriteFile(dirName+"/test_file_1.txt", []byte("hello world 1 staged"), 0644)
+	RunMyGitCli(dirName, "add", "test_file_1.txt")
+	os.WriteFile(dirName+"/test_file_2.txt", []byte("hello world 2 unstaged"), 0644)
+	os.Remove(dirName + "/test_file_3.txt")
+	os.Mkdir(dirName+"/test_dir_1", 0755)
+	os.WriteFile(dirName+"/test_dir_1/test_file_4.txt", []byte("hello world 4"), 0644)
+	os.WriteFile(dirName+"/test_file_5.txt", []byte("hello world 5"), 0644)
+	RunMyGitCli(dirName, "add", "test_file_5.txt")
+
+	stdout, _, _ = RunMyGitCli(dirName, "status", "--porcelain=v1")
+	gitStdout, _, _ := RunGitCli(dirName, "status", "--porcelain=v1")
+	assert.Equal(t, gitStdout, stdout)
+	assert.Equal(t, "M  test_file_1.txt\n M test_file_2.txt\n D test_file_3.txt\nA  test_file_5.txt\n?? test_dir_1/\n", stdout)
+	stdout, _, _ = RunMyGitCli(dirName, "status", "--short")
+	assert.Equal(t, gitStdout, stdout)
+
+	stdout, _, _ = RunMyGitCli(dirName, "status")
+	gitStdout, _, _ = RunGitCli(dirName, "-c", "advice.statusHints=false", "status")
+	assert.Equal(t, gitStdout, stdout)
+}
+
+func TestConfig(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	RunGitCli(dirName, "init")
+	os.WriteFile(dirName+"/included", []byte("[included]\n\tvalue = \"a  b\" ; comment\n"), 0644)
+	RunGitCli(dirName, "config", "include.path", "../included")
+	RunGitCli(dirName, "config", "--add", "multi.Sub.key", "one")
+	RunGitCli(dirName, "config", "--add", "multi.Sub.key", "two")
+
+	stdout, stderr, errcode := RunMyGitCli(dirName, "config", "--list")
+	assert.Equal(t, 0, errcode, stderr)
+	gitStdout, _, _ := RunGitCli(dirName, "config", "--list")
+	assert.Equal(t, gitStdout, stdout)
+	stdout, _, _ = RunMyGitCli(dirName, "config", "included.value")
+	assert.Equal(t, "a  b\n", stdout)
+	stdout, _, _ = RunMyGitCli(dirName, "config", "--get-all", "MULTI.Sub.KEY")
+	assert.Equal(t, "one\ntwo\n", stdout)
+	_, _, errcode = RunMyGitCli(dirName, "config", "multi.sub.key")
+	assert.Equal(t, 1, errcode)
+	_, _, errcode = RunMyGitCli(dirName, "config", "multi.Sub.key", "three")
+	assert.Equal(t, 5, errcode)
+
+	_, stderr, errcode = RunMyGitCli(dirName, "config", "user.name", "test user")
+	assert.Equal(t, 0, errcode, stderr)
+	RunMyGitCli(dirName, "config", "remote.origin.url", "https://example.com/repo.git")
+	RunMyGitCli(dirName, "config", "core.comment", "#hash")
+	RunMyGitCli(dirName, "config", "--unset-all", "multi.Sub.key")
+	for key, value := range map[string]string{"user.name": "test user\n", "remote.origin.url": "https://example.com/repo.git\n", "core.comment": "#hash\n", "multi.Sub.key": ""} {
+		gitStdout, _, _ = RunGitCli(dirName, "config", "--get-all", key)
+		assert.Equal(t, value, gitStdout, key)
+	}
+	_, _, errcode = RunMyGitCli(dirName, "config", "--unset", "user.email")
+	assert.Equal(t, 5, errcode)
+	// an includeIf pattern with an invalid range includes nothing, the other conditions still apply
+	os.WriteFile(dirName+"/invalid", []byte("[conditional]\n\tinvalid = yes\n"), 0644)
+	os.WriteFile(dirName+"/valid", []byte("[conditional]\n\tvalid = yes\n"), 0644)
+	RunGitCli(dirName, "config", "includeIf.gitdir:[z-a]/.path", "../invalid")
+	RunGitCli(dirName, "config", "includeIf.gitdir:**.path", "../valid")
+	stdout, stderr, errcode = RunMyGitCli(dirName, "config", "--list")
+	assert.Equal(t, 0, errcode, stderr)
+	assert.Contains(t, stdout, "conditional.valid=yes\n")
+	assert.NotContains(t, stdout, "conditional.invalid")
+}
+
+func TestCheckIgnore(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	RunGitCli(dirName, "init", "-b", "main")
+	os.MkdirAll(dirName+"/build/out", 0755)
+	os.MkdirAll(dirName+"/test_dir_1/logs", 0755)
+	os.MkdirAll(dirName+"/doc/api", 0755)
+	os.WriteFile(dirName+"/.gitignore", []byte("*.log\n!keep.log\n/build/\ndoc/**/*.txt\n"), 0644)
+	os.WriteFile(dirName+"/test_dir_1/.gitignore", []byte("logs/\n!*.log\n"), 0644)
+	os.WriteFile(dirName+"/.git/info/exclude", []byte("secret\n"), 0644)
+	for _, name := range []string{"a.log", "keep.log", "build/out/a.o", "test_dir_1/b.log", "test_dir_1/logs/c",
+		"doc/api/d.txt", "doc/e.md", "secret", "test_file_1.txt"} {
+		os.WriteFile(dirName+"/"+name, []byte(name), 0644)
+	}
+	paths := []string{"a.log", "keep.log", "build/out/a.o", "test_dir_1/b.log", "test_dir_1/logs/c", "doc/api/d.txt",
+		"doc/e.md", "secret", "test_file_1.txt"}
+
+	stdout, stderr, errcode := RunMyGitCli(dirName, append([]string{"check-ignore", "-v", "-n"}, paths...)...)
+	assert.Equal(t, 0, errcode, stderr)
+	gitStdout, _, _ := RunGitCli(dirName, append([]string{"check-ignore", "-v", "-n"}, paths...)...)
+	assert.Equal(t, gitStdout, stdout)
+	stdout, _, _ = RunMyGitCli(dirName, append([]string{"check-ignore"}, paths...)...)
+	gitStdout, _, _ = RunGitCli(dirName, append([]string{"check-ignore"}, paths...)...)
+	assert.Equal(t, gitStdout, stdout)
+	_, _, errcode = RunMyGitCli(dirName, "check-ignore", "test_file_1.txt")
+	assert.Equal(t, 1, errcode)
+
+	stdout, _, _ = RunMyGitCli(dirName, "status", "--porcelain")
+	gitStdout, _, _ = RunGitCli(dirName, "status", "--porcelain")
+	assert.Equal(t, gitStdout, stdout)
+
+	_, _, errcode = RunMyGitCli(dirName, "add", "a.log")
+	assert.Equal(t, 1, errcode)
+	_, stderr, errcode = RunMyGitCli(dirName, "add", ".")
+	assert.Equal(t, 0, errcode, stderr)
+	stdout, _, _ = RunGitCli(dirName, "ls-files")
+	assert.Equal(t, ".gitignore\ndoc/e.md\nkeep.log\ntest_dir_1/.gitignore\ntest_dir_1/b.log\ntest_file_1.txt\n", stdout)
+
+	// a pattern with an invalid range is skipped, the other lines still apply
+	os.WriteFile(dirName+"/.gitignore", []byte("[z-a]\n*.log\n"), 0644)
+	stdout, stderr, errcode = RunMyGitCli(dirName, "check-ignore", "-v", "-n", "a.log", "test_file_1.txt")
+	assert.Equal(t, 0, errcode, stderr)
+	gitStdout, _, _ = RunGitCli(dirName, "check-ignore", "-v", "-n", "a.log", "test_file_1.txt")
+	assert.Equal(t, gitStdout, stdout)
+	stdout, stderr, errcode = RunMyGitCli(dirName, "status", "--porcelain")
+	assert.Equal(t, 0, errcode, stderr)
+	gitStdout, _, _ = RunGitCli(dirName, "status", "--porcelain")
+	assert.Equal(t, gitStdout, stdout)
+}
+
+func TestBranchAndRefs(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	RunGitCli(dirName, "init", "-b", "main")
+	for i := 1; i <= 3; i++ {
+		os.WriteFile(dirName+"/test_file_1.txt", []byte(fmt.Sprintf("hello world %v", i)), 0644)
+		RunGitCli(dirName, "add", ".")
+		RunGitCli(dirName, "-c", "user.name=test", "-c", "user.email=test@test.com", "commit", "-m", fmt.Sprintf("commit %v", i))
+	}
+	RunGitCli(dirName, "-c", "user.name=test", "-c", "user.email=test@test.com", "tag", "-a", "v1", "-m", "tag", "HEAD~1")
+	head, _, _ := RunGitCli(dirName, "rev-parse", "HEAD")
+	parent, _, _ := RunGitCli(dirName, "rev-parse", "HEAD~1")
+	head, parent = strings.TrimSpace(head), strings.TrimSpace(parent)
+
+	_, stderr, errcode := RunMyGitCli(dirName, "branch", "feature", "HEAD~1")
+	assert.Equal(t, 0, errcode, stderr)
+	_, _, errcode = RunMyGitCli(dirName, "branch", "feature")
+	assert.Equal(t, 1, errcode)
+	_, _, errcode = RunMyGitCli(dirName, "branch", "bad..name")
+	assert.Equal(t, 1, errcode)
+	RunMyGitCli(dirName, "branch", "topic")
+	RunMyGitCli(dirName, "branch", "-m", "main", "trunk")
+	stdout, _, _ := RunMyGitCli(dirName, "branch")
+	assert.Equal(t, "  feature\n  topic\n* trunk\n", stdout)
+	gitStdout, _, _ := RunGitCli(dirName, "branch")
+	assert.Equal(t, gitStdout, stdout)
+	stdout, _, _ = RunMyGitCli(dirName, "symbolic-ref", "HEAD")
+	assert.Equal(t, "refs/heads/trunk\n", stdout)
+	stdout, _, _ = RunMyGitCli(dirName, "branch", "-d", "feature")
+	assert.Equal(t, fmt.Sprintf("Deleted branch feature (was %v).\n", parent[:7]), stdout)
+
+	// the old value must match
+	_, _, errcode = RunMyGitCli(dirName, "update-ref", "refs/heads/topic", parent, parent)
+	assert.Equal(t, 1, errcode)
+	_, stderr, errcode = RunMyGitCli(dirName, "update-ref", "refs/heads/topic", parent, head)
+	assert.Equal(t, 0, errcode, stderr)
+	_, _, errcode = RunMyGitCli(dirName, "update-ref", "refs/heads/topic/nested", head)
+	assert.Equal(t, 1, errcode)
+	RunMyGitCli(dirName, "symbolic-ref", "refs/remotes/origin/HEAD", "refs/heads/trunk")
+
+	stdout, _, _ = RunMyGitCli(dirName, "show-ref", "-d")
+	gitStdout, _, _ = RunGitCli(dirName, "show-ref", "-d")
+	assert.Equal(t, gitStdout, stdout)
+	_, stderr, errcode = RunMyGitCli(dirName, "pack-refs", "--all")
+	assert.Equal(t, 0, errcode, stderr)
+	_, err := os.Stat(dirName + "/.git/refs/heads/topic")
+	assert.True(t, os.IsNotExist(err))
+	gitStdout, _, _ = RunGitCli(dirName, "show-ref", "-d")
+	assert.Equal(t, stdout, gitStdout)
+	stdout, _, _ = RunMyGitCli(dirName, "show-ref", "topic")
+	assert.Equal(t, parent+" refs/heads/topic\n", stdout)
+
+	// a ref can not be inside a loose or packed ref, nor hold other refs
+	_, stderr, errcode = RunMyGitCli(dirName, "update-ref", "refs/heads/trunk/nested", head)
+	assert.Equal(t, 1, errcode)
+	assert.Contains(t, stderr, "'refs/heads/trunk' exists, cannot create 'refs/heads/trunk/nested'")
+	RunMyGitCli(dirName, "update-ref", "refs/heads/deep/a/b", head)
+	_, stderr, errcode = RunMyGitCli(dirName, "update-ref", "refs/heads/deep", head)
+	assert.Equal(t, 1, errcode)
+	assert.Contains(t, stderr, "'refs/heads/deep/a/b' exists, cannot create 'refs/heads/deep'")
+	_, stderr, errcode = RunMyGitCli(dirName, "update-ref", "refs/heads/deep/a/c", head)
+	assert.Equal(t, 0, errcode, stderr)
+	RunMyGitCli(dirName, "update-ref", "-d", "refs/heads/deep/a/b")
+	RunMyGitCli(dirName, "update-ref", "-d", "refs/heads/deep/a/c")
+
+	_, stderr, errcode = RunMyGitCli(dirName, "update-ref", "-d", "refs/heads/topic")
+	assert.Equal(t, 0, errcode, stderr)
+	_, _, errcode = RunGitCli(dirName, "rev-parse", "--verify", "-q", "refs/heads/topic")
+	assert.Equal(t, 1, errcode)
+	_, stderr, errcode = RunGitCli(dirName, "fsck")
+	assert.Equal(t, 0, errcode, stderr)
+}
+
 func TestLsTree(t *testing.T) {
 	dirName := SetupTestDir()
 	defer CleanTestDir(dirName)
@@ -184,11 +706,43 @@ func TestLsTree(t *testing.T) {
 	assert.Equal(t, fmt.Sprintf("%v", "test_dir_1\ntest_file_1.txt\n"), lsTreeOut)
 }
 
+func TestLsTreeRecursive(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	RunGitCli(dirName, "init")
+
+	os.WriteFile(dirName+"/test_file_1.txt", []byte("hello world 1"), 0755)
+	os.MkdirAll(dirName+"/test_dir_1/test_dir_2", 0755)
+	os.WriteFile(dirName+"/test_dir_1/test_file_2.txt", []byte("hello world 2"), 0755)
+	os.WriteFile(dirName+"/test_dir_1/test_dir_2/test_file_3.txt", []byte("hello world 3"), 0755)
+
+	RunGitCli(dirName, "add", ".")
+	RunGitCli(dirName, "-c", "user.name=test", "-c", "user.email=test@test.com", "commit", "-m", "commit 1")
+
+	for _, args := range [][]string{
+		{"HEAD"},
+		{"-r", "HEAD"},
+		{"-r", "-t", "HEAD"},
+		{"-r", "-l", "HEAD"},
+		{"HEAD", "test_dir_1"},
+		{"HEAD", "test_dir_1/"},
+		{"HEAD", "test_dir_1/test_dir_2/test_file_3.txt"},
+	} {
+		stdout, stderr, errcode := RunMyGitCli(dirName, append([]string{"ls-tree"}, args...)...)
+		assert.Equal(t, 0, errcode, stderr)
+		gitStdout, _, _ := RunGitCli(dirName, append([]string{"ls-tree"}, args...)...)
+		assert.Equal(t, gitStdout, stdout, args)
+	}
+}
+
 func TestCommit(t *testing.T) {
 	dirName := SetupTestDir()
 	defer CleanTestDir(dirName)
 
 	RunGitCli(dirName, "init")
+	RunGitCli(dirName, "config", "user.name", "test")
+	RunGitCli(dirName, "config", "user.email", "test@test.com")
 
 	os.WriteFile(dirName+"/test_file_1.txt", []byte("hello world 1"), 0755)
 	os.Mkdir(dirName+"/test_dir_1", 0755)
@@ -233,6 +787,285 @@ func TestCommit(t *testing.T) {
 	assert.Contains(t, showRes, newCommitHash)
 }
 
+func TestCommitTreeIdentity(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	RunGitCli(dirName, "init")
+	RunGitCli(dirName, "config", "user.name", "test")
+	RunGitCli(dirName, "config", "user.email", "test@test.com")
+	os.WriteFile(dirName+"/test_file_1.txt", []byte("hello world 1"), 0644)
+	os.WriteFile(dirName+"/message.txt", []byte("from a file\n\nwith a body\n"), 0644)
+	RunGitCli(dirName, "add", "test_file_1.txt")
+	treeHash, _, _ := RunGitCli(dirName, "write-tree")
+	treeHash = strings.TrimSpace(treeHash)
+
+	// with fixed dates both commits are the same object
+	env := append(os.Environ(), "GIT_AUTHOR_DATE=1700000000 +0200", "GIT_COMMITTER_DATE=Tue, 14 Nov 2023 22:13:20 +0100")
+	commitTree := func(cliPath string, stdin string, args ...string) string {
+		cmd := exec.Command(cliPath, append([]string{"commit-tree"}, args...)...)
+		cmd.Dir = dirName
+		cmd.Env = append(env, "GIT_AUTHOR_NAME=author", "GIT_AUTHOR_EMAIL=author@test.com")
+		cmd.Stdin = strings.NewReader(stdin)
+		stdout, stderr, errcode := RunCommand(cmd)
+		assert.Equal(t, 0, errcode, stderr)
+		return strings.TrimSpace(stdout)
+	}
+	binDirAbs, _ := filepath.Abs("../../bin/gitgo")
+
+	first := commitTree("git", "", treeHash, "-m", "first")
+	assert.Equal(t, first, commitTree(binDirAbs, "", treeHash, "-m", "first"))
+	second := commitTree("git", "", "-p", first, treeHash, "-m", "second", "-m", "paragraph")
+	assert.Equal(t, second, commitTree(binDirAbs, "", "-p", first, treeHash, "-m", "second", "-m", "paragraph"))
+	merge := commitTree("git", "", treeHash, "-p", first, "-p", second, "-F", "message.txt")
+	assert.Equal(t, merge, commitTree(binDirAbs, "", treeHash, "-p", first, "-p", second, "-F", "message.txt"))
+	fromStdin := commitTree("git", "from stdin\n", treeHash, "-p", merge)
+	assert.Equal(t, fromStdin, commitTree(binDirAbs, "from stdin\n", treeHash, "-p", merge))
+
+	content, _, _ := RunGitCli(dirName, "cat-file", "-p", merge)
+	assert.Contains(t, content, "author author <author@test.com> 1700000000 +0200\ncommitter test <test@test.com> 1699996400 +0100\n")
+
+	// characters breaking the signature line are removed from the whole value
+	env = append(env, "GIT_COMMITTER_NAME= \"com <mit>\nter\". ", "GIT_COMMITTER_EMAIL=<com\nmitter@test.com>")
+	crud := commitTree("git", "", treeHash, "-m", "crud")
+	assert.Equal(t, crud, commitTree(binDirAbs, "", treeHash, "-m", "crud"))
+	stdout, stderr, errcode := RunMyGitCli(dirName, "log", "--format=%cn <%ce>", crud)
+	assert.Equal(t, 0, errcode, stderr)
+	assert.Equal(t, "com mitter <committer@test.com>\n", stdout)
+	_, stderr, errcode = RunGitCli(dirName, "fsck", "--strict")
+	assert.Equal(t, 0, errcode, stderr)
+}
+
+func TestCommitPorcelain(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	RunGitCli(dirName, "init", "-b", "main")
+	RunGitCli(dirName, "config", "user.name", "test")
+	RunGitCli(dirName, "config", "user.email", "test@test.com")
+
+	stdout, _, errcode := RunMyGitCli(dirName, "commit", "-m", "nothing")
+	assert.Equal(t, 1, errcode)
+	assert.Contains(t, stdout, "nothing to commit")
+
+	os.WriteFile(dirName+"/test_file_1.txt", []byte("hello world 1"), 0644)
+	RunMyGitCli(dirName, "add", ".")
+	stdout, stderr, errcode := RunMyGitCli(dirName, "commit", "-m", "first", "-m", "body")
+	assert.Equal(t, 0, errcode, stderr)
+	head, _, _ := RunGitCli(dirName, "rev-parse", "HEAD")
+	assert.Equal(t, fmt.Sprintf("[main (root-commit) %v] first\n", head[:7]), stdout)
+	message, _, _ := RunGitCli(dirName, "log", "-1", "--format=%B")
+	assert.Equal(t, "first\n\nbody\n\n", message)
+
+	_, _, errcode = RunMyGitCli(dirName, "commit", "-m", "same tree")
+	assert.Equal(t, 1, errcode)
+	_, stderr, errcode = RunMyGitCli(dirName, "commit", "--allow-empty", "-m", "empty")
+	assert.Equal(t, 0, errcode, stderr)
+
+	// amending keeps the parents and by default the message
+	os.WriteFile(dirName+"/test_file_1.txt", []byte("hello world 2"), 0644)
+	RunMyGitCli(dirName, "add", ".")
+	stdout, stderr, errcode = RunMyGitCli(dirName, "commit", "--amend")
+	assert.Equal(t, 0, errcode, stderr)
+	assert.Contains(t, stdout, "] empty\n")
+	log, _, _ := RunGitCli(dirName, "log", "--format=%s")
+	assert.Equal(t, "empty\nfirst\n", log)
+	status, _, _ := RunGitCli(dirName, "status", "--porcelain")
+	assert.Equal(t, "", status)
+
+	// a detached commit leaves the branch alone
+	main, _, _ := RunGitCli(dirName, "rev-parse", "main")
+	RunGitCli(dirName, "checkout", "-q", "--detach")
+	stdout, _, _ = RunMyGitCli(dirName, "commit", "--allow-empty", "-m", "detached")
+	assert.Contains(t, stdout, "[detached HEAD ")
+	branch, _, _ := RunGitCli(dirName, "rev-parse", "main")
+	assert.Equal(t, main, branch)
+	_, stderr, errcode = RunGitCli(dirName, "fsck", "--strict")
+	assert.Equal(t, 0, errcode, stderr)
+}
+
+func TestLog(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	RunGitCli(dirName, "init", "-b", "main")
+	RunGitCli(dirName, "config", "user.name", "test")
+	RunGitCli(dirName, "config", "user.email", "test@test.com")
+	_, stderr, errcode := RunMyGitCli(dirName, "log")
+	assert.Equal(t, 1, errcode)
+	assert.Contains(t, stderr, "does not have any commits yet")
+
+	// with fixed dates the history is the same on every run
+	commit := func(date int, author string, message string) {
+		t.Setenv("GIT_AUTHOR_DATE", fmt.Sprintf("%v +0200", 1700000000+date))
+		t.Setenv("GIT_COMMITTER_DATE", fmt.Sprintf("%v +0100", 1700000000+date))
+		t.Setenv("GIT_AUTHOR_NAME", author)
+		RunGitCli(dirName, "commit", "--allow-empty", "-m", message)
+	}
+	commit(0, "alice", "root")
+	commit(100, "bob", "second\n\nwith a\tbody")
+	RunGitCli(dirName, "checkout", "-b", "side")
+	commit(200, "alice", "side 1")
+	commit(300, "bob", "side 2")
+	RunGitCli(dirName, "checkout", "main")
+	commit(400, "alice", "main 3")
+	RunGitCli(dirName, "checkout", "-b", "other", "HEAD~1")
+	commit(500, "carol", "other 1")
+	RunGitCli(dirName, "checkout", "main")
+	commit(600, "bob", "main 4")
+	t.Setenv("GIT_COMMITTER_DATE", "1700000700 +0100")
+	RunGitCli(dirName, "merge", "-q", "--no-ff", "side", "other", "-m", "octopus")
+	commit(800, "alice", "last")
+
+	for _, args := range [][]string{
+		{},
+		{"--oneline"},
+		{"--graph", "--oneline"},
+		{"--graph"},
+		{"--topo-order", "--format=%h %p %an <%ae> %ad%n%s%n%b"},
+		{"--date-order", "--pretty=fuller", "--graph"},
+		{"-n", "3", "--format=%H %cI %s"},
+		{"-n2", "--oneline"},
+		{"--author=alice", "--author=^carol", "--graph", "--oneline"},
+		{"--since=1700000250", "--until=1700000650", "--oneline"},
+		{"side", "other", "-2", "--pretty=short"},
+	} {
+		stdout, stderr, errcode := RunMyGitCli(dirName, append([]string{"log"}, args...)...)
+		assert.Equal(t, 0, errcode, stderr)
+		gitStdout, _, _ := RunGitCli(dirName, append([]string{"log"}, args...)...)
+		assert.Equal(t, gitStdout, stdout, args)
+	}
+	// abbreviated shas resolve from loose objects and from packs
+	short, _, _ := RunGitCli(dirName, "rev-parse", "--short", "main~1")
+	short = strings.TrimSpace(short)
+	for _, gc := range []bool{false, true} {
+		if gc {
+			RunGitCli(dirName, "gc", "-q")
+		}
+		for _, args := range [][]string{{"--oneline", short}, {"--oneline", short[:4] + "^2"}} {
+			stdout, stderr, errcode := RunMyGitCli(dirName, append([]string{"log"}, args...)...)
+			assert.Equal(t, 0, errcode, stderr)
+			gitStdout, _, _ := RunGitCli(dirName, append([]string{"log"}, args...)...)
+			assert.Equal(t, gitStdout, stdout, args)
+		}
+	}
+	stdout, _, _ := RunMyGitCli(dirName, "log", "--graph", "--oneline")
+	assert.Contains(t, stdout, "*-.   ")
+	_, _, errcode = RunMyGitCli(dirName, "log", "--format=unknown")
+	assert.Equal(t, 1, errcode)
+}
+
+func TestFsck(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	RunGitCli(dirName, "init")
+	for i := 1; i <= 2; i++ {
+		os.WriteFile(dirName+"/test_file_1.txt", []byte(fmt.Sprintf("hello world %v", i)), 0755)
+		RunGitCli(dirName, "add", ".")
+		RunGitCli(dirName, "-c", "user.name=test", "-c", "user.email=test@test.com", "commit", "-m", fmt.Sprintf("commit %v", i))
+	}
+	RunGitCli(dirName, "gc", "-q")
+	os.WriteFile(dirName+"/dangling.txt", []byte("dangling"), 0755)
+	danglingHash, _, _ := RunGitCli(dirName, "hash-object", "-w", "dangling.txt")
+
+	stdout, stderr, errcode := RunMyGitCli(dirName, "fsck")
+	assert.Equal(t, 0, errcode, stderr)
+	assert.Equal(t, fmt.Sprintf("dangling blob %v", danglingHash), stdout)
+
+	os.WriteFile(dirName+"/test_file_1.txt", []byte("hello world 3"), 0755)
+	RunGitCli(dirName, "add", ".")
+	RunGitCli(dirName, "-c", "user.name=test", "-c", "user.email=test@test.com", "commit", "-m", "commit 3")
+	blobHash, _, _ := RunGitCli(dirName, "rev-parse", "HEAD:test_file_1.txt")
+	blobHash = strings.TrimSuffix(blobHash, "\n")
+	os.Remove(fmt.Sprintf("%v/.git/objects/%v/%v", dirName, blobHash[:2], blobHash[2:]))
+
+	stdout, stderr, errcode = RunMyGitCli(dirName, "fsck")
+	assert.Equal(t, 1, errcode)
+	assert.Contains(t, stdout, fmt.Sprintf("missing blob %v", blobHash))
+	assert.Equal(t, "fsck found 1 errors\n", stderr)
+}
+
+func TestGc(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	RunGitCli(dirName, "init")
+	for i := 1; i <= 2; i++ {
+		os.WriteFile(dirName+"/test_file_1.txt", []byte(fmt.Sprintf("hello world %v", i)), 0755)
+		RunGitCli(dirName, "add", ".")
+		RunGitCli(dirName, "-c", "user.name=test", "-c", "user.email=test@test.com", "commit", "-m", fmt.Sprintf("commit %v", i))
+	}
+	os.WriteFile(dirName+"/unreachable.txt", []byte("unreachable"), 0755)
+	unreachableHash, _, _ := RunGitCli(dirName, "hash-object", "-w", "unreachable.txt")
+
+	stdout, stderr, errcode := RunMyGitCli(dirName, "gc", "--prune=now")
+	assert.Equal(t, 0, errcode, stderr)
+	assert.Contains(t, stdout, "Writing objects: (6,6), done.")
+
+	countObjects, _, _ := RunGitCli(dirName, "count-objects", "-v")
+	assert.Contains(t, countObjects, "count: 0\n")
+	assert.Contains(t, countObjects, "in-pack: 6\n")
+	_, _, errcode = RunGitCli(dirName, "cat-file", "-e", strings.TrimSuffix(unreachableHash, "\n"))
+	assert.Equal(t, 1, errcode)
+	_, stderr, errcode = RunGitCli(dirName, "fsck", "--full")
+	assert.Equal(t, 0, errcode, stderr)
+}
+
+func TestPackObjects(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	repoDir := dirName + "/work"
+	os.Mkdir(repoDir, 0755)
+	RunGitCli(repoDir, "init", "-b", "main")
+	content := ""
+	for i := 1; i <= 200; i++ {
+		content += fmt.Sprintf("line %v\n", i)
+	}
+	for i := 1; i <= 3; i++ {
+		content += fmt.Sprintf("commit %v\n", i)
+		os.WriteFile(repoDir+"/test_file_1.txt", []byte(content), 0755)
+		RunGitCli(repoDir, "add", ".")
+		RunGitCli(repoDir, "-c", "user.name=test", "-c", "user.email=test@test.com", "commit", "-m", fmt.Sprintf("commit %v", i))
+	}
+	objects, _, _ := RunGitCli(repoDir, "rev-list", "--objects", "--all")
+
+	stdout, stderr, errcode := RunMyGitCliWithStdin(repoDir, objects, "pack-objects", dirName+"/objects")
+	assert.Equal(t, 0, errcode, stderr)
+	packSha := strings.TrimSuffix(stdout, "\n")
+	verify, stderr, errcode := RunGitCli(repoDir, "verify-pack", "-v", fmt.Sprintf("%v/objects-%v.idx", dirName, packSha))
+	assert.Equal(t, 0, errcode, stderr)
+	assert.Contains(t, verify, "chain length = 1: 1 object")
+	assert.Contains(t, verify, "chain length = 2: 1 object")
+
+	// objects of the last commit only, with ref deltas
+	headHash, _, _ := RunGitCli(repoDir, "rev-parse", "main")
+	parentHash, _, _ := RunGitCli(repoDir, "rev-parse", "main~1")
+	revisions := fmt.Sprintf("%v..main\n", strings.TrimSuffix(parentHash, "\n"))
+	stdout, stderr, errcode = RunMyGitCliWithStdin(repoDir, revisions, "pack-objects", "--revs", "--no-ofs-delta", "--stdout")
+	assert.Equal(t, 0, errcode, stderr)
+	os.WriteFile(dirName+"/revs.pack", []byte(stdout), 0644)
+	_, stderr, errcode = RunGitCli(repoDir, "index-pack", dirName+"/revs.pack")
+	assert.Equal(t, 0, errcode, stderr)
+	verify, _, _ = RunGitCli(repoDir, "verify-pack", "-v", dirName+"/revs.idx")
+	assert.Contains(t, verify, strings.TrimSuffix(headHash, "\n")+" commit")
+	assert.Contains(t, verify, "non delta: 3 objects")
+
+	// repetitive content is deltified without trying every offset of the base
+	zeros := make([]byte, 2000000)
+	os.WriteFile(repoDir+"/zeros_1.bin", zeros, 0644)
+	os.WriteFile(repoDir+"/zeros_2.bin", append(zeros, 1), 0644)
+	blobs, _, _ := RunGitCli(repoDir, "hash-object", "-w", "zeros_1.bin", "zeros_2.bin")
+	stdout, stderr, errcode = RunMyGitCliWithStdin(repoDir, blobs, "pack-objects", "--stdout")
+	assert.Equal(t, 0, errcode, stderr)
+	os.WriteFile(dirName+"/zeros.pack", []byte(stdout), 0644)
+	_, stderr, errcode = RunGitCli(repoDir, "index-pack", dirName+"/zeros.pack")
+	assert.Equal(t, 0, errcode, stderr)
+	verify, _, _ = RunGitCli(repoDir, "verify-pack", "-v", dirName+"/zeros.idx")
+	assert.Contains(t, verify, "chain length = 1: 1 object")
+}
+
 func TestClone(t *testing.T) {
 	dirName := SetupTestDir()
 	defer CleanTestDir(dirName)
@@ -251,3 +1084,354 @@ func TestClone(t *testing.T) {
 	assert.Contains(t, stdout, "Get back to version 1")
 
 }
+
+func TestCloneLocalServer(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	SetupRemoteRepository(dirName)
+	server := ServeGitRepositories(dirName)
+	defer server.Close()
+
+	cloneDir := dirName + "/clone"
+	os.Mkdir(cloneDir, 0755)
+	stdout, stderr, errcode := RunMyGitCli(cloneDir, "clone", server.URL+"/remote.git")
+	if errcode != 0 {
+		fmt.Println(stderr)
+	}
+	assert.Equal(t, 0, errcode)
+	assert.Contains(t, stdout, "Receiving objects: (9,9), done.")
+
+	headHash, _, _ := RunGitCli(dirName+"/remote.git", "rev-parse", "main")
+	stdout, stderr, errcode = RunGitCli(cloneDir+"/remote.git", "cat-file", "-p", strings.TrimSuffix(headHash, "\n"))
+	if errcode != 0 {
+		fmt.Println(stderr)
+	}
+	assert.Contains(t, stdout, "commit 3")
+
+	packs, _ := filepath.Glob(cloneDir + "/remote.git/.git/objects/pack/*.idx")
+	assert.Len(t, packs, 1)
+	_, stderr, errcode = RunGitCli(cloneDir, "verify-pack", packs[0])
+	assert.Equal(t, 0, errcode, stderr)
+}
+
+func TestCloneCheckout(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	workDir := dirName + "/work"
+	os.MkdirAll(workDir+"/src/nested", 0755)
+	RunGitCli(workDir, "init", "-b", "main")
+	os.WriteFile(workDir+"/README.md", []byte("readme\n"), 0644)
+	os.WriteFile(workDir+"/src/build.sh", []byte("#!/bin/sh\n"), 0755)
+	os.WriteFile(workDir+"/src/nested/data.txt", []byte("data\n"), 0644)
+	os.Symlink("src/nested/data.txt", workDir+"/link")
+	RunGitCli(workDir, "add", ".")
+	RunGitCli(workDir, "-c", "user.name=test", "-c", "user.email=test@test.com", "commit", "-m", "files")
+	RunGitCli(dirName, "clone", "--bare", workDir, dirName+"/remote.git")
+	server := ServeGitRepositories(dirName)
+	defer server.Close()
+
+	cloneDir := dirName + "/clone"
+	os.Mkdir(cloneDir, 0755)
+	_, stderr, errcode := RunMyGitCli(cloneDir, "clone", server.URL+"/remote.git")
+	assert.Equal(t, 0, errcode, stderr)
+	repoDir := cloneDir + "/remote.git"
+
+	content, _ := os.ReadFile(repoDir + "/src/nested/data.txt")
+	assert.Equal(t, "data\n", string(content))
+	info, _ := os.Stat(repoDir + "/src/build.sh")
+	assert.NotZero(t, info.Mode()&0o100)
+	target, _ := os.Readlink(repoDir + "/link")
+	assert.Equal(t, "src/nested/data.txt", target)
+
+	stdout, _, _ := RunGitCli(repoDir, "symbolic-ref", "HEAD")
+	assert.Equal(t, "refs/heads/main\n", stdout)
+	stdout, _, _ = RunGitCli(repoDir, "status", "--porcelain")
+	assert.Equal(t, "", stdout)
+	stdout, _, _ = RunGitCli(repoDir, "ls-files", "-s")
+	gitStdout, _, _ := RunGitCli(workDir, "ls-files", "-s")
+	assert.Equal(t, gitStdout, stdout)
+	stdout, _, _ = RunMyGitCli(repoDir, "status", "--porcelain")
+	assert.Equal(t, "", stdout)
+}
+
+func TestCloneRefs(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	SetupRemoteRepository(dirName)
+	remoteDir := dirName + "/remote.git"
+	RunGitCli(remoteDir, "branch", "feature", "main~1")
+	RunGitCli(remoteDir, "tag", "light", "main~2")
+	RunGitCli(remoteDir, "-c", "user.name=test", "-c", "user.email=test@test.com", "tag", "-a", "v1", "-m", "v1", "main")
+	server := ServeGitRepositories(dirName)
+	defer server.Close()
+
+	cloneDir := dirName + "/clone"
+	os.Mkdir(cloneDir, 0755)
+	_, stderr, errcode := RunMyGitCli(cloneDir, "clone", server.URL+"/remote.git")
+	assert.Equal(t, 0, errcode, stderr)
+	repoDir := cloneDir + "/remote.git"
+	gitCloneDir := dirName + "/git-clone"
+	RunGitCli(dirName, "clone", server.URL+"/remote.git", gitCloneDir)
+
+	stdout, _, _ := RunGitCli(repoDir, "for-each-ref")
+	gitStdout, _, _ := RunGitCli(gitCloneDir, "for-each-ref")
+	assert.Equal(t, gitStdout, stdout)
+	assert.Contains(t, stdout, "refs/remotes/origin/feature")
+	assert.Contains(t, stdout, " tag\trefs/tags/v1")
+	stdout, _, _ = RunGitCli(repoDir, "symbolic-ref", "HEAD")
+	assert.Equal(t, "refs/heads/main\n", stdout)
+	stdout, _, _ = RunGitCli(repoDir, "symbolic-ref", "refs/remotes/origin/HEAD")
+	assert.Equal(t, "refs/remotes/origin/main\n", stdout)
+	stdout, _, _ = RunGitCli(repoDir, "config", "--get-regexp", "^(remote|branch)\\.")
+	assert.Equal(t, "remote.origin.url "+server.URL+"/remote.git\n"+
+		"remote.origin.fetch +refs/heads/*:refs/remotes/origin/*\n"+
+		"branch.main.remote origin\n"+
+		"branch.main.merge refs/heads/main\n", stdout)
+	stdout, _, _ = RunGitCli(repoDir, "status", "-sb")
+	assert.Equal(t, "## main...origin/main\n", stdout)
+	_, stderr, errcode = RunGitCli(repoDir, "fsck", "--strict")
+	assert.Equal(t, 0, errcode, stderr)
+
+	// the branch of a remote HEAD other than main is checked out
+	RunGitCli(remoteDir, "symbolic-ref", "HEAD", "refs/heads/feature")
+	os.RemoveAll(repoDir)
+	_, stderr, errcode = RunMyGitCli(cloneDir, "clone", server.URL+"/remote.git")
+	assert.Equal(t, 0, errcode, stderr)
+	stdout, _, _ = RunGitCli(repoDir, "status", "-sb")
+	assert.Equal(t, "## feature...origin/feature\n", stdout)
+	content, _ := os.ReadFile(repoDir + "/test_file_1.txt")
+	assert.Contains(t, string(content), "hello world 2")
+}
+
+func TestCloneBranchOptions(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	SetupRemoteRepository(dirName)
+	workDir := dirName + "/work"
+	RunGitCli(workDir, "checkout", "-b", "side")
+	os.WriteFile(workDir+"/side.txt", []byte("side\n"), 0644)
+	RunGitCli(workDir, "add", ".")
+	RunGitCli(workDir, "-c", "user.name=test", "-c", "user.email=test@test.com", "commit", "-m", "side")
+	RunGitCli(workDir, "-c", "user.name=test", "-c", "user.email=test@test.com", "tag", "-a", "v2", "-m", "v2")
+	RunGitCli(workDir, "tag", "old", "main~1")
+	RunGitCli(workDir, "push", dirName+"/remote.git", "side", "v2", "old")
+	server := ServeGitRepositories(dirName)
+	defer server.Close()
+
+	cases := [][]string{
+		{},
+		{"--single-branch"},
+		{"--no-tags"},
+		{"--branch", "side", "--single-branch"},
+		{"-b", "side", "--single-branch", "--no-tags"},
+		{"-b", "v2"},
+		{"--single-branch", "-b", "old"},
+	}
+	for i, args := range cases {
+		cloneDir := fmt.Sprintf("%v/clone-%v", dirName, i)
+		os.Mkdir(cloneDir, 0755)
+		_, stderr, errcode := RunMyGitCli(cloneDir, append([]string{"clone", server.URL + "/remote.git"}, args...)...)
+		assert.Equal(t, 0, errcode, stderr)
+		repoDir := cloneDir + "/remote.git"
+		gitCloneDir := fmt.Sprintf("%v/git-clone-%v", dirName, i)
+		RunGitCli(dirName, append([]string{"clone", server.URL + "/remote.git", gitCloneDir}, args...)...)
+
+		for _, gitArgs := range [][]string{
+			{"for-each-ref"},
+			{"rev-parse", "HEAD"},
+			{"symbolic-ref", "-q", "HEAD"},
+			{"config", "--get-regexp", "^(remote|branch)\\."},
+			{"status", "--porcelain"},
+		} {
+			stdout, _, _ := RunGitCli(repoDir, gitArgs...)
+			gitStdout, _, _ := RunGitCli(gitCloneDir, gitArgs...)
+			assert.Equal(t, gitStdout, stdout, "%v %v", args, gitArgs)
+		}
+	}
+
+	stdout, _, _ := RunGitCli(dirName+"/clone-4/remote.git", "for-each-ref", "--format=%(refname)")
+	assert.Equal(t, "refs/heads/side\nrefs/remotes/origin/side\n", stdout)
+	stdout, _, _ = RunGitCli(dirName+"/clone-4/remote.git", "config", "remote.origin.tagOpt")
+	assert.Equal(t, "--no-tags\n", stdout)
+
+	cloneDir := dirName + "/clone-missing"
+	os.Mkdir(cloneDir, 0755)
+	_, stderr, errcode := RunMyGitCli(cloneDir, "clone", "-b", "missing", server.URL+"/remote.git")
+	assert.Equal(t, 1, errcode)
+	assert.Equal(t, "remote branch missing not found in upstream origin\n", stderr)
+	assert.NoDirExists(t, cloneDir+"/remote.git")
+}
+
+func TestCloneEmptyRepository(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	RunGitCli(dirName, "init", "--bare", "remote.git")
+	server := ServeGitRepositories(dirName)
+	defer server.Close()
+
+	cloneDir := dirName + "/clone"
+	os.Mkdir(cloneDir, 0755)
+	_, stderr, errcode := RunMyGitCli(cloneDir, "clone", server.URL+"/remote.git")
+	assert.Equal(t, 0, errcode)
+	assert.Equal(t, "warning: You appear to have cloned an empty repository.\n", stderr)
+	stdout, _, _ := RunGitCli(cloneDir+"/remote.git", "config", "remote.origin.url")
+	assert.Equal(t, server.URL+"/remote.git\n", stdout)
+}
+
+func TestFetch(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	SetupRemoteRepository(dirName)
+	workDir, remoteDir := dirName+"/work", dirName+"/remote.git"
+	RunGitCli(workDir, "push", remoteDir, "main~1:refs/heads/feature")
+	server := ServeGitRepositories(dirName)
+	defer server.Close()
+
+	cloneDir := dirName + "/clone"
+	os.Mkdir(cloneDir, 0755)
+	_, stderr, errcode := RunMyGitCli(cloneDir, "clone", server.URL+"/remote.git")
+	assert.Equal(t, 0, errcode, stderr)
+	repoDir := cloneDir + "/remote.git"
+	gitCloneDir := dirName + "/git-clone"
+	RunGitCli(dirName, "clone", server.URL+"/remote.git", gitCloneDir)
+	oldPacks, _ := filepath.Glob(repoDir + "/.git/objects/pack/*.idx")
+
+	commit := func(message string) {
+		os.WriteFile(workDir+"/test_file_1.txt", []byte(message+"\n"), 0644)
+		RunGitCli(workDir, "-c", "user.name=test", "-c", "user.email=test@test.com", "commit", "-am", message)
+	}
+	commit("commit 4")
+	commit("commit 5")
+	RunGitCli(workDir, "-c", "user.name=test", "-c", "user.email=test@test.com", "tag", "-a", "v2", "-m", "v2", "main~1")
+	RunGitCli(workDir, "checkout", "-b", "side")
+	commit("side")
+	RunGitCli(workDir, "push", remoteDir, "main", "side", "v2")
+	RunGitCli(workDir, "push", "-f", remoteDir, "main~4:refs/heads/feature")
+
+	fetch := func(args ...string) (string, int) {
+		stdout, stderr, errcode := RunMyGitCli(repoDir, append([]string{"fetch"}, args...)...)
+		assert.Equal(t, "", stdout)
+		_, gitStderr, gitErrcode := RunGitCli(gitCloneDir, append([]string{"-c", "protocol.version=0", "fetch"}, args...)...)
+		assert.Equal(t, gitStderr, stderr, args)
+		assert.Equal(t, gitErrcode, errcode, args)
+		for _, gitArgs := range [][]string{{"for-each-ref"}, {"cat-file", "-p", "FETCH_HEAD"}} {
+			stdout, _, _ := RunGitCli(repoDir, gitArgs...)
+			gitStdout, _, _ := RunGitCli(gitCloneDir, gitArgs...)
+			assert.Equal(t, gitStdout, stdout, args)
+		}
+		fetchHead, _ := os.ReadFile(repoDir + "/.git/FETCH_HEAD")
+		gitFetchHead, _ := os.ReadFile(gitCloneDir + "/.git/FETCH_HEAD")
+		assert.Equal(t, string(gitFetchHead), string(fetchHead), args)
+		return stderr, errcode
+	}
+
+	stderr, _ = fetch()
+	assert.Contains(t, stderr, "From "+server.URL+"/remote\n")
+	assert.Contains(t, stderr, " * [new branch]      side       -> origin/side\n")
+	assert.Contains(t, stderr, "(forced update)\n")
+	assert.Contains(t, stderr, " * [new tag]         v2         -> v2\n")
+	// only the 3 new commits with their tree and blob and the tag were sent
+	packs, _ := filepath.Glob(repoDir + "/.git/objects/pack/*.idx")
+	assert.Len(t, packs, len(oldPacks)+1)
+	for _, pack := range packs {
+		if !slices.Contains(oldPacks, pack) {
+			stdout, _, _ := RunGitCli(repoDir, "verify-pack", "-v", pack)
+			assert.Equal(t, 10, strings.Count(stdout, " commit ")+strings.Count(stdout, " tree ")+strings.Count(stdout, " blob ")+strings.Count(stdout, " tag "))
+		}
+	}
+	_, stderr, errcode = RunGitCli(repoDir, "fsck", "--strict")
+	assert.Equal(t, 0, errcode, stderr)
+
+	stderr, _ = fetch()
+	assert.Equal(t, "", stderr)
+	fetch("origin", "side")
+	stderr, errcode = fetch("origin", "feature:refs/remotes/origin/main")
+	assert.Equal(t, 1, errcode)
+	assert.Contains(t, stderr, " ! [rejected]        feature    -> origin/main  (non-fast-forward)\n")
+	fetch("origin", "+feature:refs/remotes/origin/main")
+	fetch(server.URL + "/remote.git")
+}
+
+func TestCloneCorruptedPack(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	SetupRemoteRepository(dirName)
+	gitServer := ServeGitRepositories(dirName)
+	defer gitServer.Close()
+	// flip the last byte of the pack trailer
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := httptest.NewRecorder()
+		gitServer.Config.Handler.ServeHTTP(recorder, r)
+		body := recorder.Body.Bytes()
+		if strings.HasSuffix(r.URL.Path, "/git-upload-pack") {
+			body[len(body)-1] ^= 0xff
+		}
+		w.Header().Set("Content-Type", recorder.Header().Get("Content-Type"))
+		w.WriteHeader(recorder.Code)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	cloneDir := dirName + "/clone"
+	os.Mkdir(cloneDir, 0755)
+	_, stderr, errcode := RunMyGitCli(cloneDir, "clone", server.URL+"/remote.git")
+
+	assert.Equal(t, 1, errcode)
+	assert.Contains(t, stderr, "pack file checksum mismatch")
+	assert.NoDirExists(t, cloneDir+"/remote.git")
+}
+
+func TestCloneUnsafeTree(t *testing.T) {
+	dirName := SetupTestDir()
+	defer CleanTestDir(dirName)
+
+	// each case is the raw entries of a root tree, built with git hash-object --literally since
+	// git mktree refuses these names
+	entry := func(mode string, name string, sha string) string {
+		rawSha, _ := hex.DecodeString(sha)
+		return mode + " " + name + "\x00" + string(rawSha)
+	}
+	workDir := dirName + "/work"
+	os.Mkdir(workDir, 0755)
+	RunGitCli(workDir, "init", "--bare", "-b", "main")
+	blobSha, _, _ := RunGitCliWithStdin(workDir, "escaped\n", "hash-object", "-w", "--stdin")
+	blobSha = strings.TrimSpace(blobSha)
+	linkSha, _, _ := RunGitCliWithStdin(workDir, "..", "hash-object", "-w", "--stdin")
+	linkSha = strings.TrimSpace(linkSha)
+	subTreeSha, _, _ := RunGitCliWithStdin(workDir, fmt.Sprintf("100644 blob %v\tescaped.txt\n100644 blob %v\tconfig\n", blobSha, blobSha), "mktree")
+	subTreeSha = strings.TrimSpace(subTreeSha)
+
+	cases := map[string]string{
+		"dotdot":  entry("40000", "..", subTreeSha),
+		"dotgit":  entry("40000", ".GIT", subTreeSha),
+		"symlink": entry("120000", "a", linkSha) + entry("40000", "a", subTreeSha),
+	}
+	server := ServeGitRepositories(dirName)
+	defer server.Close()
+	for name, tree := range cases {
+		t.Run(name, func(t *testing.T) {
+			remoteDir := dirName + "/" + name + ".git"
+			RunGitCli(dirName, "clone", "--bare", "-q", workDir, remoteDir)
+			treeSha, _, _ := RunGitCliWithStdin(remoteDir, tree, "hash-object", "-t", "tree", "-w", "--literally", "--stdin")
+			commitSha, _, _ := RunGitCli(remoteDir, "-c", "user.name=test", "-c", "user.email=test@test.com", "commit-tree", "-m", "unsafe", strings.TrimSpace(treeSha))
+			RunGitCli(remoteDir, "update-ref", "refs/heads/main", strings.TrimSpace(commitSha))
+
+			cloneDir := dirName + "/clone-" + name
+			os.Mkdir(cloneDir, 0755)
+			_, stderr, errcode := RunMyGitCli(cloneDir, "clone", server.URL+"/"+name+".git")
+
+			assert.Equal(t, 1, errcode)
+			assert.NotEmpty(t, stderr)
+			assert.NoDirExists(t, cloneDir+"/"+name)
+			assert.NoFileExists(t, cloneDir+"/escaped.txt")
+			assert.NoFileExists(t, dirName+"/escaped.txt")
+		})
+	}
+}